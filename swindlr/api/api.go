@@ -3,6 +3,7 @@ package api
 import (
 	"net/http"
 	"net/url"
+	"strings"
 
 	"github.com/b0gdanp3trovic/swindlr/loadbalancer"
 	"github.com/gin-gonic/gin"
@@ -10,7 +11,11 @@ import (
 
 func AddBackend(c *gin.Context, serverPool *loadbalancer.ServerPool) {
 	var input struct {
-		URL string `json:"URL"`
+		URL            string   `json:"URL"`
+		Tags           []string `json:"tags"`
+		Region         string   `json:"region"`
+		Zone           string   `json:"zone"`
+		MaxConnections int      `json:"max_connections"`
 	}
 
 	if err := c.BindJSON(&input); err != nil {
@@ -18,13 +23,23 @@ func AddBackend(c *gin.Context, serverPool *loadbalancer.ServerPool) {
 		return
 	}
 
+	if input.MaxConnections < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "max_connections can't be negative"})
+		return
+	}
+
 	parsedUrl, err := url.Parse(input.URL)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid URL format"})
 		return
 	}
 
-	serverPool.AddBackend(loadbalancer.CreateNewBackend(parsedUrl, serverPool))
+	backend := loadbalancer.CreateNewBackend(parsedUrl, serverPool)
+	backend.Tags = input.Tags
+	backend.Region = strings.ToLower(input.Region)
+	backend.Zone = input.Zone
+	backend.MaxConnections = input.MaxConnections
+	serverPool.AddBackend(backend)
 	c.JSON(http.StatusOK, gin.H{"message": "Backend added successfully"})
 }
 
@@ -36,3 +51,165 @@ func RemoveBackend(c *gin.Context, serverPool *loadbalancer.ServerPool) {
 	}
 	c.JSON(http.StatusOK, gin.H{"message": "Backend removed successfully"})
 }
+
+func GetSplits(c *gin.Context, router *loadbalancer.Router) {
+	splits := []gin.H{}
+	for _, split := range router.Splits() {
+		splits = append(splits, gin.H{
+			"name":        split.Name,
+			"path_prefix": split.PathPrefix,
+			"hash_on":     split.HashOn,
+			"hash_key":    split.HashKey,
+			"weights":     split.Weights(),
+		})
+	}
+	c.JSON(http.StatusOK, splits)
+}
+
+func UpdateSplit(c *gin.Context, router *loadbalancer.Router) {
+	var input struct {
+		Weights []loadbalancer.SplitWeight `json:"weights"`
+	}
+
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := router.SetSplitWeights(c.Param("name"), input.Weights); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Split updated successfully"})
+}
+
+func Metrics(c *gin.Context) {
+	c.Header("Content-Type", "text/plain; version=0.0.4")
+	c.Status(http.StatusOK)
+	loadbalancer.DefaultMetrics.WritePrometheus(c.Writer)
+}
+
+func GetRules(c *gin.Context, router *loadbalancer.Router) {
+	c.JSON(http.StatusOK, router.Rules())
+}
+
+func AddRule(c *gin.Context, router *loadbalancer.Router) {
+	var input struct {
+		loadbalancer.RoutingRule
+		Position *int `json:"position"`
+	}
+
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	position := -1
+	if input.Position != nil {
+		position = *input.Position
+	}
+
+	if err := router.AddRule(&input.RoutingRule, position); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Rule added successfully"})
+}
+
+func SetRules(c *gin.Context, router *loadbalancer.Router) {
+	var rules []*loadbalancer.RoutingRule
+
+	if err := c.BindJSON(&rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := router.SetRules(rules); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Rules replaced successfully"})
+}
+
+func RemoveRule(c *gin.Context, router *loadbalancer.Router) {
+	if err := router.RemoveRule(c.Param("name")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Rule removed successfully"})
+}
+
+func ConcurrencyLimits(c *gin.Context, router *loadbalancer.Router) {
+	pools := gin.H{}
+	for name, sp := range router.Pools() {
+		backends := []gin.H{}
+		for _, backend := range sp.Backends() {
+			details := gin.H{
+				"url":             backend.URL.String(),
+				"max_connections": backend.MaxConnections,
+				"limit":           backend.ConnectionLimit(),
+			}
+			if backend.Adaptive != nil {
+				details["adaptive_limit"] = backend.Adaptive.Limit()
+				details["inflight"] = backend.Adaptive.Inflight()
+			}
+			backends = append(backends, details)
+		}
+		pools[name] = backends
+	}
+	c.JSON(http.StatusOK, pools)
+}
+
+func CacheStats(c *gin.Context, cache *loadbalancer.Cache) {
+	c.JSON(http.StatusOK, cache.Stats())
+}
+
+func PurgeCache(c *gin.Context, cache *loadbalancer.Cache, audit *AuditLog) {
+	var input struct {
+		loadbalancer.PurgeSelector
+		Ban bool `json:"ban"`
+	}
+
+	if err := c.BindJSON(&input); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	details := gin.H{
+		"key":    input.Key,
+		"url":    input.URL,
+		"prefix": input.Prefix,
+		"glob":   input.Glob,
+		"tag":    input.Tag,
+	}
+	for k, v := range details {
+		if v == "" {
+			delete(details, k)
+		}
+	}
+
+	if input.Ban {
+		if err := cache.Ban(input.PurgeSelector); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		audit.Record(c, "cache_ban", details)
+		c.JSON(http.StatusOK, gin.H{"message": "Ban added successfully"})
+		return
+	}
+
+	purged, err := cache.Purge(input.PurgeSelector)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	details["purged"] = purged
+	audit.Record(c, "cache_purge", details)
+	c.JSON(http.StatusOK, gin.H{"message": "Cache purged successfully", "purged": purged})
+}
+
+func FlushCache(c *gin.Context, cache *loadbalancer.Cache, audit *AuditLog) {
+	purged := cache.Flush()
+	audit.Record(c, "cache_flush", gin.H{"purged": purged})
+	c.JSON(http.StatusOK, gin.H{"message": "Cache flushed successfully", "purged": purged})
+}
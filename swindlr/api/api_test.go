@@ -0,0 +1,53 @@
+package api
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/b0gdanp3trovic/swindlr/loadbalancer"
+	"github.com/gin-gonic/gin"
+	"github.com/stretchr/testify/assert"
+)
+
+func addBackend(serverPool *loadbalancer.ServerPool, body string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	w := httptest.NewRecorder()
+	c, _ := gin.CreateTestContext(w)
+	c.Request = httptest.NewRequest(http.MethodPost, "/api/backends", strings.NewReader(body))
+	c.Request.Header.Set("Content-Type", "application/json")
+	AddBackend(c, serverPool)
+	return w
+}
+
+func TestAddBackendMaxConnections(t *testing.T) {
+	serverPool := &loadbalancer.ServerPool{}
+
+	w := addBackend(serverPool, `{"URL": "http://localhost:8081", "zone": "a", "max_connections": 10}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	backends := serverPool.Backends()
+	if assert.Len(t, backends, 1) {
+		assert.Equal(t, 10, backends[0].MaxConnections)
+		assert.Equal(t, 10, backends[0].ConnectionLimit())
+	}
+
+	w = addBackend(serverPool, `{"URL": "http://localhost:8082"}`)
+	assert.Equal(t, http.StatusOK, w.Code)
+	backends = serverPool.Backends()
+	if assert.Len(t, backends, 2) {
+		assert.Equal(t, 0, backends[1].MaxConnections)
+	}
+}
+
+func TestAddBackendInvalidMaxConnections(t *testing.T) {
+	serverPool := &loadbalancer.ServerPool{}
+
+	w := addBackend(serverPool, `{"URL": "http://localhost:8081", "max_connections": -1}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Contains(t, w.Body.String(), "max_connections")
+
+	w = addBackend(serverPool, `{"URL": "http://localhost:8081", "max_connections": "ten"}`)
+	assert.Equal(t, http.StatusBadRequest, w.Code)
+	assert.Empty(t, serverPool.Backends())
+}
@@ -0,0 +1,60 @@
+package api
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AuditEntry struct {
+	Time    time.Time `json:"time"`
+	Action  string    `json:"action"`
+	Client  string    `json:"client"`
+	Details gin.H     `json:"details,omitempty"`
+}
+
+// AuditLog records administrative actions. They are written to the log
+// and the most recent ones are kept in memory for the API.
+type AuditLog struct {
+	entries    []AuditEntry
+	maxEntries int
+	mux        sync.Mutex
+}
+
+func NewAuditLog(maxEntries int) *AuditLog {
+	return &AuditLog{maxEntries: maxEntries}
+}
+
+func (a *AuditLog) Record(c *gin.Context, action string, details gin.H) {
+	entry := AuditEntry{
+		Time:    time.Now(),
+		Action:  action,
+		Client:  c.ClientIP(),
+		Details: details,
+	}
+
+	encoded, _ := json.Marshal(entry.Details)
+	log.Printf("audit: %s by %s: %s", entry.Action, entry.Client, encoded)
+
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	a.entries = append(a.entries, entry)
+	if a.maxEntries > 0 && len(a.entries) > a.maxEntries {
+		a.entries = append([]AuditEntry(nil), a.entries[len(a.entries)-a.maxEntries:]...)
+	}
+}
+
+// Entries returns the recorded entries, oldest first.
+func (a *AuditLog) Entries() []AuditEntry {
+	a.mux.Lock()
+	defer a.mux.Unlock()
+	return append([]AuditEntry{}, a.entries...)
+}
+
+func GetAuditLog(c *gin.Context, audit *AuditLog) {
+	c.JSON(http.StatusOK, audit.Entries())
+}
@@ -3,7 +3,9 @@ package main
 import (
 	"log"
 	"os"
+	"time"
 
+	"github.com/b0gdanp3trovic/swindlr/loadbalancer"
 	"github.com/spf13/viper"
 )
 
@@ -51,6 +53,20 @@ func checkLoadBalancerStrategy() {
 	log.Printf("Load balancing strategy '%s' is set.", strategy)
 }
 
+func checkGeoRoutingConfig() {
+	if !viper.GetBool("use_geo_routing") {
+		return
+	}
+
+	database := viper.GetString("geo_routing.database")
+	if database == "" {
+		log.Fatal("Error: Geo routing is enabled but 'geo_routing.database' is not specified.")
+	}
+	if _, err := os.Stat(database); os.IsNotExist(err) {
+		log.Fatalf("Error: GeoIP database '%s' not found.", database)
+	}
+}
+
 func initConfig(customPath string) {
 	viper.SetConfigName("config")
 	viper.SetConfigType("yaml")
@@ -71,12 +87,98 @@ func initConfig(customPath string) {
 	viper.SetDefault("ssl_key_file", "")
 	viper.SetDefault("use_dynamic", false)
 	viper.SetDefault("apiPort", 8082)
+	viper.SetDefault("audit_log.max_entries", 1000)
 	viper.SetDefault("load_balancer.strategy", "round_robin")
 	viper.SetDefault("use_sticky_sessions", false)
 	viper.SetDefault("rate_limiting.rate", 10.0)
 	viper.SetDefault("rate_limiting.bucket_size", 5)
+	viper.SetDefault("rate_limiting.global", "")
+	viper.SetDefault("rate_limiting.max_clients", 100000)
+	viper.SetDefault("rate_limiting.response.status", 429)
+	viper.SetDefault("rate_limiting.response.body", "Rate limit exceeded\n")
+	viper.SetDefault("rate_limiting.response.content_type", "text/plain; charset=utf-8")
+	viper.SetDefault("rate_limiting.response.retry_after", true)
+	viper.SetDefault("max_connections", 0)
+	viper.SetDefault("connection_queue.timeout", 0)
+	viper.SetDefault("connection_queue.retry_after", time.Second)
+	viper.SetDefault("adaptive_concurrency.enabled", false)
+	viper.SetDefault("adaptive_concurrency.algorithm", "gradient")
+	viper.SetDefault("adaptive_concurrency.initial_limit", 20)
+	viper.SetDefault("adaptive_concurrency.min_limit", 1)
+	viper.SetDefault("adaptive_concurrency.max_limit", 1000)
+	viper.SetDefault("adaptive_concurrency.backoff", 0.9)
+	viper.SetDefault("adaptive_concurrency.timeout", 5*time.Second)
+	viper.SetDefault("adaptive_concurrency.tolerance", 2.0)
+	viper.SetDefault("adaptive_concurrency.smoothing", 0.2)
+	viper.SetDefault("rate_limiting.queue.enabled", false)
+	viper.SetDefault("rate_limiting.queue.max_delay", time.Second)
+	viper.SetDefault("rate_limiting.queue.max_depth", 100)
+	viper.SetDefault("rate_limiting.store", "local")
+	viper.SetDefault("rate_limiting.redis.address", "localhost:6379")
+	viper.SetDefault("rate_limiting.redis.password", "")
+	viper.SetDefault("rate_limiting.redis.db", 0)
+	viper.SetDefault("rate_limiting.redis.key_prefix", "swindlr:ratelimit:")
+	viper.SetDefault("rate_limiting.redis.timeout", 100*time.Millisecond)
+	viper.SetDefault("rate_limiting.redis.pool_size", 10)
+	viper.SetDefault("rate_limiting.redis.batch_size", 10)
+	viper.SetDefault("rate_limiting.redis.fail_open", true)
+	viper.SetDefault("rate_limiting.redis.retry_interval", time.Second)
+	viper.SetDefault("client_rate_limiting.enabled", false)
+	viper.SetDefault("client_rate_limiting.key", "ip")
+	viper.SetDefault("client_rate_limiting.header", "X-API-Key")
+	viper.SetDefault("client_rate_limiting.rate", 10.0)
+	viper.SetDefault("client_rate_limiting.burst", 20)
+	viper.SetDefault("client_rate_limiting.max_clients", 100000)
+	viper.SetDefault("client_rate_limiting.idle_timeout", 10*time.Minute)
+	viper.SetDefault("client_rate_limiting.allow_ips", []string{})
+	viper.SetDefault("client_rate_limiting.allow_keys", []string{})
+	viper.SetDefault("jwt.secret", "")
+	viper.SetDefault("jwt.public_key_file", "")
+	viper.SetDefault("jwt.leeway", 30*time.Second)
+	viper.SetDefault("trusted_proxies", []string{})
 	viper.SetDefault("use_geo_routing", false)
+	viper.SetDefault("geo_routing.database", "")
+	viper.SetDefault("zone", "")
+	viper.SetDefault("zone_aware_routing.enabled", false)
+	viper.SetDefault("zone_aware_routing.min_healthy_percent", 70.0)
 	viper.SetDefault("use_cache", false)
+	viper.SetDefault("cache.store", "memory")
+	viper.SetDefault("cache.redis.address", "localhost:6379")
+	viper.SetDefault("cache.redis.password", "")
+	viper.SetDefault("cache.redis.db", 0)
+	viper.SetDefault("cache.redis.key_prefix", "swindlr:cache:")
+	viper.SetDefault("cache.redis.timeout", time.Second)
+	viper.SetDefault("cache.redis.pool_size", 10)
+	viper.SetDefault("cache.default_ttl", 5*time.Minute)
+	viper.SetDefault("cache.max_bytes", 64<<20)
+	viper.SetDefault("cache.max_entries", 10000)
+	viper.SetDefault("cache.max_object_size", 1<<20)
+	viper.SetDefault("cache.janitor_interval", time.Minute)
+	viper.SetDefault("cache.coalesce_timeout", 5*time.Second)
+	viper.SetDefault("cache.stale_while_revalidate", 0)
+	viper.SetDefault("cache.stale_if_error", 0)
+	viper.SetDefault("cache.revalidation_retention", time.Hour)
+	viper.SetDefault("cache.range_fill", false)
+	viper.SetDefault("cache.status_ttls", map[string]string{})
+	viper.SetDefault("cache.disk.path", "")
+	viper.SetDefault("cache.disk.max_bytes", 1<<30)
+	viper.SetDefault("cache.disk.promote_hits", 2)
+	viper.SetDefault("cache.disk.sync_interval", 10*time.Second)
+	viper.SetDefault("cache.disk.write_queue", 100)
+	viper.SetDefault("cache.compression.enabled", false)
+	viper.SetDefault("cache.compression.encoding", "gzip")
+	viper.SetDefault("cache.compression.min_size", 1024)
+	viper.SetDefault("cache.compression.types", loadbalancer.DefaultCompressibleTypes)
+	viper.SetDefault("cache.key.include_method", true)
+	viper.SetDefault("cache.key.include_scheme", true)
+	viper.SetDefault("cache.key.include_host", true)
+	viper.SetDefault("cache.key.include_query", true)
+	viper.SetDefault("mirror.pool", "")
+	viper.SetDefault("mirror.sample_rate", 1.0)
+	viper.SetDefault("mirror.max_body_bytes", 1<<20)
+	viper.SetDefault("mirror.timeout", 5*time.Second)
+	viper.SetDefault("mirror.workers", 4)
+	viper.SetDefault("mirror.queue_size", 100)
 
 	// Read the config file
 	if err := viper.ReadInConfig(); err != nil {
@@ -88,4 +190,5 @@ func initConfig(customPath string) {
 	//Validate
 	checkSSLConfig()
 	checkLoadBalancerStrategy()
+	checkGeoRoutingConfig()
 }
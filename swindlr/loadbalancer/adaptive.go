@@ -0,0 +1,245 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// AdaptiveLimitConfig configures an adaptive concurrency limit, which
+// caps the requests in flight to a backend based on the latency and
+// errors of its responses. Algorithm is one of:
+//   - aimd: the limit grows by one for each successful request while the
+//     backend is in use, and is cut by Backoff when a request takes
+//     longer than Timeout
+//   - gradient: the limit follows the ratio of the long term latency to
+//     the latest one, growing while latency holds and shrinking as it
+//     rises, up to Tolerance times the long term latency
+//
+// With either algorithm, failed requests cut the limit by Backoff.
+type AdaptiveLimitConfig struct {
+	Algorithm    string        `mapstructure:"algorithm"`
+	InitialLimit int           `mapstructure:"initial_limit"`
+	MinLimit     int           `mapstructure:"min_limit"`
+	MaxLimit     int           `mapstructure:"max_limit"`
+	Backoff      float64       `mapstructure:"backoff"`
+	Timeout      time.Duration `mapstructure:"timeout"`
+	Tolerance    float64       `mapstructure:"tolerance"`
+	Smoothing    float64       `mapstructure:"smoothing"`
+}
+
+func (c *AdaptiveLimitConfig) validate() error {
+	switch c.Algorithm {
+	case "aimd", "gradient":
+	default:
+		return fmt.Errorf("invalid adaptive concurrency algorithm %q", c.Algorithm)
+	}
+	if c.MinLimit < 1 || c.MaxLimit < c.MinLimit {
+		return fmt.Errorf("adaptive concurrency limits need 1 <= min_limit <= max_limit")
+	}
+	if c.InitialLimit < c.MinLimit || c.InitialLimit > c.MaxLimit {
+		return fmt.Errorf("adaptive concurrency initial_limit must be between min_limit and max_limit")
+	}
+	if c.Backoff <= 0 || c.Backoff >= 1 {
+		return fmt.Errorf("adaptive concurrency backoff must be between 0 and 1")
+	}
+	if c.Algorithm == "gradient" && (c.Tolerance < 1 || c.Smoothing <= 0 || c.Smoothing > 1) {
+		return fmt.Errorf("adaptive concurrency needs tolerance >= 1 and smoothing in (0, 1]")
+	}
+	return nil
+}
+
+// The long term latency of the gradient algorithm is a plain average over
+// the first samples, then an exponential one over about longWindow samples.
+const (
+	longWarmup = 10
+	longWindow = 600
+)
+
+// AdaptiveLimiter adjusts a backend's concurrency limit from the
+// requests it serves.
+type AdaptiveLimiter struct {
+	config   AdaptiveLimitConfig
+	limit    float64
+	inflight int
+	// longRTT is the long term latency in seconds, for gradient
+	longRTT float64
+	samples int
+	labels  Labels
+	mux     sync.Mutex
+}
+
+func NewAdaptiveLimiter(config AdaptiveLimitConfig, labels Labels) (*AdaptiveLimiter, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	l := &AdaptiveLimiter{config: config, limit: float64(config.InitialLimit), labels: labels}
+	DefaultMetrics.SetGauge("swindlr_adaptive_concurrency_limit", labels, l.limit)
+	return l, nil
+}
+
+// Limit returns the current limit.
+func (l *AdaptiveLimiter) Limit() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return int(l.limit)
+}
+
+// Inflight returns the number of requests being measured.
+func (l *AdaptiveLimiter) Inflight() int {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	return l.inflight
+}
+
+func (l *AdaptiveLimiter) start() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.inflight++
+}
+
+// abandon ends a request without taking its latency into account.
+func (l *AdaptiveLimiter) abandon() {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+	l.inflight--
+}
+
+// finish ends a request and adjusts the limit from its outcome.
+func (l *AdaptiveLimiter) finish(rtt time.Duration, failed bool) {
+	l.mux.Lock()
+	defer l.mux.Unlock()
+
+	// inflight still counts this request, as when it was sent
+	inflight := float64(l.inflight)
+	l.inflight--
+
+	switch {
+	case failed:
+		l.limit *= l.config.Backoff
+	case l.config.Algorithm == "aimd":
+		if l.config.Timeout > 0 && rtt > l.config.Timeout {
+			l.limit *= l.config.Backoff
+		} else if inflight*2 >= l.limit {
+			l.limit++
+		}
+	default:
+		l.gradient(rtt.Seconds(), inflight)
+	}
+
+	l.limit = math.Max(float64(l.config.MinLimit), math.Min(float64(l.config.MaxLimit), l.limit))
+	DefaultMetrics.SetGauge("swindlr_adaptive_concurrency_limit", l.labels, l.limit)
+}
+
+// gradient moves the limit towards its current value scaled by how the
+// latency compares to the long term one, plus some room for queueing.
+func (l *AdaptiveLimiter) gradient(rtt, inflight float64) {
+	if rtt <= 0 {
+		return
+	}
+	l.samples++
+	if l.samples <= longWarmup {
+		l.longRTT += (rtt - l.longRTT) / float64(l.samples)
+	} else {
+		l.longRTT += (rtt - l.longRTT) * 2 / (longWindow + 1)
+	}
+	// Let the long term latency catch up when latency drops for good
+	if l.longRTT/rtt > 2 {
+		l.longRTT *= 0.95
+	}
+
+	// The latency of a backend that isn't in use says little about its
+	// capacity
+	if inflight < l.limit/2 {
+		return
+	}
+
+	gradient := math.Max(0.5, math.Min(1, l.config.Tolerance*l.longRTT/rtt))
+	target := l.limit*gradient + math.Sqrt(l.limit)
+	l.limit = l.limit*(1-l.config.Smoothing) + target*l.config.Smoothing
+}
+
+// statusRecorder keeps the status of the response passed through it, and
+// when its headers were written.
+type statusRecorder struct {
+	http.ResponseWriter
+	status  int
+	headers time.Time
+}
+
+func (w *statusRecorder) record(status int) {
+	if w.status == 0 {
+		w.status = status
+		w.headers = time.Now()
+	}
+}
+
+func (w *statusRecorder) WriteHeader(status int) {
+	w.record(status)
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	w.record(http.StatusOK)
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *statusRecorder) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// AdaptiveConcurrencyMiddleware measures the requests sent to a backend,
+// adjusting its limit. Latency is measured up to the response headers, so
+// slow clients and long bodies don't count against the backend. Server
+// errors count as failures, while requests abandoned by the client aren't
+// taken into account.
+func AdaptiveConcurrencyMiddleware(l *AdaptiveLimiter, next http.Handler) http.Handler {
+	if l == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusRecorder{ResponseWriter: w}
+		start := time.Now()
+		l.start()
+		next.ServeHTTP(recorder, r)
+
+		if r.Context().Err() != nil {
+			l.abandon()
+			return
+		}
+		rtt := time.Since(start)
+		if !recorder.headers.IsZero() {
+			rtt = recorder.headers.Sub(start)
+		}
+		l.finish(rtt, recorder.status >= http.StatusInternalServerError)
+	})
+}
+
+// SetupAdaptiveLimiter returns the adaptive limiter of a new backend, or
+// nil if adaptive concurrency limiting is disabled.
+func SetupAdaptiveLimiter(backend string) *AdaptiveLimiter {
+	if !viper.GetBool("adaptive_concurrency.enabled") {
+		return nil
+	}
+
+	var config AdaptiveLimitConfig
+	if err := viper.UnmarshalKey("adaptive_concurrency", &config); err != nil {
+		log.Fatalf("Error parsing adaptive concurrency: %s", err)
+	}
+	limiter, err := NewAdaptiveLimiter(config, Labels{"backend": backend})
+	if err != nil {
+		log.Fatalf("Error setting up adaptive concurrency: %s", err)
+	}
+	return limiter
+}
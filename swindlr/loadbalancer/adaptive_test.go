@@ -0,0 +1,157 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func newTestAdaptiveLimiter(t *testing.T, config AdaptiveLimitConfig) *AdaptiveLimiter {
+	limiter, err := NewAdaptiveLimiter(config, Labels{"backend": t.Name()})
+	if err != nil {
+		t.Fatalf("Failed to create adaptive limiter: %s", err)
+	}
+	return limiter
+}
+
+func TestAIMDLimit(t *testing.T) {
+	l := newTestAdaptiveLimiter(t, AdaptiveLimitConfig{
+		Algorithm: "aimd", InitialLimit: 10, MinLimit: 2, MaxLimit: 12, Backoff: 0.5, Timeout: 100 * time.Millisecond,
+	})
+
+	// An idle backend doesn't grow the limit
+	l.start()
+	l.finish(10*time.Millisecond, false)
+	if l.Limit() != 10 {
+		t.Errorf("Expected the limit to stay at 10, got %d", l.Limit())
+	}
+
+	for i := 0; i < 10; i++ {
+		l.start()
+	}
+	for i := 0; i < 5; i++ {
+		l.finish(10*time.Millisecond, false)
+	}
+	if l.Limit() != 12 {
+		t.Errorf("Expected the limit to grow up to max_limit, got %d", l.Limit())
+	}
+
+	l.finish(200*time.Millisecond, false)
+	if l.Limit() != 6 {
+		t.Errorf("Expected slow requests to halve the limit, got %d", l.Limit())
+	}
+	l.finish(10*time.Millisecond, true)
+	l.finish(10*time.Millisecond, true)
+	if l.Limit() != 2 {
+		t.Errorf("Expected failures to cut the limit down to min_limit, got %d", l.Limit())
+	}
+	if l.Inflight() != 2 {
+		t.Errorf("Expected 2 requests in flight, got %d", l.Inflight())
+	}
+}
+
+func TestGradientLimit(t *testing.T) {
+	l := newTestAdaptiveLimiter(t, AdaptiveLimitConfig{
+		Algorithm: "gradient", InitialLimit: 20, MinLimit: 1, MaxLimit: 100, Backoff: 0.9, Tolerance: 1.5, Smoothing: 0.5,
+	})
+	for i := 0; i < 100; i++ {
+		l.start()
+	}
+
+	for i := 0; i < 20; i++ {
+		l.finish(10*time.Millisecond, false)
+		l.start()
+	}
+	grown := l.Limit()
+	if grown <= 20 {
+		t.Errorf("Expected steady latency to grow the limit, got %d", grown)
+	}
+
+	for i := 0; i < 10; i++ {
+		l.finish(100*time.Millisecond, false)
+		l.start()
+	}
+	if l.Limit() >= grown {
+		t.Errorf("Expected rising latency to shrink the limit below %d, got %d", grown, l.Limit())
+	}
+}
+
+func TestAdaptiveLimitSaturatesBackend(t *testing.T) {
+	sp := NewServerPool(&RoundRobin{})
+	backend := &Backend{URL: parseURL("http://adaptive.test"), Alive: true, MaxConnections: 10}
+	backend.Adaptive = newTestAdaptiveLimiter(t, AdaptiveLimitConfig{
+		Algorithm: "aimd", InitialLimit: 1, MinLimit: 1, MaxLimit: 5, Backoff: 0.5,
+	})
+	sp.backends = []*Backend{backend}
+	req := httptest.NewRequest("GET", "/", nil)
+
+	if backend.ConnectionLimit() != 1 {
+		t.Errorf("Expected the adaptive limit to apply, got %d", backend.ConnectionLimit())
+	}
+	peer, err := sp.AcquirePeer(req)
+	if err != nil || peer != backend {
+		t.Fatalf("Expected the backend, got %v", err)
+	}
+	if _, err := sp.AcquirePeer(req); err != errPoolSaturated {
+		t.Errorf("Expected the backend to be saturated at its adaptive limit, got %v", err)
+	}
+	sp.ReleasePeer(peer)
+}
+
+func TestAdaptiveConcurrencyMiddleware(t *testing.T) {
+	l := newTestAdaptiveLimiter(t, AdaptiveLimitConfig{
+		Algorithm: "aimd", InitialLimit: 10, MinLimit: 1, MaxLimit: 20, Backoff: 0.5,
+	})
+	handler := AdaptiveConcurrencyMiddleware(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if l.Limit() != 5 {
+		t.Errorf("Expected a server error to cut the limit, got %d", l.Limit())
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+	if l.Limit() != 5 {
+		t.Errorf("Expected abandoned requests to be ignored, got %d", l.Limit())
+	}
+	if l.Inflight() != 0 {
+		t.Errorf("Expected no requests in flight, got %d", l.Inflight())
+	}
+}
+
+func TestAdaptiveConcurrencyIgnoresBody(t *testing.T) {
+	l := newTestAdaptiveLimiter(t, AdaptiveLimitConfig{
+		Algorithm: "aimd", InitialLimit: 2, MinLimit: 1, MaxLimit: 20, Backoff: 0.5, Timeout: 50 * time.Millisecond,
+	})
+	// A quick response with a slowly streamed body
+	handler := AdaptiveConcurrencyMiddleware(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("done"))
+	}))
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	if l.Limit() != 3 {
+		t.Errorf("Expected the response to count as fast, got a limit of %d", l.Limit())
+	}
+}
+
+func TestAdaptiveLimitValidation(t *testing.T) {
+	configs := []AdaptiveLimitConfig{
+		{Algorithm: "vegas", InitialLimit: 10, MinLimit: 1, MaxLimit: 20, Backoff: 0.5},
+		{Algorithm: "aimd", InitialLimit: 10, MinLimit: 0, MaxLimit: 20, Backoff: 0.5},
+		{Algorithm: "aimd", InitialLimit: 30, MinLimit: 1, MaxLimit: 20, Backoff: 0.5},
+		{Algorithm: "aimd", InitialLimit: 10, MinLimit: 1, MaxLimit: 20, Backoff: 1},
+		{Algorithm: "gradient", InitialLimit: 10, MinLimit: 1, MaxLimit: 20, Backoff: 0.5, Tolerance: 0.5, Smoothing: 0.2},
+	}
+	for i, config := range configs {
+		if _, err := NewAdaptiveLimiter(config, nil); err == nil {
+			t.Errorf("Expected an error for config %d", i)
+		}
+	}
+}
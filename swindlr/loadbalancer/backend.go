@@ -19,7 +19,21 @@ type Backend struct {
 	Connections  int
 	SessionMap   map[string]*Backend
 	Limiter      *rate.Limiter
-	Latency      time.Duration
+	// sharedLimit replaces Limiter when limits are shared across replicas
+	sharedLimit limitState
+	Latency     time.Duration
+	Tags        []string
+	Region      string
+	Zone        string
+	// MaxConnections caps the requests in flight to the backend, if set
+	MaxConnections int
+	// Adaptive lowers the cap further, from the backend's latency
+	Adaptive *AdaptiveLimiter
+	// Requests over the limit wait up to queueDelay for their turn, with
+	// at most queueDepth of them waiting at once
+	queueDelay time.Duration
+	queueDepth int
+	queued     int
 }
 
 func (b *Backend) setAlive(alive bool) {
@@ -34,6 +48,23 @@ func (b *Backend) setLatency(latency time.Duration) {
 	b.mux.Unlock()
 }
 
+// HasTags reports whether the backend carries every one of the given tags.
+func (b *Backend) HasTags(tags []string) bool {
+	for _, tag := range tags {
+		found := false
+		for _, own := range b.Tags {
+			if own == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
 func (b *Backend) IncrementConnections() {
 	b.mux.Lock()
 	defer b.mux.Unlock()
@@ -46,26 +77,162 @@ func (b *Backend) DecrementConnections() {
 	b.Connections--
 }
 
+// ConnectionLimit returns the lower of MaxConnections and the adaptive
+// limit, or zero if there's neither.
+func (b *Backend) ConnectionLimit() int {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	return b.connectionLimit()
+}
+
+// connectionLimit must be called with the lock held.
+func (b *Backend) connectionLimit() int {
+	limit := b.MaxConnections
+	if b.Adaptive != nil {
+		if adaptive := b.Adaptive.Limit(); limit == 0 || adaptive < limit {
+			limit = adaptive
+		}
+	}
+	return limit
+}
+
+// saturated reports whether the backend is at its connection limit.
+func (b *Backend) saturated() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	limit := b.connectionLimit()
+	return limit > 0 && b.Connections >= limit
+}
+
+// available reports whether the backend is alive and below its
+// connection limit.
+func (b *Backend) available() bool {
+	b.mux.RLock()
+	defer b.mux.RUnlock()
+	limit := b.connectionLimit()
+	return b.Alive && (limit == 0 || b.Connections < limit)
+}
+
+// tryAcquire takes a connection slot of the backend, unless it's
+// saturated.
+func (b *Backend) tryAcquire() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if limit := b.connectionLimit(); limit > 0 && b.Connections >= limit {
+		return false
+	}
+	b.Connections++
+	return true
+}
+
+// enqueue adds a request to the backend's queue, unless it's full.
+func (b *Backend) enqueue() bool {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	if b.queued >= b.queueDepth {
+		return false
+	}
+	b.queued++
+	DefaultMetrics.SetGauge("swindlr_rate_limit_queue_depth", Labels{"backend": b.URL.Host}, float64(b.queued))
+	return true
+}
+
+func (b *Backend) dequeue() {
+	b.mux.Lock()
+	defer b.mux.Unlock()
+	b.queued--
+	DefaultMetrics.SetGauge("swindlr_rate_limit_queue_depth", Labels{"backend": b.URL.Host}, float64(b.queued))
+}
+
 func CreateNewBackend(serverURL *url.URL, serverPool *ServerPool) *Backend {
 	r := float64(viper.GetInt("rate_limiting.rate"))
 	bucketSize := viper.GetInt("rate_limiting.bucket_size")
 
 	limiter := rate.NewLimiter(rate.Limit(r), bucketSize)
-	return &Backend{
+	backend := &Backend{
 		URL:          serverURL,
 		Alive:        true,
 		ReverseProxy: CreateReverseProxy(serverURL, serverPool),
 		Limiter:      limiter,
+		Adaptive:     SetupAdaptiveLimiter(serverURL.Host),
+	}
+	if viper.GetBool("rate_limiting.queue.enabled") {
+		backend.queueDelay = viper.GetDuration("rate_limiting.queue.max_delay")
+		backend.queueDepth = viper.GetInt("rate_limiting.queue.max_depth")
+	}
+	// Shared, the limit is a bucket's worth of requests per time it takes
+	// to refill the bucket
+	if sharedRateLimits != nil && r > 0 && bucketSize > 0 {
+		period := time.Duration(float64(bucketSize) / r * float64(time.Second))
+		backend.sharedLimit = sharedRateLimits.newState("backend:"+hashKey(serverURL.String()), bucketSize, period)
 	}
+	return backend
 }
 
 func RateLimitMiddleware(next http.Handler, backend *Backend) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !backend.Limiter.Allow() {
-			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
-			return
+		r, turn, ok := backend.admit(w, r)
+		if ok && turn.wait(r) {
+			next.ServeHTTP(w, r)
 		}
-
-		next.ServeHTTP(w, r)
 	})
 }
+
+// rateLimitTurn is a request queued for its turn under a backend's rate
+// limit.
+type rateLimitTurn struct {
+	backend     *Backend
+	reservation *rate.Reservation
+	queued      time.Time
+	delay       time.Duration
+}
+
+// admit checks the request against the backend's rate limit, rejecting
+// it if it's over the limit and can't be queued. A queued request has to
+// wait for its turn before it's sent.
+func (b *Backend) admit(w http.ResponseWriter, r *http.Request) (*http.Request, *rateLimitTurn, bool) {
+	now := time.Now()
+	var status rateLimitStatus
+	var reservation *rate.Reservation
+	var delay time.Duration
+	if b.sharedLimit != nil {
+		status = b.sharedLimit.take(now)
+	} else {
+		status, reservation, delay = reserveToken(b.Limiter, now, b.queueDelay)
+	}
+	if delay > 0 && !b.enqueue() {
+		reservation.CancelAt(now)
+		status.allowed = false
+		status.retryAfter = delay
+	}
+	r = reportRateLimit(w, r, status)
+	if !status.allowed {
+		DefaultMetrics.IncCounter("swindlr_rate_limited_total", Labels{"scope": "backend"})
+		rejectRateLimited(w, status.retryAfter)
+		return r, nil, false
+	}
+	if delay == 0 {
+		return r, nil, true
+	}
+	return r, &rateLimitTurn{backend: b, reservation: reservation, queued: now, delay: delay}, true
+}
+
+// wait waits for the request's turn, and reports whether it should still
+// be sent. Requests that aren't queued don't wait.
+func (t *rateLimitTurn) wait(r *http.Request) bool {
+	if t == nil {
+		return true
+	}
+
+	timer := time.NewTimer(t.delay)
+	select {
+	case <-timer.C:
+	case <-r.Context().Done():
+		// The client is gone, so its turn goes to the next request
+		timer.Stop()
+		t.reservation.Cancel()
+	}
+	t.backend.dequeue()
+	DefaultMetrics.Observe("swindlr_rate_limit_queue_wait_seconds", Labels{"backend": t.backend.URL.Host}, time.Since(t.queued).Seconds())
+	return r.Context().Err() == nil
+}
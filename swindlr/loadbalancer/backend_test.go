@@ -1,6 +1,7 @@
 package loadbalancer
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
 	"net/url"
@@ -54,3 +55,95 @@ func TestRateLimitingMiddleware(t *testing.T) {
 		t.Errorf("Expected status code %d, got %d after rate limit reset", http.StatusOK, resp.StatusCode)
 	}
 }
+
+func TestRateLimitQueue(t *testing.T) {
+	viper.Set("rate_limiting.rate", 10)
+	viper.Set("rate_limiting.bucket_size", 1)
+	viper.Set("rate_limiting.queue.enabled", true)
+	viper.Set("rate_limiting.queue.max_delay", 500*time.Millisecond)
+	viper.Set("rate_limiting.queue.max_depth", 1)
+	defer viper.Set("rate_limiting.queue.enabled", false)
+
+	serverURL, _ := url.Parse("http://queue.test")
+	backend := CreateNewBackend(serverURL, NewServerPool(nil))
+	handler := RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), backend)
+	serve := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+		return rec
+	}
+
+	if rec := serve(); rec.Code != http.StatusOK {
+		t.Fatalf("Expected the first request to pass, got %d", rec.Code)
+	}
+
+	// The second request waits for the next token
+	start := time.Now()
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() { queued <- serve() }()
+	queueLength := func() int {
+		backend.mux.RLock()
+		defer backend.mux.RUnlock()
+		return backend.queued
+	}
+	for queueLength() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	// With the queue full, the third one is rejected
+	if rec := serve(); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected a full queue to reject requests, got %d", rec.Code)
+	} else if rec.Header().Get("Retry-After") == "" {
+		t.Errorf("Expected a Retry-After header")
+	}
+
+	if rec := <-queued; rec.Code != http.StatusOK {
+		t.Errorf("Expected the queued request to pass, got %d", rec.Code)
+	}
+	if waited := time.Since(start); waited < 50*time.Millisecond {
+		t.Errorf("Expected the queued request to wait for a token, waited %s", waited)
+	}
+	if queueLength() != 0 {
+		t.Errorf("Expected the queue to be empty, got %d", queueLength())
+	}
+	if DefaultMetrics.Gauge("swindlr_rate_limit_queue_depth", Labels{"backend": "queue.test"}) != 0 {
+		t.Errorf("Expected the queue depth metric to be back to 0")
+	}
+
+	// Requests that would wait longer than max_delay are rejected
+	backend.queueDelay = time.Millisecond
+	serve()
+	if rec := serve(); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Expected requests over max_delay to be rejected, got %d", rec.Code)
+	}
+}
+
+func TestRateLimitQueueClientGone(t *testing.T) {
+	viper.Set("rate_limiting.rate", 1)
+	viper.Set("rate_limiting.bucket_size", 1)
+	viper.Set("rate_limiting.queue.enabled", true)
+	viper.Set("rate_limiting.queue.max_delay", 5*time.Second)
+	viper.Set("rate_limiting.queue.max_depth", 10)
+	defer viper.Set("rate_limiting.queue.enabled", false)
+
+	serverURL, _ := url.Parse("http://gone.test")
+	backend := CreateNewBackend(serverURL, NewServerPool(nil))
+	served := 0
+	handler := RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { served++ }), backend)
+
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil).WithContext(ctx))
+
+	if served != 1 {
+		t.Errorf("Expected only the first request to be served, got %d", served)
+	}
+	if backend.queued != 0 {
+		t.Errorf("Expected the queue to be empty, got %d", backend.queued)
+	}
+	// The canceled request gave its token back
+	if delay := backend.Limiter.Reserve().Delay(); delay > time.Second {
+		t.Errorf("Expected the canceled reservation to be returned, next token in %s", delay)
+	}
+}
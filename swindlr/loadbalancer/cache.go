@@ -1,66 +1,393 @@
 package loadbalancer
 
 import (
+	"bufio"
 	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
 type CacheItem struct {
-	Content      []byte
-	Expiration   time.Time
-	ETag         string
-	LastModified time.Time
-	Header       http.Header
+	// Status is the status of the response, zero for items stored before
+	// it was recorded, which are all 200 OK
+	Status            int
+	Content           []byte
+	Expiration        time.Time
+	ETag              string
+	LastModified      time.Time
+	Header            http.Header
+	ResponseTime      time.Time
+	InitialAge        time.Duration
+	FreshnessLifetime time.Duration
+	MustRevalidate    bool
+	// Windows after expiration in which the item may still be served
+	// while it is refreshed, or when the origin fails (RFC 5861)
+	StaleWhileRevalidate time.Duration
+	StaleIfError         time.Duration
+	// Tags are the surrogate keys the item can be purged by
+	Tags []string
+	// StoredUntil is when the store may drop the item
+	StoredUntil time.Time
+	// Encoding is the content coding of Content when the cache negotiates
+	// it with clients. Header then describes the unencoded response.
+	Encoding string
+	// ETagEncoding is the content coding of the response the origin's
+	// ETag was assigned to
+	ETagEncoding string
 }
 
+type CacheStats struct {
+	Hits      uint64 `json:"hits"`
+	Misses    uint64 `json:"misses"`
+	Evictions uint64 `json:"evictions"`
+	Expired   uint64 `json:"expired"`
+	Entries   int    `json:"entries"`
+	Bytes     int64  `json:"bytes"`
+	// Responses in the disk tier, if it is enabled
+	DiskEntries int   `json:"disk_entries"`
+	DiskBytes   int64 `json:"disk_bytes"`
+}
+
+// CacheStore stores the responses of a Cache. Items are returned even
+// when they are stale, it's up to the Cache to decide whether they can
+// still be served. Purge selectors are resolved by the Cache, so stores
+// never receive a URL.
+type CacheStore interface {
+	Get(key string, r *http.Request) (CacheItem, bool)
+	// Set stores the item as the variant for the request, for ttl
+	Set(key string, r *http.Request, item CacheItem, ttl time.Duration)
+	Delete(key string)
+	Purge(selector PurgeSelector) (int, error)
+	Ban(selector PurgeSelector) error
+	Flush() int
+	Stats() CacheStats
+}
+
+// Cache applies the HTTP caching rules on top of a CacheStore.
 type Cache struct {
-	items map[string]CacheItem
-	mux   sync.RWMutex
-	ttl   time.Duration
+	store CacheStore
+	// ttl is the freshness lifetime of responses that don't specify one
+	// and have no Last-Modified header to derive it from
+	ttl                  time.Duration
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	// revalidationRetention is how long expired items with validators
+	// are kept, so they can be revalidated instead of fetched again
+	revalidationRetention time.Duration
+	keyConfig             CacheKeyConfig
+	maxObjectSize         int64
+	hits                  uint64
+	misses                uint64
+	// flights holds a channel per key with a request in flight upstream,
+	// closed when the request finishes
+	flights         map[string]chan struct{}
+	flightsMux      sync.Mutex
+	coalesceTimeout time.Duration
+	rangeFill       bool
+	compression     *CacheCompression
+	// statusTTLs holds the statuses besides 200 OK that are cached, with
+	// the freshness lifetime of responses that don't specify one
+	statusTTLs map[int]time.Duration
 }
 
-func NewCache(ttl time.Duration) *Cache {
+func NewCache(ttl time.Duration, store CacheStore) *Cache {
 	return &Cache{
-		items: make(map[string]CacheItem),
-		ttl:   ttl,
+		store:                 store,
+		ttl:                   ttl,
+		revalidationRetention: time.Hour,
+		keyConfig:             DefaultCacheKeyConfig,
+		flights:               make(map[string]chan struct{}),
+	}
+}
+
+// SetStaleDefaults sets the stale-while-revalidate and stale-if-error
+// windows of responses that don't specify them.
+func (c *Cache) SetStaleDefaults(staleWhileRevalidate, staleIfError time.Duration) {
+	c.staleWhileRevalidate = staleWhileRevalidate
+	c.staleIfError = staleIfError
+}
+
+func (c *Cache) SetRevalidationRetention(retention time.Duration) {
+	c.revalidationRetention = retention
+}
+
+// SetCompression enables storing bodies compressed. A nil configuration
+// disables it.
+func (c *Cache) SetCompression(compression *CacheCompression) error {
+	if compression != nil {
+		if err := compression.Validate(); err != nil {
+			return err
+		}
 	}
+	c.compression = compression
+	return nil
+}
+
+// SetStatusTTLs enables caching of responses with the given statuses.
+func (c *Cache) SetStatusTTLs(ttls map[int]time.Duration) {
+	c.statusTTLs = ttls
+}
+
+func (c *Cache) cacheable(status int) bool {
+	_, ok := c.statusTTLs[status]
+	return status == http.StatusOK || ok
 }
 
-func (c *Cache) Get(key string) (CacheItem, bool) {
-	c.mux.RLock()
-	defer c.mux.RUnlock()
-	item, found := c.items[key]
+// defaultTTL is the freshness lifetime of responses with the status that
+// don't specify one.
+func (c *Cache) defaultTTL(status int) time.Duration {
+	if ttl, ok := c.statusTTLs[status]; ok {
+		return ttl
+	}
+	return c.ttl
+}
+
+// SetRangeFill enables fetching the full object in the background when
+// a range of an uncached object is requested.
+func (c *Cache) SetRangeFill(enabled bool) {
+	c.rangeFill = enabled
+}
+
+// SetCoalesceTimeout sets how long requests wait for an identical request
+// in flight before going upstream themselves. Zero disables coalescing.
+func (c *Cache) SetCoalesceTimeout(timeout time.Duration) {
+	c.coalesceTimeout = timeout
+}
+
+// joinFlight registers a request for the key. The first request becomes
+// the leader, the others get the leader's channel to wait on.
+func (c *Cache) joinFlight(key string) (leader bool, done chan struct{}) {
+	if c.coalesceTimeout <= 0 {
+		return true, nil
+	}
+
+	c.flightsMux.Lock()
+	defer c.flightsMux.Unlock()
+	if done, found := c.flights[key]; found {
+		return false, done
+	}
+	done = make(chan struct{})
+	c.flights[key] = done
+	return true, done
+}
+
+// leaveFlight releases the requests waiting on the flight. Leaving a
+// flight more than once is harmless.
+func (c *Cache) leaveFlight(key string, done chan struct{}) {
+	if done == nil {
+		return
+	}
+
+	c.flightsMux.Lock()
+	defer c.flightsMux.Unlock()
+	if c.flights[key] != done {
+		return
+	}
+	delete(c.flights, key)
+	close(done)
+}
+
+// waitFlight reports whether the leader finished before the timeout.
+func (c *Cache) waitFlight(r *http.Request, done chan struct{}) bool {
+	timer := time.NewTimer(c.coalesceTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		DefaultMetrics.IncCounter("swindlr_cache_coalesce_timeouts_total", nil)
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+func (c *Cache) SetKeyConfig(keyConfig CacheKeyConfig) {
+	c.keyConfig = keyConfig
+}
+
+// SetMaxObjectSize sets the size of the largest response that is cached.
+// Zero disables the limit.
+func (c *Cache) SetMaxObjectSize(maxObjectSize int64) {
+	c.maxObjectSize = maxObjectSize
+}
+
+// Key returns the primary cache key of the request.
+func (c *Cache) Key(r *http.Request) string {
+	return c.keyConfig.Key(r)
+}
+
+func (c *Cache) Get(key string, r *http.Request) (CacheItem, bool) {
+	item, found := c.Lookup(key, r)
 	if !found || time.Now().After(item.Expiration) {
 		return CacheItem{}, false
 	}
 	return item, true
 }
 
-func (c *Cache) Set(key string, content []byte, headers http.Header, duration time.Duration) {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	c.items[key] = CacheItem{
-		Content:      content,
-		Expiration:   time.Now().Add(duration),
-		ETag:         headers.Get("ETag"),
-		LastModified: time.Now(),
-		Header:       cloneHeader(headers),
+// Lookup returns the variant matching the request even if it is no
+// longer fresh.
+func (c *Cache) Lookup(key string, r *http.Request) (CacheItem, bool) {
+	return c.store.Get(key, r)
+}
+
+// Set stores the item for as long as it can still be served or
+// revalidated.
+func (c *Cache) Set(key string, r *http.Request, item CacheItem) {
+	if c.maxObjectSize > 0 && item.size() > c.maxObjectSize {
+		return
+	}
+	ttl := time.Until(item.retainUntil(c.revalidationRetention))
+	if ttl <= 0 {
+		return
+	}
+	c.store.Set(key, r, item, ttl)
+}
+
+func (c *Cache) countHit() {
+	atomic.AddUint64(&c.hits, 1)
+	DefaultMetrics.IncCounter("swindlr_cache_hits_total", nil)
+}
+
+func (c *Cache) countMiss() {
+	atomic.AddUint64(&c.misses, 1)
+	DefaultMetrics.IncCounter("swindlr_cache_misses_total", nil)
+}
+
+func (c *Cache) Stats() CacheStats {
+	stats := c.store.Stats()
+	stats.Hits = atomic.LoadUint64(&c.hits)
+	stats.Misses = atomic.LoadUint64(&c.misses)
+	return stats
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
 	}
+	return true
 }
 
-func (c *Cache) DeleteExpired() {
-	c.mux.Lock()
-	defer c.mux.Unlock()
-	now := time.Now()
-	for key, item := range c.items {
-		if now.After(item.Expiration) {
-			delete(c.items, key)
+// size approximates the memory used by the item.
+func (item CacheItem) size() int64 {
+	size := int64(len(item.Content) + len(item.ETag))
+	for k, values := range item.Header {
+		size += int64(len(k))
+		for _, v := range values {
+			size += int64(len(v))
 		}
 	}
+	return size
+}
+
+// NewCacheItem builds a cache item from an origin response received at
+// responseTime for a request sent at requestTime.
+func (c *Cache) NewCacheItem(status int, content []byte, headers http.Header, requestTime, responseTime time.Time) CacheItem {
+	etagEncoding := strings.ToLower(strings.TrimSpace(headers.Get("Content-Encoding")))
+	content, encoding, headers := c.encode(content, headers)
+	cc := parseCacheControl(headers)
+	lifetime := freshnessLifetime(status, headers, cc, responseTime, c.defaultTTL(status))
+	age := initialAge(headers, requestTime, responseTime)
+
+	// no-cache responses may be stored, but have to be revalidated
+	// before every use
+	if cc.has("no-cache") {
+		lifetime = 0
+	}
+
+	lastModified, _ := headerTime(headers, "Last-Modified")
+
+	// Quotas are reported for each request, and never served from the
+	// cache
+	headers = cloneHeader(headers)
+	for _, name := range []string{"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy"} {
+		headers.Del(name)
+	}
+
+	staleWhileRevalidate, ok := cc.seconds("stale-while-revalidate")
+	if !ok {
+		staleWhileRevalidate = c.staleWhileRevalidate
+	}
+	staleIfError, ok := cc.seconds("stale-if-error")
+	if !ok {
+		staleIfError = c.staleIfError
+	}
+
+	return CacheItem{
+		Status:            status,
+		Content:           content,
+		Expiration:        responseTime.Add(lifetime - age),
+		ETag:              headers.Get("ETag"),
+		LastModified:      lastModified,
+		Header:            headers,
+		ResponseTime:      responseTime,
+		InitialAge:        age,
+		FreshnessLifetime: lifetime,
+		MustRevalidate:    cc.has("must-revalidate") || cc.has("proxy-revalidate"),
+
+		StaleWhileRevalidate: staleWhileRevalidate,
+		StaleIfError:         staleIfError,
+		Tags:                 surrogateKeys(headers),
+		Encoding:             encoding,
+		ETagEncoding:         etagEncoding,
+	}
+}
+
+func (item CacheItem) status() int {
+	if item.Status == 0 {
+		return http.StatusOK
+	}
+	return item.Status
+}
+
+// Age is the current age of the item (RFC 9111 section 4.2.3).
+func (item CacheItem) Age(now time.Time) time.Duration {
+	return item.InitialAge + now.Sub(item.ResponseTime)
+}
+
+// revalidatable reports whether the stale item may be served while it
+// is refreshed in the background.
+func (item CacheItem) revalidatable(now time.Time) bool {
+	staleness := item.Age(now) - item.FreshnessLifetime
+	return !item.MustRevalidate && staleness >= 0 && staleness < item.StaleWhileRevalidate
+}
+
+// usableOnError reports whether the item may be served instead of an
+// origin error.
+func (item CacheItem) usableOnError(now time.Time) bool {
+	return !item.MustRevalidate && item.Age(now)-item.FreshnessLifetime < item.StaleIfError
+}
+
+// retainUntil is the time after which the item can no longer be served
+// at all. Items with validators are kept for revalidation for at least
+// the given retention.
+func (item CacheItem) retainUntil(retention time.Duration) time.Time {
+	grace := item.StaleWhileRevalidate
+	if item.StaleIfError > grace {
+		grace = item.StaleIfError
+	}
+	if item.hasValidators() && retention > grace {
+		grace = retention
+	}
+	return item.Expiration.Add(grace)
 }
 
 func cloneHeader(header http.Header) http.Header {
@@ -72,12 +399,29 @@ func cloneHeader(header http.Header) http.Header {
 }
 
 // Middleware logic
+
+// responseWriter passes the response through to the client, and keeps a
+// copy of the body only if the response may be cached. Capturing stops
+// once the body grows over the maximum object size.
 type responseWriter struct {
 	http.ResponseWriter
 	status      int
 	body        bytes.Buffer
 	header      http.Header
 	wroteHeader bool
+	// Responses for which suppress returns true are recorded but not
+	// written, so the cached response can be served instead
+	suppress   func(status int) bool
+	suppressed bool
+	// capture decides, once the headers are known, whether the body is
+	// copied for the cache
+	capture    func(status int, header http.Header) bool
+	capturing  bool
+	maxCapture int64
+	// aborted is set when the body was too large to be cached
+	aborted bool
+	// uncacheable is called once it's known the response won't be cached
+	uncacheable func()
 }
 
 func newResponseWriter(w http.ResponseWriter) *responseWriter {
@@ -91,18 +435,60 @@ func (rw *responseWriter) Write(b []byte) (int, error) {
 	if !rw.wroteHeader {
 		rw.WriteHeader(http.StatusOK)
 	}
-	n, err := rw.body.Write(b)
-	if err != nil {
-		return n, err
+	if rw.suppressed {
+		return len(b), nil
 	}
+	rw.tee(b)
 	return rw.ResponseWriter.Write(b)
 }
 
+func (rw *responseWriter) tee(b []byte) {
+	if !rw.capturing {
+		return
+	}
+	if rw.maxCapture > 0 && int64(rw.body.Len()+len(b)) > rw.maxCapture {
+		rw.abort()
+		return
+	}
+	rw.body.Write(b)
+}
+
+func (rw *responseWriter) abort() {
+	rw.capturing = false
+	rw.aborted = true
+	rw.body = bytes.Buffer{}
+	DefaultMetrics.IncCounter("swindlr_cache_capture_aborted_total", nil)
+	rw.notifyUncacheable()
+}
+
+func (rw *responseWriter) notifyUncacheable() {
+	if rw.uncacheable != nil {
+		rw.uncacheable()
+		rw.uncacheable = nil
+	}
+}
+
 func (rw *responseWriter) WriteHeader(status int) {
 	if rw.wroteHeader {
 		return
 	}
 	rw.status = status
+	if rw.suppress != nil && rw.suppress(status) {
+		rw.suppressed = true
+		rw.wroteHeader = true
+		return
+	}
+
+	if rw.capture != nil && rw.capture(status, rw.header) {
+		rw.capturing = true
+		// Don't start capturing a body that is known to be too large
+		if length, err := strconv.ParseInt(rw.header.Get("Content-Length"), 10, 64); err == nil && rw.maxCapture > 0 && length > rw.maxCapture {
+			rw.abort()
+		}
+	} else {
+		rw.notifyUncacheable()
+	}
+
 	for k, v := range rw.header {
 		rw.ResponseWriter.Header()[k] = v
 	}
@@ -114,6 +500,189 @@ func (rw *responseWriter) Header() http.Header {
 	return rw.header
 }
 
+// captured returns the body if it was captured in full.
+func (rw *responseWriter) captured() ([]byte, bool) {
+	if !rw.capturing {
+		return nil, false
+	}
+	return rw.body.Bytes(), true
+}
+
+// Flush sends buffered data to the client right away, so streamed
+// responses such as server-sent events aren't delayed.
+func (rw *responseWriter) Flush() {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if rw.suppressed {
+		return
+	}
+	if flusher, ok := rw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Hijack hands the connection over for protocol upgrades. Hijacked
+// responses are never cached.
+func (rw *responseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := rw.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking is not supported")
+	}
+	conn, buf, err := hijacker.Hijack()
+	if err == nil {
+		rw.capturing = false
+		rw.wroteHeader = true
+		rw.notifyUncacheable()
+	}
+	return conn, buf, err
+}
+
+// ReadFrom lets the underlying writer copy the body efficiently, e.g. with
+// sendfile, when it doesn't have to be captured.
+func (rw *responseWriter) ReadFrom(src io.Reader) (int64, error) {
+	if !rw.wroteHeader {
+		rw.WriteHeader(http.StatusOK)
+	}
+	if readerFrom, ok := rw.ResponseWriter.(io.ReaderFrom); ok && !rw.capturing && !rw.suppressed {
+		return readerFrom.ReadFrom(src)
+	}
+	return io.Copy(writerOnly{rw}, src)
+}
+
+// Unwrap gives http.ResponseController access to the underlying writer.
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
+// writerOnly hides the ReadFrom method of a writer, so io.Copy doesn't
+// call it recursively.
+type writerOnly struct {
+	io.Writer
+}
+
+// newCaptureWriter wraps w to capture the response to r if it may be
+// stored in the cache.
+func (c *Cache) newCaptureWriter(w http.ResponseWriter, r *http.Request, reqCC cacheControl) *responseWriter {
+	rw := newResponseWriter(w)
+	rw.capture = func(status int, header http.Header) bool {
+		_, wildcard := varyHeaders(header)
+		return !wildcard && c.cacheable(status) && isStorable(r, reqCC, parseCacheControl(header))
+	}
+
+	rw.maxCapture = c.maxObjectSize
+	return rw
+}
+
+func isOriginError(status int) bool {
+	switch status {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// refresh fetches the full response to the request in the background,
+// conditionally if the item has validators, and stores it. The flight for
+// the key is left once it finishes.
+func (c *Cache) refresh(key string, r *http.Request, item CacheItem, next http.Handler, done chan struct{}) {
+	defer c.leaveFlight(key, done)
+
+	req := conditionalRequest(r.WithContext(context.WithoutCancel(r.Context())), item)
+
+	rw := c.newCaptureWriter(discardResponseWriter{header: make(http.Header)}, req, requestCacheControl(req))
+	requestTime := time.Now()
+	next.ServeHTTP(rw, req)
+	responseTime := time.Now()
+
+	if rw.status == http.StatusNotModified {
+		c.revalidated(key, r, item, rw.Header(), requestTime, responseTime)
+		return
+	}
+
+	if body, ok := rw.captured(); ok {
+		c.Set(key, req, c.NewCacheItem(rw.status, body, rw.Header(), requestTime, responseTime))
+		DefaultMetrics.IncCounter("swindlr_cache_background_refreshes_total", Labels{"result": "stored"})
+	} else {
+		DefaultMetrics.IncCounter("swindlr_cache_background_refreshes_total", Labels{"result": "discarded"})
+	}
+}
+
+type discardResponseWriter struct {
+	header http.Header
+}
+
+func (d discardResponseWriter) Header() http.Header         { return d.header }
+func (d discardResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+func (d discardResponseWriter) WriteHeader(int)             {}
+
+// serveCached writes the cached item as the response to the request,
+// or a 304 Not Modified if the client's copy is still current.
+func serveCached(w http.ResponseWriter, r *http.Request, item CacheItem, now time.Time, status string) {
+	w.Header().Set("X-Swindlr-Cache", status)
+
+	if item.status() == http.StatusOK && notModified(r, item) {
+		for _, k := range notModifiedHeaders {
+			if v, ok := item.Header[k]; ok {
+				w.Header()[k] = v
+			}
+		}
+		if item.Encoding != "" {
+			w.Header().Add("Vary", "Accept-Encoding")
+			if etag := item.etag(item.negotiate(r)); etag != "" {
+				w.Header().Set("ETag", etag)
+			}
+		}
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	content, encoding, err := item.representation(r)
+	if err != nil {
+		log.Printf("Error decoding cached response: %s", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+		return
+	}
+
+	// Copy cached headers
+	for k, v := range item.Header {
+		w.Header()[k] = v
+	}
+	if item.Encoding != "" {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		// ServeContent compares If-Range with this ETag, so ranges are
+		// only served from the same coding
+		if etag := item.etag(encoding); etag != "" {
+			w.Header().Set("ETag", etag)
+		}
+	}
+
+	w.Header().Set("Age", strconv.FormatInt(int64(item.Age(now)/time.Second), 10))
+
+	// Negatively cached responses are served as they were received
+	if item.status() != http.StatusOK {
+		w.WriteHeader(item.status())
+		w.Write(content)
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+
+	// Only full responses are cached, so any range can be served from
+	// them. ServeContent also evaluates If-Range and builds
+	// multipart/byteranges responses.
+	if r.Header.Get("Range") != "" {
+		w.Header().Del("Content-Length")
+		http.ServeContent(w, r, "", item.LastModified, bytes.NewReader(content))
+		return
+	}
+	w.Write(content)
+}
+
 func CacheMiddleware(cache *Cache, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if !viper.GetBool("use_cache") {
@@ -121,56 +690,228 @@ func CacheMiddleware(cache *Cache, next http.Handler) http.Handler {
 			return
 		}
 
-		if item, found := cache.Get(r.URL.Path); found {
-			/*
-				The If-None-Match HTTP request header makes the request conditional.
-				For GET and HEAD methods, the server will return the requested resource, with a 200 status,
-				only if it doesn't have an ETag matching the given ones.
-			*/
+		reqCC := requestCacheControl(r)
+		now := time.Now()
 
-			if match := r.Header.Get("If-None-Match"); match != "" && match == item.ETag {
-				w.Header().Set("X-Swindlr-Cache", "HIT")
-				w.WriteHeader(http.StatusNotModified)
-				return
+		// no-store requests may neither be answered from nor stored in
+		// the cache
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || reqCC.has("no-store") {
+			w.Header().Set("X-Swindlr-Cache", "BYPASS")
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := cache.Key(r)
+		item, found := cache.Lookup(key, r)
+		if found && item.satisfies(reqCC, now) {
+			cache.countHit()
+			serveCached(w, r, item, now, "HIT")
+			return
+		}
+
+		// Serve the stale item and refresh it in the background, unless
+		// another request is already doing so
+		if found && !reqCC.has("no-cache") && item.revalidatable(now) {
+			if leader, done := cache.joinFlight(key); leader {
+				go cache.refresh(key, r, item, next, done)
 			}
+			cache.countHit()
+			serveCached(w, r, item, now, "STALE")
+			return
+		}
 
-			/*
-				The If-Modified-Since request HTTP header makes the request conditional:
-				the server sends back the requested resource, with a 200 status,
-				only if it has been last modified after the given date.
-			*/
-
-			if modifiedSince := r.Header.Get("If-Modified-Since"); modifiedSince != "" {
-				t, err := time.Parse(http.TimeFormat, modifiedSince)
-				if err == nil && item.LastModified.Before(t.Add(1*time.Second)) {
-					w.Header().Set("X-Swindlr-Cache", "HIT")
-					w.WriteHeader(http.StatusNotModified)
-					return
+		if reqCC.has("only-if-cached") {
+			http.Error(w, "Not cached", http.StatusGatewayTimeout)
+			return
+		}
+
+		// Partial responses are never stored, so a range request for an
+		// uncached object is passed through as is. The full object can be
+		// fetched in the background to serve later ranges from the cache.
+		if !found && r.Header.Get("Range") != "" {
+			if cache.rangeFill {
+				if leader, done := cache.joinFlight(key); leader {
+					DefaultMetrics.IncCounter("swindlr_cache_range_fills_total", nil)
+					go cache.refresh(key, r, CacheItem{}, next, done)
 				}
 			}
+			cache.countMiss()
+			w.Header().Set("X-Swindlr-Cache", "MISS")
+			next.ServeHTTP(w, r)
+			return
+		}
 
-			// Copy cached headers
-			for k, v := range item.Header {
-				w.Header()[k] = v
+		// Only one request per key goes upstream at a time. The others
+		// wait for its response to be cached, or give up after a timeout
+		// and send their own request.
+		var flight chan struct{}
+		if !reqCC.has("no-cache") {
+			leader, done := cache.joinFlight(key)
+			if leader {
+				flight = done
+				defer cache.leaveFlight(key, done)
+			} else if cache.waitFlight(r, done) {
+				if item, found := cache.Lookup(key, r); found && item.satisfies(reqCC, time.Now()) {
+					cache.countHit()
+					serveCached(w, r, item, time.Now(), "HIT")
+					return
+				}
 			}
+		}
 
-			// Set additional headers
-			w.Header().Set("ETag", item.ETag)
-			w.Header().Set("Last-Modified", item.LastModified.Format(http.TimeFormat))
-			w.Header().Set("X-Swindlr-Cache", "HIT")
-			w.Write(item.Content)
+		cache.countMiss()
+		w.Header().Set("X-Swindlr-Cache", "MISS")
+		// Expired items with validators are revalidated with the origin
+		// instead of being fetched again
+		upstream := r
+		revalidating := found && item.hasValidators()
+		if revalidating {
+			upstream = conditionalRequest(r, item)
+		}
+
+		rw := cache.newCaptureWriter(w, r, reqCC)
+		// Waiting requests have nothing to wait for once the response
+		// turns out not to be cached, such as private or streamed ones
+		if flight != nil {
+			rw.uncacheable = func() { cache.leaveFlight(key, flight) }
+		}
+		rw.suppress = func(status int) bool {
+			return (revalidating && status == http.StatusNotModified) ||
+				(found && item.usableOnError(now) && isOriginError(status))
+		}
+		requestTime := time.Now()
+		next.ServeHTTP(rw, upstream)
+		responseTime := time.Now()
+
+		if rw.suppressed && rw.status == http.StatusNotModified {
+			item = cache.revalidated(key, r, item, rw.Header(), requestTime, responseTime)
+			serveCached(w, r, item, time.Now(), "REVALIDATED")
+			return
+		}
+		if rw.suppressed {
+			DefaultMetrics.IncCounter("swindlr_cache_stale_on_error_total", nil)
+			serveCached(w, r, item, time.Now(), "STALE")
 			return
 		}
+		if revalidating {
+			DefaultMetrics.IncCounter("swindlr_cache_revalidations_total", Labels{"result": "modified"})
+		}
 
-		w.Header().Set("X-Swindlr-Cache", "MISS")
-		rw := newResponseWriter(w)
-		next.ServeHTTP(rw, r)
+		if body, ok := rw.captured(); ok {
+			cache.Set(key, r, cache.NewCacheItem(rw.status, body, rw.Header(), requestTime, responseTime))
+		}
+	})
+}
+
+// uncacheableStatuses are never stored, as they don't carry a complete
+// response.
+var uncacheableStatuses = map[int]bool{
+	http.StatusPartialContent: true,
+	http.StatusNotModified:    true,
+}
 
-		if rw.status == http.StatusOK {
-			cacheControl := rw.Header().Get("Cache-Control")
-			if cacheControl != "no-store" && cacheControl != "private" {
-				cache.Set(r.URL.Path, rw.body.Bytes(), rw.Header(), cache.ttl)
+// ParseStatusTTLs parses TTLs keyed by status, such as "404", or by
+// status class, such as "5xx". Statuses override their class.
+func ParseStatusTTLs(values map[string]string) (map[int]time.Duration, error) {
+	ttls := make(map[int]time.Duration)
+	for key, value := range values {
+		ttl, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TTL for %s: %w", key, err)
+		}
+
+		if len(key) == 3 && strings.HasSuffix(strings.ToLower(key), "xx") && key[0] >= '2' && key[0] <= '5' {
+			class := int(key[0]-'0') * 100
+			for status := class; status < class+100; status++ {
+				if _, ok := values[strconv.Itoa(status)]; !ok && !uncacheableStatuses[status] {
+					ttls[status] = ttl
+				}
 			}
+			continue
 		}
-	})
+
+		status, err := strconv.Atoi(key)
+		if err != nil || status < 200 || status > 599 || uncacheableStatuses[status] {
+			return nil, fmt.Errorf("invalid status: %q", key)
+		}
+		ttls[status] = ttl
+	}
+	return ttls, nil
+}
+
+func SetupCache() *Cache {
+	var store CacheStore
+	switch viper.GetString("cache.store") {
+	case "memory":
+		store = setupMemoryStore()
+	case "redis":
+		client := newRESPClient(
+			viper.GetString("cache.redis.address"),
+			viper.GetString("cache.redis.password"),
+			viper.GetInt("cache.redis.db"),
+			viper.GetDuration("cache.redis.timeout"),
+			viper.GetInt("cache.redis.pool_size"),
+		)
+		store = NewRedisStore(client, viper.GetString("cache.redis.key_prefix"))
+		log.Printf("Using Redis cache store at %s", viper.GetString("cache.redis.address"))
+	default:
+		log.Fatalf("Invalid cache store: %s", viper.GetString("cache.store"))
+	}
+
+	cache := NewCache(viper.GetDuration("cache.default_ttl"), store)
+
+	keyConfig := DefaultCacheKeyConfig
+	if err := viper.UnmarshalKey("cache.key", &keyConfig); err != nil {
+		log.Fatalf("Error parsing cache key configuration: %s", err)
+	}
+	cache.SetKeyConfig(keyConfig)
+	cache.SetMaxObjectSize(viper.GetInt64("cache.max_object_size"))
+
+	cache.SetCoalesceTimeout(viper.GetDuration("cache.coalesce_timeout"))
+	cache.SetStaleDefaults(viper.GetDuration("cache.stale_while_revalidate"), viper.GetDuration("cache.stale_if_error"))
+	cache.SetRevalidationRetention(viper.GetDuration("cache.revalidation_retention"))
+	cache.SetRangeFill(viper.GetBool("cache.range_fill"))
+
+	statusTTLs, err := ParseStatusTTLs(viper.GetStringMapString("cache.status_ttls"))
+	if err != nil {
+		log.Fatalf("Error parsing cache status TTLs: %s", err)
+	}
+	cache.SetStatusTTLs(statusTTLs)
+
+	if viper.GetBool("cache.compression.enabled") {
+		compression := &CacheCompression{}
+		if err := viper.UnmarshalKey("cache.compression", compression); err != nil {
+			log.Fatalf("Error parsing cache compression configuration: %s", err)
+		}
+		if err := cache.SetCompression(compression); err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+	}
+
+	return cache
+}
+
+func setupMemoryStore() *MemoryStore {
+	store := NewMemoryStore()
+	store.SetLimits(viper.GetInt64("cache.max_bytes"), viper.GetInt("cache.max_entries"))
+
+	if path := viper.GetString("cache.disk.path"); path != "" {
+		disk, err := OpenDiskTier(path, viper.GetInt64("cache.disk.max_bytes"), viper.GetInt("cache.disk.promote_hits"))
+		if err != nil {
+			// The cache still works without the disk tier
+			log.Printf("Error opening disk cache at %s, using memory only: %s", path, err)
+		} else {
+			log.Printf("Disk cache enabled at %s", path)
+			disk.SetWriteQueue(viper.GetInt("cache.disk.write_queue"))
+			store.SetDiskTier(disk)
+			if interval := viper.GetDuration("cache.disk.sync_interval"); interval > 0 {
+				go disk.StartSync(interval, nil)
+			}
+		}
+	}
+
+	if interval := viper.GetDuration("cache.janitor_interval"); interval > 0 {
+		go store.StartJanitor(interval, nil)
+	}
+	return store
 }
@@ -1,19 +1,25 @@
 package loadbalancer
 
 import (
+	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
 )
 
 func TestCacheMiddleware(t *testing.T) {
 	viper.Set("use_cache", true)
 
-	cache := NewCache(1 * time.Minute)
+	cache := NewCache(1*time.Minute, NewMemoryStore())
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("ETag", "12345")
@@ -45,7 +51,7 @@ func TestCacheMiddleware(t *testing.T) {
 func TestCacheExpiration(t *testing.T) {
 	viper.Set("use_cache", true)
 
-	cache := NewCache(1 * time.Second)
+	cache := NewCache(1*time.Second, NewMemoryStore())
 
 	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("ETag", "12345")
@@ -75,3 +81,1065 @@ func TestCacheExpiration(t *testing.T) {
 	assert.Equal(t, "Hello, World!", rr.Body.String())
 	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
 }
+
+func TestCacheRespectsResponseCacheControl(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	tests := []struct {
+		cacheControl string
+		cached       bool
+	}{
+		{"", true},
+		{"public, max-age=60", true},
+		{"max-age=0, private", false},
+		{"no-cache", false},
+		{"no-store", false},
+		{"max-age=0", false},
+		{"s-maxage=0, max-age=60", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cacheControl, func(t *testing.T) {
+			cache := NewCache(1*time.Minute, NewMemoryStore())
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.cacheControl != "" {
+					w.Header().Set("Cache-Control", tt.cacheControl)
+				}
+				w.Write([]byte("Hello, World!"))
+			})
+			cacheHandler := CacheMiddleware(cache, handler)
+
+			req, _ := http.NewRequest("GET", "/test", nil)
+			cacheHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+			rr := httptest.NewRecorder()
+			cacheHandler.ServeHTTP(rr, req)
+
+			expected := "MISS"
+			if tt.cached {
+				expected = "HIT"
+			}
+			assert.Equal(t, expected, rr.Header().Get("X-Swindlr-Cache"))
+		})
+	}
+}
+
+func TestCacheRespectsRequestCacheControl(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Header().Set("Age", "30")
+		w.Write([]byte("Hello, World!"))
+	})
+	cacheHandler := CacheMiddleware(cache, handler)
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	cacheHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	rr := httptest.NewRecorder()
+	cacheHandler.ServeHTTP(rr, req)
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "30", rr.Header().Get("Age"))
+
+	for _, directive := range []string{"no-cache", "max-age=10", "min-fresh=40"} {
+		req, _ := http.NewRequest("GET", "/test", nil)
+		req.Header.Set("Cache-Control", directive)
+		rr := httptest.NewRecorder()
+		cacheHandler.ServeHTTP(rr, req)
+		assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"), directive)
+	}
+
+	req, _ = http.NewRequest("GET", "/other", nil)
+	req.Header.Set("Cache-Control", "only-if-cached")
+	rr = httptest.NewRecorder()
+	cacheHandler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusGatewayTimeout, rr.Code)
+}
+
+func TestFreshnessLifetime(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Second)
+	defaultTTL := 5 * time.Minute
+
+	lastModified := http.Header{"Date": {now.Format(http.TimeFormat)}, "Last-Modified": {now.Add(-10 * time.Hour).Format(http.TimeFormat)}}
+	tests := []struct {
+		name     string
+		status   int
+		header   http.Header
+		expected time.Duration
+	}{
+		{"s-maxage wins", http.StatusOK, http.Header{"Cache-Control": {"max-age=10, s-maxage=20"}}, 20 * time.Second},
+		{"max-age over expires", http.StatusOK, http.Header{"Cache-Control": {"max-age=10"}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, 10 * time.Second},
+		{"expires", http.StatusOK, http.Header{"Date": {now.Format(http.TimeFormat)}, "Expires": {now.Add(time.Hour).Format(http.TimeFormat)}}, time.Hour},
+		{"invalid expires", http.StatusOK, http.Header{"Expires": {"0"}}, 0},
+		{"heuristic", http.StatusOK, lastModified, time.Hour},
+		{"heuristic for a 404", http.StatusNotFound, lastModified, time.Hour},
+		{"no heuristic for a 503", http.StatusServiceUnavailable, lastModified, defaultTTL},
+		{"default", http.StatusOK, http.Header{}, defaultTTL},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lifetime := freshnessLifetime(tt.status, tt.header, parseCacheControl(tt.header), now, defaultTTL)
+			assert.Equal(t, tt.expected, lifetime)
+		})
+	}
+}
+
+func TestMustRevalidateIgnoresMaxStale(t *testing.T) {
+	now := time.Now()
+	item := CacheItem{ResponseTime: now.Add(-time.Minute), FreshnessLifetime: 30 * time.Second}
+	reqCC := cacheControl{"max-stale": ""}
+
+	assert.True(t, item.satisfies(reqCC, now))
+
+	item.MustRevalidate = true
+	assert.False(t, item.satisfies(reqCC, now))
+}
+
+func TestCacheKeys(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Method + " " + r.URL.Query().Get("q")))
+	})
+	cacheHandler := CacheMiddleware(cache, handler)
+
+	serve := func(method, target string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		cacheHandler.ServeHTTP(rr, httptest.NewRequest(method, target, nil))
+		return rr
+	}
+
+	serve("GET", "http://swindlr.test/search?q=a&page=1")
+	rr := serve("GET", "http://swindlr.test/search?q=b&page=1")
+	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "GET b", rr.Body.String())
+
+	// Parameter order doesn't matter
+	rr = serve("GET", "http://swindlr.test/search?page=1&q=a")
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "GET a", rr.Body.String())
+
+	rr = serve("GET", "http://other.test/search?q=a&page=1")
+	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+
+	rr = serve("POST", "http://swindlr.test/search?q=a&page=1")
+	assert.Equal(t, "BYPASS", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "POST a", rr.Body.String())
+}
+
+func TestCacheKeysPerRoute(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	router := NewRouter(NewServerPool(&RoundRobin{}))
+	router.AddPool("canary", NewServerPool(&RoundRobin{}))
+	err := router.SetRules([]*RoutingRule{
+		{Name: "canary", Pool: "canary", Matchers: []Matcher{{Source: "header", Name: "X-Canary", Match: "present"}}},
+		{Name: "tenant", Tags: []string{"tenant-a"}, Matchers: []Matcher{{Source: "header", Name: "X-Tenant", Match: "exact", Value: "a"}}},
+	})
+	assert.NoError(t, err)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	serve := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://swindlr.test/page", nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		_, routed := router.Route(req)
+		body := GetPoolFromContext(routed) + " " + strings.Join(GetTagsFromContext(routed), ",")
+		rr := httptest.NewRecorder()
+		CacheMiddleware(cache, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(body))
+		})).ServeHTTP(rr, routed)
+		return rr
+	}
+
+	assert.Equal(t, "MISS", serve("", "").Header().Get("X-Swindlr-Cache"))
+	rr := serve("X-Canary", "1")
+	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "canary ", rr.Body.String())
+	rr = serve("X-Tenant", "a")
+	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "default tenant-a", rr.Body.String())
+
+	rr = serve("", "")
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "default ", rr.Body.String())
+	rr = serve("X-Canary", "1")
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "canary ", rr.Body.String())
+
+	// Purging the URL covers every route
+	purged, err := cache.Purge(PurgeSelector{URL: "http://swindlr.test/page"})
+	assert.NoError(t, err)
+	assert.Equal(t, 3, purged)
+}
+
+func TestCacheVary(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Vary", "Accept-Language")
+		w.Write([]byte("content for " + r.Header.Get("Accept-Language")))
+	})
+	cacheHandler := CacheMiddleware(cache, handler)
+
+	serve := func(language string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://swindlr.test/page", nil)
+		req.Header.Set("Accept-Language", language)
+		rr := httptest.NewRecorder()
+		cacheHandler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	serve("en")
+	serve("de")
+
+	rr := serve("en")
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "content for en", rr.Body.String())
+
+	rr = serve("de")
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "content for de", rr.Body.String())
+
+	rr = serve("fr")
+	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+}
+
+func TestCacheAuthorization(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	tests := []struct {
+		cacheControl string
+		cached       bool
+	}{
+		{"", false},
+		{"max-age=60", false},
+		{"public, max-age=60", true},
+		{"s-maxage=60", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.cacheControl, func(t *testing.T) {
+			cache := NewCache(1*time.Minute, NewMemoryStore())
+			handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.cacheControl != "" {
+					w.Header().Set("Cache-Control", tt.cacheControl)
+				}
+				w.Write([]byte("secret"))
+			})
+			cacheHandler := CacheMiddleware(cache, handler)
+
+			req := httptest.NewRequest("GET", "http://swindlr.test/me", nil)
+			req.Header.Set("Authorization", "Bearer token")
+			cacheHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+			rr := httptest.NewRecorder()
+			cacheHandler.ServeHTTP(rr, httptest.NewRequest("GET", "http://swindlr.test/me", nil))
+
+			expected := "MISS"
+			if tt.cached {
+				expected = "HIT"
+			}
+			assert.Equal(t, expected, rr.Header().Get("X-Swindlr-Cache"))
+		})
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	store := NewMemoryStore()
+	store.SetLimits(0, 2)
+	cache := NewCache(1*time.Minute, store)
+
+	set := func(path string) *http.Request {
+		req := httptest.NewRequest("GET", "http://swindlr.test"+path, nil)
+		cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte(path), http.Header{}, time.Now(), time.Now()))
+		return req
+	}
+
+	a := set("/a")
+	b := set("/b")
+
+	// Touch /a so /b becomes the least recently used entry
+	_, found := cache.Lookup(cache.Key(a), a)
+	assert.True(t, found)
+
+	set("/c")
+
+	_, found = cache.Lookup(cache.Key(b), b)
+	assert.False(t, found, "least recently used entry should be evicted")
+	_, found = cache.Lookup(cache.Key(a), a)
+	assert.True(t, found)
+
+	stats := cache.Stats()
+	assert.Equal(t, 2, stats.Entries)
+	assert.Equal(t, uint64(1), stats.Evictions)
+}
+
+func TestCacheSizeLimits(t *testing.T) {
+	store := NewMemoryStore()
+	store.SetLimits(100, 0)
+	cache := NewCache(1*time.Minute, store)
+	cache.SetMaxObjectSize(60)
+
+	set := func(path string, size int) *http.Request {
+		req := httptest.NewRequest("GET", "http://swindlr.test"+path, nil)
+		cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, make([]byte, size), http.Header{}, time.Now(), time.Now()))
+		return req
+	}
+
+	big := set("/big", 80)
+	_, found := cache.Lookup(cache.Key(big), big)
+	assert.False(t, found, "objects over the max object size should not be stored")
+
+	first := set("/first", 55)
+	set("/second", 55)
+	_, found = cache.Lookup(cache.Key(first), first)
+	assert.False(t, found, "cache should stay within max bytes")
+	assert.LessOrEqual(t, cache.Stats().Bytes, int64(100))
+}
+
+func TestCacheJanitor(t *testing.T) {
+	store := NewMemoryStore()
+	cache := NewCache(10*time.Millisecond, store)
+	req := httptest.NewRequest("GET", "http://swindlr.test/a", nil)
+	cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte("a"), http.Header{}, time.Now(), time.Now()))
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go store.StartJanitor(20*time.Millisecond, stop)
+
+	assert.Eventually(t, func() bool {
+		return cache.Stats().Entries == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(0), cache.Stats().Bytes)
+	assert.Equal(t, uint64(1), cache.Stats().Expired)
+}
+
+func TestCacheCoalescing(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	run := func(timeout time.Duration) (int32, []*httptest.ResponseRecorder) {
+		cache := NewCache(1*time.Minute, NewMemoryStore())
+		cache.SetCoalesceTimeout(timeout)
+
+		var upstream int32
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&upstream, 1)
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte("Hello, World!"))
+		})
+		cacheHandler := CacheMiddleware(cache, handler)
+
+		recorders := make([]*httptest.ResponseRecorder, 10)
+		var wg sync.WaitGroup
+		for i := range recorders {
+			recorders[i] = httptest.NewRecorder()
+			wg.Add(1)
+			go func(rr *httptest.ResponseRecorder) {
+				defer wg.Done()
+				cacheHandler.ServeHTTP(rr, httptest.NewRequest("GET", "http://swindlr.test/hot", nil))
+			}(recorders[i])
+		}
+		wg.Wait()
+		return atomic.LoadInt32(&upstream), recorders
+	}
+
+	upstream, recorders := run(time.Second)
+	assert.Equal(t, int32(1), upstream)
+	for _, rr := range recorders {
+		assert.Equal(t, "Hello, World!", rr.Body.String())
+	}
+
+	// Waiters give up and go upstream themselves
+	upstream, _ = run(10 * time.Millisecond)
+	assert.Greater(t, upstream, int32(1))
+}
+
+func TestCacheCoalescingUncacheable(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	cache.SetCoalesceTimeout(5 * time.Second)
+
+	var upstream int32
+	release := make(chan struct{})
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "private")
+		if atomic.AddInt32(&upstream, 1) == 1 {
+			// The first request streams its body slowly
+			w.WriteHeader(http.StatusOK)
+			w.(http.Flusher).Flush()
+			<-release
+		}
+		w.Write([]byte("Hello, World!"))
+	})
+	cacheHandler := CacheMiddleware(cache, handler)
+
+	leader := make(chan struct{})
+	go func() {
+		defer close(leader)
+		cacheHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "http://swindlr.test/private", nil))
+	}()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt32(&upstream) == 1
+	}, time.Second, time.Millisecond)
+
+	// Private responses aren't worth waiting for, so the other requests go
+	// upstream without waiting for the first one to finish
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rr := httptest.NewRecorder()
+			cacheHandler.ServeHTTP(rr, httptest.NewRequest("GET", "http://swindlr.test/private", nil))
+			assert.Equal(t, "Hello, World!", rr.Body.String())
+		}()
+	}
+	finished := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+	case <-time.After(time.Second):
+		t.Error("Expected waiting requests to be released before the first response ends")
+	}
+	close(release)
+	<-leader
+	<-finished
+	assert.Equal(t, int32(6), atomic.LoadInt32(&upstream))
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	cache.SetCoalesceTimeout(time.Second)
+
+	var version int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=1, stale-while-revalidate=30")
+		w.Write([]byte(fmt.Sprintf("version %d", atomic.AddInt32(&version, 1))))
+	})
+	cacheHandler := CacheMiddleware(cache, handler)
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	cacheHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	time.Sleep(1100 * time.Millisecond)
+
+	rr := httptest.NewRecorder()
+	cacheHandler.ServeHTTP(rr, req)
+	assert.Equal(t, "STALE", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "version 1", rr.Body.String())
+
+	assert.Eventually(t, func() bool {
+		rr := httptest.NewRecorder()
+		cacheHandler.ServeHTTP(rr, req)
+		return rr.Header().Get("X-Swindlr-Cache") == "HIT" && rr.Body.String() == "version 2"
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestCacheStaleIfError(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	cache.SetStaleDefaults(0, time.Minute)
+
+	var failing atomic.Bool
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing.Load() {
+			http.Error(w, "Service not available", http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Write([]byte("Hello, World!"))
+	})
+	cacheHandler := CacheMiddleware(cache, handler)
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	cacheHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	failing.Store(true)
+	rr := httptest.NewRecorder()
+	cacheHandler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "STALE", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "Hello, World!", rr.Body.String())
+}
+
+func TestLBServesStaleWithoutBackends(t *testing.T) {
+	viper.Set("use_cache", true)
+	viper.Set("use_sticky_sessions", false)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	cache.SetStaleDefaults(0, time.Minute)
+
+	req := httptest.NewRequest("GET", "http://swindlr.test/test", nil)
+	past := time.Now().Add(-10 * time.Second)
+	cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte("Hello, World!"), http.Header{"Cache-Control": {"max-age=1"}}, past, past))
+
+	rr := httptest.NewRecorder()
+	LB(rr, req, NewServerPool(&RoundRobin{}), cache)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "STALE", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "Hello, World!", rr.Body.String())
+
+	// Outside the stale-if-error window the error is passed through
+	cache = NewCache(1*time.Minute, NewMemoryStore())
+	cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte("Hello, World!"), http.Header{"Cache-Control": {"max-age=1"}}, past, past))
+
+	rr = httptest.NewRecorder()
+	LB(rr, req, NewServerPool(&RoundRobin{}), cache)
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+}
+
+func TestLBDoesNotCacheLocalRejections(t *testing.T) {
+	viper.Set("use_cache", true)
+	viper.Set("use_sticky_sessions", false)
+
+	ttls, err := ParseStatusTTLs(map[string]string{"4xx": "1m", "5xx": "1m"})
+	assert.NoError(t, err)
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	cache.SetStatusTTLs(ttls)
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+	backend := &Backend{
+		URL:          parseURL(server.URL),
+		Alive:        true,
+		ReverseProxy: httputil.NewSingleHostReverseProxy(parseURL(server.URL)),
+		Limiter:      rate.NewLimiter(rate.Every(time.Hour), 1),
+	}
+	sp := NewServerPool(&RoundRobin{})
+	sp.AddBackend(backend)
+
+	get := func(sp *ServerPool, path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		LB(rr, httptest.NewRequest("GET", "http://swindlr.test"+path, nil), sp, cache)
+		return rr
+	}
+
+	assert.Equal(t, http.StatusOK, get(sp, "/a").Code)
+	// The backend's rate limit rejections aren't cached for other clients
+	for i := 0; i < 2; i++ {
+		rr := get(sp, "/b")
+		assert.Equal(t, http.StatusTooManyRequests, rr.Code)
+		assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+		assert.Equal(t, "no-store", rr.Header().Get("Cache-Control"))
+	}
+
+	// Nor are the errors for an empty pool
+	for i := 0; i < 2; i++ {
+		rr := get(NewServerPool(&RoundRobin{}), "/c")
+		assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+		assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+	}
+	assert.Equal(t, 1, cache.Stats().Entries)
+}
+
+func TestCacheRevalidation(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat)
+
+	var fullResponses, notModified int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=0")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` && r.Header.Get("If-Modified-Since") == lastModified {
+			atomic.AddInt32(&notModified, 1)
+			w.Header().Set("Cache-Control", "max-age=60")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&fullResponses, 1)
+		w.Header().Set("Last-Modified", lastModified)
+		w.Write([]byte("Hello, World!"))
+	})
+	cacheHandler := CacheMiddleware(cache, handler)
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	cacheHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	rr := httptest.NewRecorder()
+	cacheHandler.ServeHTTP(rr, req)
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "REVALIDATED", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "Hello, World!", rr.Body.String())
+	assert.Equal(t, lastModified, rr.Header().Get("Last-Modified"))
+
+	// The 304 made the entry fresh again
+	rr = httptest.NewRecorder()
+	cacheHandler.ServeHTTP(rr, req)
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&fullResponses))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&notModified))
+}
+
+func TestCacheClientConditionals(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	lastModified := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `W/"v1"`)
+		w.Header().Set("Last-Modified", lastModified.Format(http.TimeFormat))
+		w.Write([]byte("Hello, World!"))
+	})
+	cacheHandler := CacheMiddleware(cache, handler)
+
+	req, _ := http.NewRequest("GET", "/test", nil)
+	cacheHandler.ServeHTTP(httptest.NewRecorder(), req)
+
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		status int
+	}{
+		{"weak match", "If-None-Match", `"v1"`, http.StatusNotModified},
+		{"etag list", "If-None-Match", `"v0", W/"v1"`, http.StatusNotModified},
+		{"wildcard", "If-None-Match", "*", http.StatusNotModified},
+		{"etag mismatch", "If-None-Match", `"v2"`, http.StatusOK},
+		{"not modified since", "If-Modified-Since", lastModified.Format(http.TimeFormat), http.StatusNotModified},
+		{"modified since", "If-Modified-Since", lastModified.Add(-time.Hour).Format(http.TimeFormat), http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, _ := http.NewRequest("GET", "/test", nil)
+			req.Header.Set(tt.header, tt.value)
+			rr := httptest.NewRecorder()
+			cacheHandler.ServeHTTP(rr, req)
+			assert.Equal(t, tt.status, rr.Code)
+			assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+		})
+	}
+}
+
+func TestParseETags(t *testing.T) {
+	assert.Equal(t, []string{`"a"`, `W/"b,c"`, "*"}, parseETags(` "a", W/"b,c" ,*`))
+	assert.Empty(t, parseETags(""))
+}
+
+func TestSurrogateKeys(t *testing.T) {
+	header := http.Header{}
+	header.Add("Surrogate-Key", "product-1  catalog")
+	header.Add("Cache-Tag", "catalog, en-US,")
+	assert.Equal(t, []string{"product-1", "catalog", "en-US"}, surrogateKeys(header))
+}
+
+func newPurgeTestCache(t *testing.T) *Cache {
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	for _, target := range []string{"/static/app.css", "/static/app.js", "/products/1", "/products/2"} {
+		req, _ := http.NewRequest("GET", "http://example.com"+target, nil)
+		header := http.Header{}
+		if strings.HasPrefix(target, "/products/") {
+			header.Set("Surrogate-Key", "products product"+strings.TrimPrefix(target, "/products/"))
+		}
+		now := time.Now().Add(-time.Second)
+		cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte(target), header, now, now))
+	}
+	assert.Equal(t, 4, cache.Stats().Entries)
+	return cache
+}
+
+func TestCachePurge(t *testing.T) {
+	tests := []struct {
+		name      string
+		selector  PurgeSelector
+		purged    int
+		remaining []string
+	}{
+		{"url", PurgeSelector{URL: "http://example.com/products/1"}, 1, []string{"/static/app.css", "/static/app.js", "/products/2"}},
+		{"key", PurgeSelector{Key: "GET|http|example.com|/products/2|"}, 1, []string{"/static/app.css", "/static/app.js", "/products/1"}},
+		{"prefix", PurgeSelector{Prefix: "/static/"}, 2, []string{"/products/1", "/products/2"}},
+		{"glob", PurgeSelector{Glob: "/static/*.css"}, 1, []string{"/static/app.js", "/products/1", "/products/2"}},
+		{"tag", PurgeSelector{Tag: "products"}, 2, []string{"/static/app.css", "/static/app.js"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := newPurgeTestCache(t)
+			purged, err := cache.Purge(tt.selector)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.purged, purged)
+			assert.Equal(t, len(tt.remaining), cache.Stats().Entries)
+			for _, target := range tt.remaining {
+				req, _ := http.NewRequest("GET", "http://example.com"+target, nil)
+				_, found := cache.Get(cache.Key(req), req)
+				assert.True(t, found, target)
+			}
+		})
+	}
+
+	cache := newPurgeTestCache(t)
+	_, err := cache.Purge(PurgeSelector{})
+	assert.Error(t, err)
+	_, err = cache.Purge(PurgeSelector{Prefix: "/", Tag: "products"})
+	assert.Error(t, err)
+	_, err = cache.Purge(PurgeSelector{Glob: "/static/["})
+	assert.Error(t, err)
+}
+
+func TestCachePurgeURL(t *testing.T) {
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	var requests []*http.Request
+	for _, method := range []string{"GET", "HEAD"} {
+		for _, scheme := range []string{"http", "https"} {
+			req := httptest.NewRequest(method, scheme+"://example.com/page", nil)
+			requests = append(requests, req)
+			now := time.Now().Add(-time.Second)
+			cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte("page"), http.Header{}, now, now))
+		}
+	}
+	assert.Equal(t, 4, cache.Stats().Entries)
+
+	// Both methods are purged, for the URL's scheme only
+	purged, err := cache.Purge(PurgeSelector{URL: "https://example.com/page"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, purged)
+	for _, req := range requests {
+		_, found := cache.Get(cache.Key(req), req)
+		assert.Equal(t, req.TLS == nil, found, req.Method+" "+req.URL.String())
+	}
+}
+
+func TestCacheBan(t *testing.T) {
+	cache := newPurgeTestCache(t)
+	assert.NoError(t, cache.Ban(PurgeSelector{Tag: "product1"}))
+
+	// Bans are applied lazily
+	assert.Equal(t, 4, cache.Stats().Entries)
+
+	req, _ := http.NewRequest("GET", "http://example.com/products/1", nil)
+	_, found := cache.Get(cache.Key(req), req)
+	assert.False(t, found)
+	assert.Equal(t, 3, cache.Stats().Entries)
+
+	// Responses stored after the ban are not affected
+	now := time.Now().Add(time.Millisecond)
+	cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte("new"), http.Header{"Surrogate-Key": {"product1"}}, now, now))
+	item, found := cache.Get(cache.Key(req), req)
+	assert.True(t, found)
+	assert.Equal(t, "new", string(item.Content))
+
+	assert.NoError(t, cache.Ban(PurgeSelector{Prefix: "/static/"}))
+	cache.store.(*MemoryStore).DeleteExpired()
+	assert.Equal(t, 2, cache.Stats().Entries)
+	assert.Empty(t, cache.store.(*MemoryStore).bans)
+}
+
+func TestCacheFlush(t *testing.T) {
+	cache := newPurgeTestCache(t)
+	assert.NoError(t, cache.Ban(PurgeSelector{Tag: "products"}))
+	assert.Equal(t, 4, cache.Flush())
+	assert.Equal(t, 0, cache.Stats().Entries)
+	assert.Equal(t, int64(0), cache.Stats().Bytes)
+	assert.Empty(t, cache.store.(*MemoryStore).bans)
+}
+
+func TestCacheStreamsLargeResponses(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	cache.SetMaxObjectSize(10)
+
+	body := strings.Repeat("x", 25)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for i := 0; i < len(body); i += 5 {
+			w.Write([]byte(body[i : i+5]))
+			w.(http.Flusher).Flush()
+		}
+	})
+	cacheHandler := CacheMiddleware(cache, handler)
+
+	req, _ := http.NewRequest("GET", "/large", nil)
+	rr := httptest.NewRecorder()
+	cacheHandler.ServeHTTP(rr, req)
+	assert.Equal(t, body, rr.Body.String())
+	assert.True(t, rr.Flushed)
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestResponseWriterCapture(t *testing.T) {
+	storable := func(status int, header http.Header) bool { return status == http.StatusOK }
+
+	t.Run("under limit", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		rw := newResponseWriter(rr)
+		rw.capture = storable
+		rw.maxCapture = 10
+		rw.Write([]byte("hello"))
+		body, ok := rw.captured()
+		assert.True(t, ok)
+		assert.Equal(t, "hello", string(body))
+	})
+
+	t.Run("not storable", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		rw := newResponseWriter(rr)
+		rw.capture = storable
+		rw.WriteHeader(http.StatusNotFound)
+		rw.Write([]byte("hello"))
+		_, ok := rw.captured()
+		assert.False(t, ok)
+		assert.Equal(t, 0, rw.body.Len())
+		assert.Equal(t, "hello", rr.Body.String())
+	})
+
+	t.Run("content length over limit", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		rw := newResponseWriter(rr)
+		rw.capture = storable
+		rw.maxCapture = 10
+		rw.Header().Set("Content-Length", "11")
+		rw.WriteHeader(http.StatusOK)
+		assert.True(t, rw.aborted)
+		_, ok := rw.captured()
+		assert.False(t, ok)
+	})
+
+	t.Run("read from", func(t *testing.T) {
+		rr := httptest.NewRecorder()
+		rw := newResponseWriter(rr)
+		rw.capture = storable
+		rw.maxCapture = 10
+		n, err := rw.ReadFrom(strings.NewReader("hello, world"))
+		assert.NoError(t, err)
+		assert.Equal(t, int64(12), n)
+		assert.Equal(t, "hello, world", rr.Body.String())
+		_, ok := rw.captured()
+		assert.False(t, ok)
+	})
+
+	t.Run("hijack unsupported", func(t *testing.T) {
+		rw := newResponseWriter(httptest.NewRecorder())
+		_, _, err := rw.Hijack()
+		assert.Error(t, err)
+	})
+}
+
+func TestCacheRangeRequests(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Write([]byte("Hello, World!"))
+	})
+	cacheHandler := CacheMiddleware(cache, handler)
+	cacheHandler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+	t.Run("single range", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("Range", "bytes=0-4")
+		rr := httptest.NewRecorder()
+		cacheHandler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusPartialContent, rr.Code)
+		assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+		assert.Equal(t, "bytes 0-4/13", rr.Header().Get("Content-Range"))
+		assert.Equal(t, "5", rr.Header().Get("Content-Length"))
+		assert.Equal(t, "Hello", rr.Body.String())
+	})
+
+	t.Run("multiple ranges", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("Range", "bytes=0-4,7-11")
+		rr := httptest.NewRecorder()
+		cacheHandler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusPartialContent, rr.Code)
+		assert.True(t, strings.HasPrefix(rr.Header().Get("Content-Type"), "multipart/byteranges; boundary="))
+		assert.Contains(t, rr.Body.String(), "Hello")
+		assert.Contains(t, rr.Body.String(), "World")
+	})
+
+	t.Run("if-range mismatch", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("Range", "bytes=0-4")
+		req.Header.Set("If-Range", `"v0"`)
+		rr := httptest.NewRecorder()
+		cacheHandler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Equal(t, "Hello, World!", rr.Body.String())
+	})
+
+	t.Run("unsatisfiable", func(t *testing.T) {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("Range", "bytes=100-200")
+		rr := httptest.NewRecorder()
+		cacheHandler.ServeHTTP(rr, req)
+		assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, rr.Code)
+	})
+}
+
+func TestCacheRangeMiss(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	run := func(rangeFill bool) (*Cache, http.Handler, *int32) {
+		cache := NewCache(1*time.Minute, NewMemoryStore())
+		cache.SetRangeFill(rangeFill)
+		var fullRequests int32
+		handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") == "bytes=0-4" {
+				w.Header().Set("Content-Range", "bytes 0-4/13")
+				w.WriteHeader(http.StatusPartialContent)
+				w.Write([]byte("Hello"))
+				return
+			}
+			atomic.AddInt32(&fullRequests, 1)
+			w.Write([]byte("Hello, World!"))
+		})
+		return cache, CacheMiddleware(cache, handler), &fullRequests
+	}
+
+	rangeRequest := func() *http.Request {
+		req := httptest.NewRequest("GET", "/test", nil)
+		req.Header.Set("Range", "bytes=0-4")
+		return req
+	}
+
+	// Partial responses are passed through, but not cached
+	cache, cacheHandler, fullRequests := run(false)
+	rr := httptest.NewRecorder()
+	cacheHandler.ServeHTTP(rr, rangeRequest())
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "Hello", rr.Body.String())
+	assert.Equal(t, 0, cache.Stats().Entries)
+	assert.Equal(t, int32(0), atomic.LoadInt32(fullRequests))
+
+	// With range fill, the full object is fetched in the background
+	cache, cacheHandler, fullRequests = run(true)
+	cacheHandler.ServeHTTP(httptest.NewRecorder(), rangeRequest())
+	assert.Eventually(t, func() bool {
+		return cache.Stats().Entries == 1
+	}, time.Second, 10*time.Millisecond)
+
+	rr = httptest.NewRecorder()
+	cacheHandler.ServeHTTP(rr, rangeRequest())
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "Hello", rr.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(fullRequests))
+}
+
+func TestParseStatusTTLs(t *testing.T) {
+	ttls, err := ParseStatusTTLs(map[string]string{"404": "30s", "5xx": "10s", "503": "1s"})
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, ttls[404])
+	assert.Equal(t, 10*time.Second, ttls[500])
+	assert.Equal(t, 1*time.Second, ttls[503])
+	assert.NotContains(t, ttls, 410)
+
+	ttls, err = ParseStatusTTLs(map[string]string{"2xx": "1m"})
+	assert.NoError(t, err)
+	assert.Contains(t, ttls, 204)
+	assert.NotContains(t, ttls, 206)
+
+	for _, values := range []map[string]string{
+		{"404": "soon"},
+		{"abc": "1m"},
+		{"304": "1m"},
+		{"1xx": "1m"},
+	} {
+		_, err := ParseStatusTTLs(values)
+		assert.Error(t, err, values)
+	}
+}
+
+func TestCacheNegativeCaching(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	cache.SetStatusTTLs(map[int]time.Duration{
+		http.StatusNotFound:           1 * time.Second,
+		http.StatusMovedPermanently:   1 * time.Minute,
+		http.StatusServiceUnavailable: 1 * time.Minute,
+	})
+
+	requests := 0
+	handler := CacheMiddleware(cache, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/moved":
+			http.Redirect(w, r, "/new", http.StatusMovedPermanently)
+		case "/down":
+			w.Header().Set("Cache-Control", "no-store")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case "/gone":
+			w.WriteHeader(http.StatusGone)
+		}
+	}))
+
+	get := func(path string) *httptest.ResponseRecorder {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", path, nil))
+		return rr
+	}
+
+	get("/missing")
+	rr := get("/missing")
+	assert.Equal(t, http.StatusNotFound, rr.Code)
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "404 page not found\n", rr.Body.String())
+	assert.Empty(t, rr.Header().Get("Accept-Ranges"))
+	assert.Equal(t, 1, requests)
+
+	get("/moved")
+	rr = get("/moved")
+	assert.Equal(t, http.StatusMovedPermanently, rr.Code)
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "/new", rr.Header().Get("Location"))
+
+	// Cache-Control is honored
+	get("/down")
+	rr = get("/down")
+	assert.Equal(t, http.StatusServiceUnavailable, rr.Code)
+	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+
+	// Statuses that aren't configured aren't cached
+	get("/gone")
+	rr = get("/gone")
+	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+
+	// The per-status TTL applies to responses without freshness information
+	requests = 0
+	time.Sleep(1100 * time.Millisecond)
+	rr = get("/missing")
+	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, 1, requests)
+}
+
+func TestCacheNoStoreRequestBypasses(t *testing.T) {
+	viper.Set("use_cache", true)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	handler := CacheMiddleware(cache, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, World!"))
+	}))
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("Cache-Control", "no-store")
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	assert.Equal(t, "BYPASS", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
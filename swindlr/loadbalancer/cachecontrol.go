@@ -0,0 +1,187 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Heuristic freshness is a fraction of the time since the resource was
+// last modified (RFC 9111 section 4.2.2), capped to a day.
+const (
+	heuristicFraction = 10
+	heuristicMaxAge   = 24 * time.Hour
+)
+
+// heuristicStatuses are the statuses that are cacheable by default, and
+// may be given a heuristic freshness (RFC 9110 section 15.1).
+var heuristicStatuses = map[int]bool{
+	http.StatusOK:                   true,
+	http.StatusNonAuthoritativeInfo: true,
+	http.StatusNoContent:            true,
+	http.StatusPartialContent:       true,
+	http.StatusMultipleChoices:      true,
+	http.StatusMovedPermanently:     true,
+	http.StatusPermanentRedirect:    true,
+	http.StatusNotFound:             true,
+	http.StatusMethodNotAllowed:     true,
+	http.StatusGone:                 true,
+	http.StatusRequestURITooLong:    true,
+	http.StatusNotImplemented:       true,
+}
+
+type cacheControl map[string]string
+
+func parseCacheControl(header http.Header) cacheControl {
+	cc := cacheControl{}
+	for _, line := range header.Values("Cache-Control") {
+		for _, part := range strings.Split(line, ",") {
+			part = strings.TrimSpace(part)
+			if part == "" {
+				continue
+			}
+			name, value, _ := strings.Cut(part, "=")
+			cc[strings.ToLower(strings.TrimSpace(name))] = strings.Trim(strings.TrimSpace(value), `"`)
+		}
+	}
+	return cc
+}
+
+func (cc cacheControl) has(directive string) bool {
+	_, ok := cc[directive]
+	return ok
+}
+
+// seconds parses a delta-seconds directive value.
+func (cc cacheControl) seconds(directive string) (time.Duration, bool) {
+	value, ok := cc[directive]
+	if !ok {
+		return 0, false
+	}
+	n, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || n < 0 {
+		// An invalid value is treated as already stale
+		return 0, true
+	}
+	return time.Duration(n) * time.Second, true
+}
+
+// requestCacheControl also honors the HTTP/1.0 Pragma: no-cache header
+// when the request carries no Cache-Control header.
+func requestCacheControl(r *http.Request) cacheControl {
+	cc := parseCacheControl(r.Header)
+	if len(r.Header.Values("Cache-Control")) == 0 && strings.Contains(strings.ToLower(r.Header.Get("Pragma")), "no-cache") {
+		cc["no-cache"] = ""
+	}
+	return cc
+}
+
+func headerTime(header http.Header, name string) (time.Time, bool) {
+	value := header.Get(name)
+	if value == "" {
+		return time.Time{}, false
+	}
+	t, err := http.ParseTime(value)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return t, true
+}
+
+// freshnessLifetime computes how long a response with the status stays
+// fresh in a shared cache, falling back to a heuristic based on
+// Last-Modified for statuses that allow it, and then to the configured
+// default.
+func freshnessLifetime(status int, header http.Header, cc cacheControl, responseTime time.Time, defaultTTL time.Duration) time.Duration {
+	if lifetime, ok := cc.seconds("s-maxage"); ok {
+		return lifetime
+	}
+	if lifetime, ok := cc.seconds("max-age"); ok {
+		return lifetime
+	}
+
+	date, ok := headerTime(header, "Date")
+	if !ok {
+		date = responseTime
+	}
+
+	if header.Get("Expires") != "" {
+		expires, ok := headerTime(header, "Expires")
+		if !ok || expires.Before(date) {
+			return 0
+		}
+		return expires.Sub(date)
+	}
+
+	if lastModified, ok := headerTime(header, "Last-Modified"); ok && lastModified.Before(date) && heuristicStatuses[status] {
+		lifetime := date.Sub(lastModified) / heuristicFraction
+		if lifetime > heuristicMaxAge {
+			lifetime = heuristicMaxAge
+		}
+		return lifetime
+	}
+
+	return defaultTTL
+}
+
+// initialAge is the corrected initial age of a response, from its Date
+// and Age headers and the time the request took (RFC 9111 section 4.2.3).
+func initialAge(header http.Header, requestTime, responseTime time.Time) time.Duration {
+	var apparentAge time.Duration
+	if date, ok := headerTime(header, "Date"); ok && responseTime.After(date) {
+		apparentAge = responseTime.Sub(date)
+	}
+
+	var ageValue time.Duration
+	if age, err := strconv.ParseInt(header.Get("Age"), 10, 64); err == nil && age > 0 {
+		ageValue = time.Duration(age) * time.Second
+	}
+
+	correctedAge := ageValue + responseTime.Sub(requestTime)
+	if apparentAge > correctedAge {
+		return apparentAge
+	}
+	return correctedAge
+}
+
+// isStorable reports whether a response with a cacheable status may be
+// stored in a shared cache.
+func isStorable(r *http.Request, reqCC, respCC cacheControl) bool {
+	if reqCC.has("no-store") || respCC.has("no-store") || respCC.has("private") {
+		return false
+	}
+
+	// Responses to authenticated requests are only shared when the origin
+	// explicitly allows it (RFC 9111 section 3.5)
+	return r.Header.Get("Authorization") == "" ||
+		respCC.has("public") || respCC.has("s-maxage") || respCC.has("must-revalidate")
+}
+
+// satisfies reports whether the cached item can be served for a request
+// with the given Cache-Control directives without contacting the origin.
+func (item CacheItem) satisfies(reqCC cacheControl, now time.Time) bool {
+	if reqCC.has("no-cache") {
+		return false
+	}
+
+	age := item.Age(now)
+	if maxAge, ok := reqCC.seconds("max-age"); ok && age > maxAge {
+		return false
+	}
+	if minFresh, ok := reqCC.seconds("min-fresh"); ok && item.FreshnessLifetime-age < minFresh {
+		return false
+	}
+
+	if age < item.FreshnessLifetime {
+		return true
+	}
+
+	if item.MustRevalidate || !reqCC.has("max-stale") {
+		return false
+	}
+	if maxStale, ok := reqCC.seconds("max-stale"); ok && reqCC["max-stale"] != "" {
+		return age-item.FreshnessLifetime <= maxStale
+	}
+	return true
+}
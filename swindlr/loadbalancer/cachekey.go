@@ -0,0 +1,124 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// CacheKeyConfig selects the parts of a request that make up its primary
+// cache key. The path is always part of the key.
+type CacheKeyConfig struct {
+	Method  bool     `mapstructure:"include_method"`
+	Scheme  bool     `mapstructure:"include_scheme"`
+	Host    bool     `mapstructure:"include_host"`
+	Query   bool     `mapstructure:"include_query"`
+	Headers []string `mapstructure:"headers"`
+	Cookies []string `mapstructure:"cookies"`
+}
+
+var DefaultCacheKeyConfig = CacheKeyConfig{
+	Method: true,
+	Scheme: true,
+	Host:   true,
+	Query:  true,
+}
+
+func (k CacheKeyConfig) Key(r *http.Request) string {
+	parts := []string{}
+
+	if k.Method {
+		parts = append(parts, r.Method)
+	}
+	if k.Scheme {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+		parts = append(parts, scheme)
+	}
+	if k.Host {
+		parts = append(parts, strings.ToLower(r.Host))
+	}
+
+	parts = append(parts, r.URL.Path)
+
+	// Encode sorts the parameters by name, so their order doesn't matter
+	if k.Query {
+		parts = append(parts, r.URL.Query().Encode())
+	}
+
+	for _, name := range k.Headers {
+		parts = append(parts, http.CanonicalHeaderKey(name)+"="+strings.Join(r.Header.Values(name), ","))
+	}
+	for _, name := range k.Cookies {
+		value := ""
+		if cookie, err := r.Cookie(name); err == nil {
+			value = cookie.Value
+		}
+		parts = append(parts, "cookie:"+name+"="+value)
+	}
+
+	key := strings.Join(parts, "|")
+	if route := routeKey(r); route != "" {
+		key += routeKeySeparator + route
+	}
+	return key
+}
+
+// routeKeySeparator precedes the route in a primary key, so the keys of
+// one URL on every route can be found from the URL's key.
+const routeKeySeparator = "|route:"
+
+// routeKey identifies the pool and tags the request was routed to, as
+// the same URL can be served by different backends.
+func routeKey(r *http.Request) string {
+	pool := GetPoolFromContext(r)
+	tags := GetTagsFromContext(r)
+	if pool == "" && len(tags) == 0 {
+		return ""
+	}
+	tags = append([]string(nil), tags...)
+	sort.Strings(tags)
+	return pool + ";" + strings.Join(tags, ",")
+}
+
+// varyHeaders returns the canonical, sorted header names listed in the
+// response's Vary header. wildcard is set for a "*", which means the
+// response can't be matched to later requests at all.
+func varyHeaders(header http.Header) (headers []string, wildcard bool) {
+	seen := map[string]bool{}
+	for _, line := range header.Values("Vary") {
+		for _, name := range strings.Split(line, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, true
+			}
+			name = http.CanonicalHeaderKey(name)
+			if !seen[name] {
+				seen[name] = true
+				headers = append(headers, name)
+			}
+		}
+	}
+	sort.Strings(headers)
+	return headers, false
+}
+
+// varyKey identifies the variant of a response selected by the request's
+// values of the Vary headers.
+func varyKey(r *http.Request, headers []string) string {
+	parts := make([]string, 0, len(headers))
+	for _, name := range headers {
+		values := r.Header.Values(name)
+		normalized := make([]string, 0, len(values))
+		for _, value := range values {
+			normalized = append(normalized, strings.Join(strings.Fields(value), " "))
+		}
+		parts = append(parts, name+"="+strings.Join(normalized, ","))
+	}
+	return strings.Join(parts, "|")
+}
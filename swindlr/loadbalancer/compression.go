@@ -0,0 +1,238 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+)
+
+// CacheCompression configures how cacheable bodies are compressed before
+// they are stored. Bodies the backend already compressed with a supported
+// encoding are stored as they are.
+type CacheCompression struct {
+	Encoding string   `mapstructure:"encoding"`
+	MinSize  int      `mapstructure:"min_size"`
+	Types    []string `mapstructure:"types"`
+}
+
+var DefaultCompressibleTypes = []string{
+	"text/*",
+	"application/javascript",
+	"application/json",
+	"application/xml",
+	"image/svg+xml",
+}
+
+func supportedEncoding(encoding string) bool {
+	return encoding == "gzip" || encoding == "br" || encoding == "zstd"
+}
+
+func (cc *CacheCompression) Validate() error {
+	if !supportedEncoding(cc.Encoding) {
+		return fmt.Errorf("unsupported cache compression encoding: %q", cc.Encoding)
+	}
+	return nil
+}
+
+// compressible reports whether the response's media type is one of the
+// configured types. Types may end with /* to match a whole group.
+func (cc *CacheCompression) compressible(header http.Header) bool {
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return false
+	}
+	for _, t := range cc.Types {
+		if t == mediaType || (strings.HasSuffix(t, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(t, "*"))) {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeBody(encoding string, content []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch encoding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		zw, err := zstd.NewWriter(&buf, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %q", encoding)
+	}
+
+	if _, err := w.Write(content); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func decodeBody(encoding string, content []byte) ([]byte, error) {
+	var r io.Reader
+	switch encoding {
+	case "gzip":
+		gr, err := gzip.NewReader(bytes.NewReader(content))
+		if err != nil {
+			return nil, err
+		}
+		defer gr.Close()
+		r = gr
+	case "br":
+		r = brotli.NewReader(bytes.NewReader(content))
+	case "zstd":
+		zr, err := zstd.NewReader(bytes.NewReader(content), zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return nil, fmt.Errorf("unsupported encoding: %q", encoding)
+	}
+	return io.ReadAll(r)
+}
+
+// acceptsEncoding evaluates the request's Accept-Encoding header for the
+// content coding (RFC 9110 section 12.5.3).
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	wildcard := false
+	for _, line := range r.Header.Values("Accept-Encoding") {
+		for _, part := range strings.Split(line, ",") {
+			name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			name = strings.ToLower(strings.TrimSpace(name))
+			if name == "x-gzip" {
+				name = "gzip"
+			}
+
+			q := 1.0
+			if key, value, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(key) == "q" {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+
+			switch name {
+			case encoding:
+				return q > 0
+			case "*":
+				wildcard = q > 0
+			}
+		}
+	}
+	return wildcard
+}
+
+// withoutVary removes the header name from the response's Vary header.
+func withoutVary(header http.Header, name string) {
+	var kept []string
+	for _, line := range header.Values("Vary") {
+		for _, token := range strings.Split(line, ",") {
+			token = strings.TrimSpace(token)
+			if token != "" && !strings.EqualFold(token, name) {
+				kept = append(kept, token)
+			}
+		}
+	}
+	if len(kept) == 0 {
+		header.Del("Vary")
+		return
+	}
+	header.Set("Vary", strings.Join(kept, ", "))
+}
+
+// encode prepares a response body for storage. The returned encoding is
+// empty if the body is stored exactly as it was received, and the cache
+// doesn't negotiate its encoding. Empty bodies, such as those of HEAD
+// responses, are stored as received, as there's nothing to decode.
+func (c *Cache) encode(content []byte, header http.Header) ([]byte, string, http.Header) {
+	cc := c.compression
+	if cc == nil || len(content) == 0 {
+		return content, "", header
+	}
+
+	encoding := strings.ToLower(strings.TrimSpace(header.Get("Content-Encoding")))
+	switch {
+	case encoding == "" && len(content) >= cc.MinSize && cc.compressible(header):
+		encoded, err := encodeBody(cc.Encoding, content)
+		if err != nil {
+			return content, "", header
+		}
+		content, encoding = encoded, cc.Encoding
+	case len(header.Values("Content-Encoding")) == 1 && supportedEncoding(encoding):
+		// Already compressed by the backend
+	default:
+		return content, "", header
+	}
+
+	// The encoding is negotiated for each request, so a single variant
+	// serves all clients
+	header = cloneHeader(header)
+	header.Del("Content-Encoding")
+	header.Del("Content-Length")
+	withoutVary(header, "Accept-Encoding")
+	return content, encoding, header
+}
+
+// negotiate returns the content coding the item is sent to the client in:
+// the stored one if the client accepts it, or none.
+func (item CacheItem) negotiate(r *http.Request) string {
+	if item.Encoding == "" || acceptsEncoding(r, item.Encoding) {
+		return item.Encoding
+	}
+	return ""
+}
+
+// etag returns the entity tag of the item sent in the content coding.
+// Each coding is a different representation, so unless it's the one the
+// origin assigned the ETag to, the coding is appended to the opaque tag,
+// as in "abc-gzip" or "abc-identity".
+func (item CacheItem) etag(encoding string) string {
+	if item.ETag == "" || item.Encoding == "" || encoding == item.ETagEncoding || !strings.HasSuffix(item.ETag, `"`) {
+		return item.ETag
+	}
+	if encoding == "" {
+		encoding = "identity"
+	}
+	return strings.TrimSuffix(item.ETag, `"`) + "-" + encoding + `"`
+}
+
+// withoutCodingSuffix removes the content coding etag appended to an
+// entity tag, if any.
+func withoutCodingSuffix(tag string) string {
+	for _, encoding := range []string{"gzip", "br", "zstd", "identity"} {
+		if suffix := "-" + encoding + `"`; strings.HasSuffix(tag, suffix) {
+			return strings.TrimSuffix(tag, suffix) + `"`
+		}
+	}
+	return tag
+}
+
+// representation returns the body of the item to send to the client, in
+// the stored encoding if the client accepts it. HEAD responses and empty
+// bodies have nothing to decode.
+func (item CacheItem) representation(r *http.Request) (content []byte, encoding string, err error) {
+	encoding = item.negotiate(r)
+	if encoding == item.Encoding || r.Method == http.MethodHead || len(item.Content) == 0 {
+		return item.Content, encoding, nil
+	}
+	DefaultMetrics.IncCounter("swindlr_cache_decompressions_total", Labels{"encoding": item.Encoding})
+	content, err = decodeBody(item.Encoding, item.Content)
+	return content, "", err
+}
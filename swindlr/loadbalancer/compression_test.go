@@ -0,0 +1,241 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header   string
+		encoding string
+		accepted bool
+	}{
+		{"", "gzip", false},
+		{"gzip, deflate", "gzip", true},
+		{"x-gzip", "gzip", true},
+		{"deflate, br;q=0.5", "br", true},
+		{"br;q=0", "br", false},
+		{"*", "br", true},
+		{"*;q=0.1, gzip;q=0", "gzip", false},
+		{"identity", "gzip", false},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		if tt.header != "" {
+			req.Header.Set("Accept-Encoding", tt.header)
+		}
+		assert.Equal(t, tt.accepted, acceptsEncoding(req, tt.encoding), tt.header)
+	}
+}
+
+func TestEncodeDecodeBody(t *testing.T) {
+	content := []byte(strings.Repeat("Hello, World! ", 100))
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		encoded, err := encodeBody(encoding, content)
+		assert.NoError(t, err)
+		assert.Less(t, len(encoded), len(content))
+
+		decoded, err := decodeBody(encoding, encoded)
+		assert.NoError(t, err)
+		assert.Equal(t, content, decoded)
+	}
+}
+
+func TestCacheCompression(t *testing.T) {
+	viper.Set("use_cache", true)
+	body := strings.Repeat("Hello, World! ", 100)
+
+	for _, encoding := range []string{"gzip", "br", "zstd"} {
+		t.Run(encoding, func(t *testing.T) {
+			store := NewMemoryStore()
+			cache := NewCache(1*time.Minute, store)
+			assert.NoError(t, cache.SetCompression(&CacheCompression{Encoding: encoding, MinSize: 100, Types: DefaultCompressibleTypes}))
+
+			handler := CacheMiddleware(cache, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.Write([]byte(body))
+			}))
+
+			rr := httptest.NewRecorder()
+			handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+			assert.Equal(t, body, rr.Body.String())
+			assert.Less(t, store.Stats().Bytes, int64(len(body)))
+
+			// Clients accepting the encoding get the stored body
+			req := httptest.NewRequest("GET", "/test", nil)
+			req.Header.Set("Accept-Encoding", "gzip, br, zstd")
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+			assert.Equal(t, encoding, rr.Header().Get("Content-Encoding"))
+			assert.Equal(t, "Accept-Encoding", rr.Header().Get("Vary"))
+			decoded, err := decodeBody(encoding, rr.Body.Bytes())
+			assert.NoError(t, err)
+			assert.Equal(t, body, string(decoded))
+
+			// Others get it decoded
+			req = httptest.NewRequest("GET", "/test", nil)
+			req.Header.Set("Accept-Encoding", "identity")
+			rr = httptest.NewRecorder()
+			handler.ServeHTTP(rr, req)
+			assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+			assert.Empty(t, rr.Header().Get("Content-Encoding"))
+			assert.Equal(t, body, rr.Body.String())
+			assert.Equal(t, "1400", rr.Header().Get("Content-Length"))
+		})
+	}
+}
+
+func TestCacheCompressionHead(t *testing.T) {
+	viper.Set("use_cache", true)
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	assert.NoError(t, cache.SetCompression(&CacheCompression{Encoding: "gzip", MinSize: 0, Types: DefaultCompressibleTypes}))
+
+	handler := CacheMiddleware(cache, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Header().Set("Vary", "Accept-Encoding")
+		if acceptsEncoding(r, "gzip") {
+			w.Header().Set("Content-Encoding", "gzip")
+			w.Header().Set("Content-Length", "60")
+		} else {
+			w.Header().Set("Content-Length", "1400")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	head := func(acceptEncoding string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", "/test", nil)
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// HEAD responses are stored as received, with nothing to decode
+	head("gzip")
+	rr := head("gzip")
+	assert.Equal(t, http.StatusOK, rr.Code)
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "gzip", rr.Header().Get("Content-Encoding"))
+	assert.Equal(t, "60", rr.Header().Get("Content-Length"))
+
+	for i := 0; i < 2; i++ {
+		rr = head("")
+		assert.Equal(t, http.StatusOK, rr.Code)
+		assert.Empty(t, rr.Header().Get("Content-Encoding"))
+		assert.Equal(t, "1400", rr.Header().Get("Content-Length"))
+	}
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+}
+
+func TestCacheCompressionKeepsBackendEncoding(t *testing.T) {
+	viper.Set("use_cache", true)
+	body := strings.Repeat("Hello, World! ", 100)
+	encoded, _ := encodeBody("br", []byte(body))
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	assert.NoError(t, cache.SetCompression(&CacheCompression{Encoding: "gzip", Types: DefaultCompressibleTypes}))
+
+	requests := 0
+	handler := CacheMiddleware(cache, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Vary", "Accept-Encoding")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("Cache-Control", "max-age=0")
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("Content-Encoding", "br")
+		w.Write(encoded)
+	}))
+
+	req := httptest.NewRequest("GET", "/test", nil)
+	req.Header.Set("Accept-Encoding", "br")
+	handler.ServeHTTP(httptest.NewRecorder(), req)
+
+	// The variant stored for a br client serves clients without br too,
+	// also after being revalidated
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+		assert.Equal(t, "REVALIDATED", rr.Header().Get("X-Swindlr-Cache"))
+		assert.Empty(t, rr.Header().Get("Content-Encoding"))
+		assert.Equal(t, body, rr.Body.String())
+	}
+	assert.Equal(t, 3, requests)
+}
+
+func TestCacheCompressionETags(t *testing.T) {
+	viper.Set("use_cache", true)
+	body := strings.Repeat("Hello, World! ", 100)
+
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	assert.NoError(t, cache.SetCompression(&CacheCompression{Encoding: "gzip", Types: DefaultCompressibleTypes}))
+	handler := CacheMiddleware(cache, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body))
+	}))
+	handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/test", nil))
+
+	serve := func(header http.Header) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/test", nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	// The origin's ETag is for the unencoded response
+	rr := serve(nil)
+	assert.Equal(t, `"v1"`, rr.Header().Get("ETag"))
+	rr = serve(http.Header{"Accept-Encoding": {"gzip"}})
+	assert.Equal(t, `"v1-gzip"`, rr.Header().Get("ETag"))
+
+	// Any coding's ETag validates the response
+	rr = serve(http.Header{"If-None-Match": {`"v1-gzip"`}})
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Equal(t, `"v1"`, rr.Header().Get("ETag"))
+	rr = serve(http.Header{"Accept-Encoding": {"gzip"}, "If-None-Match": {`"v1"`}})
+	assert.Equal(t, http.StatusNotModified, rr.Code)
+	assert.Equal(t, `"v1-gzip"`, rr.Header().Get("ETag"))
+
+	// Ranges are only served from the same coding
+	rr = serve(http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-9"}, "If-Range": {`"v1-gzip"`}})
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	rr = serve(http.Header{"Accept-Encoding": {"gzip"}, "Range": {"bytes=0-9"}, "If-Range": {`"v1"`}})
+	assert.Equal(t, http.StatusOK, rr.Code)
+	rr = serve(http.Header{"Range": {"bytes=0-9"}, "If-Range": {`"v1"`}})
+	assert.Equal(t, http.StatusPartialContent, rr.Code)
+	assert.Equal(t, body[:10], rr.Body.String())
+}
+
+func TestCacheCompressionSkipsIncompressible(t *testing.T) {
+	cache := NewCache(1*time.Minute, NewMemoryStore())
+	assert.NoError(t, cache.SetCompression(&CacheCompression{Encoding: "gzip", MinSize: 10, Types: DefaultCompressibleTypes}))
+	assert.Error(t, cache.SetCompression(&CacheCompression{Encoding: "deflate"}))
+
+	now := time.Now()
+	item := cache.NewCacheItem(http.StatusOK, []byte("short"), http.Header{"Content-Type": {"text/plain"}}, now, now)
+	assert.Empty(t, item.Encoding)
+
+	item = cache.NewCacheItem(http.StatusOK, make([]byte, 100), http.Header{"Content-Type": {"image/png"}}, now, now)
+	assert.Empty(t, item.Encoding)
+
+	item = cache.NewCacheItem(http.StatusOK, make([]byte, 100), http.Header{"Content-Type": {"application/json"}}, now, now)
+	assert.Equal(t, "gzip", item.Encoding)
+}
@@ -0,0 +1,125 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Headers that are sent along with a 304 Not Modified response
+// (RFC 9110 section 15.4.5).
+var notModifiedHeaders = []string{"Cache-Control", "Content-Location", "Date", "ETag", "Expires", "Vary"}
+
+// parseETags splits an If-None-Match value into its entity tags. Commas
+// inside quoted tags are not treated as separators.
+func parseETags(value string) []string {
+	var tags []string
+	for {
+		value = strings.TrimLeft(value, " \t,")
+		if value == "" {
+			return tags
+		}
+		if value[0] == '*' {
+			tags = append(tags, "*")
+			value = value[1:]
+			continue
+		}
+
+		start := 0
+		if strings.HasPrefix(value, "W/") {
+			start = 2
+		}
+		if len(value) <= start || value[start] != '"' {
+			// Not a valid entity tag, skip to the next one
+			if i := strings.IndexByte(value, ','); i >= 0 {
+				value = value[i:]
+				continue
+			}
+			return tags
+		}
+
+		end := strings.IndexByte(value[start+1:], '"')
+		if end < 0 {
+			return tags
+		}
+		end += start + 2
+		tags = append(tags, value[:end])
+		value = value[end:]
+	}
+}
+
+// weakMatch compares entity tags ignoring their weakness indicator, as
+// required for If-None-Match (RFC 9110 section 8.8.3.2).
+func weakMatch(a, b string) bool {
+	return a != "" && strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/")
+}
+
+// notModified evaluates the request's If-None-Match and If-Modified-Since
+// headers against the cached item (RFC 9110 section 13.2.2).
+func notModified(r *http.Request, item CacheItem) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+
+	if match := r.Header.Get("If-None-Match"); match != "" {
+		for _, tag := range parseETags(match) {
+			// The client may have any coding of the response, which all
+			// have the same content
+			if tag == "*" || weakMatch(tag, item.ETag) || (item.Encoding != "" && weakMatch(withoutCodingSuffix(tag), item.ETag)) {
+				return true
+			}
+		}
+		// If-Modified-Since is ignored when If-None-Match is present
+		return false
+	}
+
+	if item.LastModified.IsZero() {
+		return false
+	}
+	since, ok := headerTime(r.Header, "If-Modified-Since")
+	return ok && !item.LastModified.After(since)
+}
+
+func (item CacheItem) hasValidators() bool {
+	return item.ETag != "" || !item.LastModified.IsZero()
+}
+
+// conditionalRequest copies the request for revalidating the cached item
+// with the origin. The client's own conditional headers are replaced by
+// the item's validators.
+func conditionalRequest(r *http.Request, item CacheItem) *http.Request {
+	req := r.Clone(r.Context())
+	for _, h := range []string{"If-None-Match", "If-Modified-Since", "If-Range", "Range"} {
+		req.Header.Del(h)
+	}
+
+	if item.ETag != "" {
+		req.Header.Set("If-None-Match", item.ETag)
+	}
+	if !item.LastModified.IsZero() {
+		req.Header.Set("If-Modified-Since", item.LastModified.UTC().Format(http.TimeFormat))
+	}
+	return req
+}
+
+// revalidated refreshes the cached item with the headers of a 304 Not
+// Modified response (RFC 9111 section 4.3.4) and stores it again.
+func (c *Cache) revalidated(key string, r *http.Request, item CacheItem, header http.Header, requestTime, responseTime time.Time) CacheItem {
+	merged := cloneHeader(item.Header)
+	for k, v := range header {
+		if k == "Content-Length" {
+			continue
+		}
+		merged[k] = append([]string(nil), v...)
+	}
+	// The stored body is already encoded
+	if item.Encoding != "" {
+		merged.Set("Content-Encoding", item.Encoding)
+	}
+
+	updated := c.NewCacheItem(item.status(), item.Content, merged, requestTime, responseTime)
+	updated.ETagEncoding = item.ETagEncoding
+	c.Set(key, r, updated)
+	DefaultMetrics.IncCounter("swindlr_cache_revalidations_total", Labels{"result": "not_modified"})
+	return updated
+}
@@ -0,0 +1,548 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// After a failed write, the disk tier isn't written to for this long and
+// the cache keeps working from memory.
+const diskRetryInterval = time.Minute
+
+// diskRecord describes a response stored in the disk tier. The body is
+// stored separately in a file named after its SHA-256 hash, so identical
+// bodies are only stored once.
+type diskRecord struct {
+	Key        string    `json:"key"`
+	Path       string    `json:"path"`
+	Vary       []string  `json:"vary,omitempty"`
+	Variant    string    `json:"variant"`
+	Hash       string    `json:"hash"`
+	Size       int64     `json:"size"`
+	LastAccess time.Time `json:"last_access"`
+	Item       CacheItem `json:"item"`
+	hits       int
+}
+
+func (rec *diskRecord) entry() *cacheEntry {
+	return &cacheEntry{key: rec.Key, path: rec.Path, vary: rec.Vary}
+}
+
+// diskWrite is a response waiting to be written, or being written.
+type diskWrite struct {
+	rec     *diskRecord
+	content []byte
+	started bool
+	// canceled is set when the response is removed before it's indexed
+	canceled bool
+}
+
+// DiskTier is the second tier of the cache. Its index is kept in memory
+// and saved to index.json in the directory, so the stored responses
+// survive restarts. When the tier is over its size limit, the least
+// recently used responses are removed.
+type DiskTier struct {
+	dir      string
+	maxBytes int64
+	// promoteHits is the number of disk hits after which a response is
+	// copied into the memory tier
+	promoteHits int
+	keys        map[string]map[string]*list.Element
+	lru         *list.List
+	refs        map[string]int
+	bytes       int64
+	dirty       bool
+	failedUntil time.Time
+	// pending holds the writes that aren't indexed yet, and writing counts
+	// the bodies being written by hash, which aren't removed meanwhile
+	pending []*diskWrite
+	writing map[string]int
+	// unlinks holds the hashes of bodies no record refers to anymore,
+	// which are deleted by unlinkRemoved without holding the lock.
+	// unlinking marks the bodies being deleted, which aren't written
+	// meanwhile
+	unlinks   []string
+	unlinking map[string]bool
+	unlinked  *sync.Cond
+	// With a write queue, responses are written in the background and
+	// dropped once queueSize writes are pending
+	queueSize int
+	queued    chan struct{}
+	mux       sync.Mutex
+}
+
+func OpenDiskTier(dir string, maxBytes int64, promoteHits int) (*DiskTier, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0o755); err != nil {
+		return nil, err
+	}
+
+	d := &DiskTier{
+		dir:         dir,
+		maxBytes:    maxBytes,
+		promoteHits: promoteHits,
+		keys:        make(map[string]map[string]*list.Element),
+		lru:         list.New(),
+		refs:        make(map[string]int),
+		writing:     make(map[string]int),
+		unlinking:   make(map[string]bool),
+		queued:      make(chan struct{}, 1),
+	}
+	d.unlinked = sync.NewCond(&d.mux)
+	if err := d.load(); err != nil {
+		return nil, err
+	}
+	d.unlinkRemoved()
+	return d, nil
+}
+
+func (d *DiskTier) indexPath() string {
+	return filepath.Join(d.dir, "index.json")
+}
+
+func (d *DiskTier) objectPath(hash string) string {
+	return filepath.Join(d.dir, "objects", hash[:2], hash)
+}
+
+// load reads the index and removes records whose body is missing, as
+// well as bodies no record refers to.
+func (d *DiskTier) load() error {
+	data, err := os.ReadFile(d.indexPath())
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	var records []*diskRecord
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &records); err != nil {
+			// A corrupt index only costs us the stored responses
+			log.Printf("Ignoring corrupt cache index %s: %s", d.indexPath(), err)
+			records = nil
+		}
+	}
+
+	// Records are saved most recently used first
+	for _, rec := range records {
+		info, err := os.Stat(d.objectPath(rec.Hash))
+		if err != nil || info.Size() != rec.Size {
+			continue
+		}
+		d.insert(rec, d.lru.PushBack(rec))
+	}
+
+	err = filepath.WalkDir(filepath.Join(d.dir, "objects"), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if d.refs[entry.Name()] == 0 {
+			os.Remove(path)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	d.evict()
+	return nil
+}
+
+func (d *DiskTier) insert(rec *diskRecord, element *list.Element) {
+	variants, found := d.keys[rec.Key]
+	if !found {
+		variants = make(map[string]*list.Element)
+		d.keys[rec.Key] = variants
+	}
+	variants[rec.Variant] = element
+	if d.refs[rec.Hash] == 0 {
+		d.bytes += rec.Size
+	}
+	d.refs[rec.Hash]++
+}
+
+// Get returns the variant of the key matching the request. hot is set
+// once the response has been read often enough to be promoted.
+func (d *DiskTier) Get(key string, r *http.Request) (item CacheItem, hot bool, found bool) {
+	d.mux.Lock()
+	variants := d.keys[key]
+	// All variants of a key vary on the same headers
+	var element *list.Element
+	for _, e := range variants {
+		element = variants[varyKey(r, e.Value.(*diskRecord).Vary)]
+		break
+	}
+	if element == nil {
+		d.mux.Unlock()
+		return CacheItem{}, false, false
+	}
+
+	rec := element.Value.(*diskRecord)
+	d.lru.MoveToFront(element)
+	rec.LastAccess = time.Now()
+	rec.hits++
+	hot = rec.hits >= d.promoteHits
+	item = rec.Item
+	path := d.objectPath(rec.Hash)
+	d.dirty = true
+	d.mux.Unlock()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		log.Printf("Error reading cached response from disk: %s", err)
+		DefaultMetrics.IncCounter("swindlr_cache_disk_errors_total", Labels{"op": "read"})
+		d.Delete(key, rec.Variant)
+		d.unlinkRemoved()
+		return CacheItem{}, false, false
+	}
+	item.Content = content
+	return item, hot, true
+}
+
+// SetWriteQueue makes Put queue responses to be written in the background,
+// so callers don't wait for the disk. Once size writes are pending, new
+// responses are dropped. A size of zero writes synchronously.
+func (d *DiskTier) SetWriteQueue(size int) {
+	d.mux.Lock()
+	d.queueSize = size
+	d.mux.Unlock()
+	if size > 0 {
+		go d.startWriter()
+	}
+}
+
+// Put stores the response. Failures are reported, and writes are then
+// skipped for a while so the cache carries on from memory.
+func (d *DiskTier) Put(key, path string, vary []string, variant string, item CacheItem) error {
+	sum := sha256.Sum256(item.Content)
+	rec := &diskRecord{
+		Key:        key,
+		Path:       path,
+		Vary:       vary,
+		Variant:    variant,
+		Hash:       hex.EncodeToString(sum[:]),
+		Size:       int64(len(item.Content)),
+		LastAccess: time.Now(),
+		Item:       item,
+	}
+	rec.Item.Content = nil
+	w := &diskWrite{rec: rec, content: item.Content}
+
+	d.mux.Lock()
+	if time.Now().Before(d.failedUntil) {
+		d.mux.Unlock()
+		return nil
+	}
+	if d.queueSize > 0 {
+		if len(d.pending) >= d.queueSize {
+			d.mux.Unlock()
+			DefaultMetrics.IncCounter("swindlr_cache_disk_dropped_total", nil)
+			return nil
+		}
+		d.pending = append(d.pending, w)
+		d.mux.Unlock()
+		select {
+		case d.queued <- struct{}{}:
+		default:
+		}
+		return nil
+	}
+	w.started = true
+	d.pending = append(d.pending, w)
+	d.mux.Unlock()
+	return d.write(w)
+}
+
+// startWriter writes the queued responses in order.
+func (d *DiskTier) startWriter() {
+	for range d.queued {
+		for {
+			d.mux.Lock()
+			var next *diskWrite
+			for _, w := range d.pending {
+				if !w.started {
+					next = w
+					break
+				}
+			}
+			if next == nil {
+				d.mux.Unlock()
+				break
+			}
+			next.started = true
+			d.mux.Unlock()
+			d.write(next)
+		}
+	}
+}
+
+// write stores the body of a pending write, unless it's already stored,
+// then indexes the response. The lock is only held to update the index.
+func (d *DiskTier) write(w *diskWrite) error {
+	rec := w.rec
+	defer d.unlinkRemoved()
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	defer d.dropPending(w)
+	// A body being deleted can't be written until it's gone
+	for d.unlinking[rec.Hash] {
+		d.unlinked.Wait()
+	}
+	if w.canceled {
+		return nil
+	}
+
+	if d.refs[rec.Hash] == 0 {
+		d.writing[rec.Hash]++
+		d.mux.Unlock()
+		err := d.writeObject(rec.Hash, w.content)
+		d.mux.Lock()
+		d.writing[rec.Hash]--
+		if d.writing[rec.Hash] == 0 {
+			delete(d.writing, rec.Hash)
+		}
+
+		if err != nil {
+			d.failedUntil = time.Now().Add(diskRetryInterval)
+			DefaultMetrics.IncCounter("swindlr_cache_disk_errors_total", Labels{"op": "write"})
+			log.Printf("Error writing cached response to disk, using memory only for %s: %s", diskRetryInterval, err)
+			return err
+		}
+		if w.canceled {
+			d.unlinks = append(d.unlinks, rec.Hash)
+			return nil
+		}
+	}
+
+	// Index the record before removing the ones it replaces, so a body
+	// they share keeps its reference and isn't removed
+	var replaced []*list.Element
+	if variants, found := d.keys[rec.Key]; found {
+		for v, element := range variants {
+			if v == rec.Variant || !equalStrings(element.Value.(*diskRecord).Vary, rec.Vary) {
+				replaced = append(replaced, element)
+			}
+		}
+	}
+	d.insert(rec, d.lru.PushFront(rec))
+	for _, element := range replaced {
+		d.remove(element)
+	}
+	d.dirty = true
+	d.evict()
+	return nil
+}
+
+// dropPending forgets a write once it's done. It must be called with the
+// lock held.
+func (d *DiskTier) dropPending(w *diskWrite) {
+	for i, pending := range d.pending {
+		if pending == w {
+			d.pending = append(d.pending[:i], d.pending[i+1:]...)
+			return
+		}
+	}
+}
+
+func (d *DiskTier) writeObject(hash string, content []byte) error {
+	path := d.objectPath(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+
+	// Write to a temporary file first, so a partially written body is
+	// never mistaken for a complete one
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// remove drops the record. Once no other record refers to its body, the
+// body is left for unlinkRemoved. It must be called with the lock held.
+func (d *DiskTier) remove(element *list.Element) {
+	rec := element.Value.(*diskRecord)
+	d.lru.Remove(element)
+
+	variants := d.keys[rec.Key]
+	// The variant may already be taken by the record replacing this one
+	if variants[rec.Variant] == element {
+		delete(variants, rec.Variant)
+	}
+	if len(variants) == 0 {
+		delete(d.keys, rec.Key)
+	}
+
+	d.refs[rec.Hash]--
+	if d.refs[rec.Hash] <= 0 {
+		delete(d.refs, rec.Hash)
+		d.bytes -= rec.Size
+		d.unlinks = append(d.unlinks, rec.Hash)
+	}
+	d.dirty = true
+}
+
+// unlinkRemoved deletes the bodies removed records left behind. It must
+// be called without the tier's lock, and the store's, held, so lookups
+// don't wait for the filesystem. Bodies referred to again, or being
+// written, are kept.
+func (d *DiskTier) unlinkRemoved() {
+	d.mux.Lock()
+	var hashes []string
+	for _, hash := range d.unlinks {
+		if d.refs[hash] > 0 || d.writing[hash] > 0 || d.unlinking[hash] {
+			continue
+		}
+		d.unlinking[hash] = true
+		hashes = append(hashes, hash)
+	}
+	d.unlinks = nil
+	d.mux.Unlock()
+	if len(hashes) == 0 {
+		return
+	}
+
+	for _, hash := range hashes {
+		os.Remove(d.objectPath(hash))
+	}
+
+	d.mux.Lock()
+	for _, hash := range hashes {
+		delete(d.unlinking, hash)
+	}
+	d.unlinked.Broadcast()
+	d.mux.Unlock()
+}
+
+func (d *DiskTier) evict() {
+	for d.lru.Len() > 0 && d.maxBytes > 0 && d.bytes > d.maxBytes {
+		d.remove(d.lru.Back())
+		DefaultMetrics.IncCounter("swindlr_cache_disk_evictions_total", nil)
+	}
+	DefaultMetrics.SetGauge("swindlr_cache_disk_entries", nil, float64(d.lru.Len()))
+	DefaultMetrics.SetGauge("swindlr_cache_disk_bytes", nil, float64(d.bytes))
+}
+
+// Delete removes the variant of the key, leaving its body to
+// unlinkRemoved.
+func (d *DiskTier) Delete(key, variant string) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	if element, found := d.keys[key][variant]; found {
+		d.remove(element)
+	}
+	for _, w := range d.pending {
+		if w.rec.Key == key && w.rec.Variant == variant {
+			w.canceled = true
+		}
+	}
+}
+
+// Remove drops all responses for which match returns true and returns
+// how many were removed. Like Delete, it leaves their bodies to
+// unlinkRemoved.
+func (d *DiskTier) Remove(match func(entry *cacheEntry, item CacheItem) bool) int {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+
+	removed := 0
+	for element := d.lru.Front(); element != nil; {
+		next := element.Next()
+		rec := element.Value.(*diskRecord)
+		if match(rec.entry(), rec.Item) {
+			d.remove(element)
+			removed++
+		}
+		element = next
+	}
+	// Pending writes aren't counted, as they were never readable
+	for _, w := range d.pending {
+		if match(w.rec.entry(), w.rec.Item) {
+			w.canceled = true
+		}
+	}
+	d.evict()
+	return removed
+}
+
+func (d *DiskTier) Flush() int {
+	return d.Remove(func(*cacheEntry, CacheItem) bool { return true })
+}
+
+func (d *DiskTier) Stats() (entries int, bytes int64) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.lru.Len(), d.bytes
+}
+
+// Sync saves the index if it changed since it was last saved.
+func (d *DiskTier) Sync() error {
+	d.mux.Lock()
+	if !d.dirty {
+		d.mux.Unlock()
+		return nil
+	}
+	records := make([]*diskRecord, 0, d.lru.Len())
+	for element := d.lru.Front(); element != nil; element = element.Next() {
+		records = append(records, element.Value.(*diskRecord))
+	}
+	data, err := json.Marshal(records)
+	d.dirty = false
+	d.mux.Unlock()
+	if err != nil {
+		return err
+	}
+
+	tmp := d.indexPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		d.markDirty()
+		return err
+	}
+	if err := os.Rename(tmp, d.indexPath()); err != nil {
+		d.markDirty()
+		return err
+	}
+	return nil
+}
+
+func (d *DiskTier) markDirty() {
+	d.mux.Lock()
+	d.dirty = true
+	d.mux.Unlock()
+}
+
+// StartSync saves the index every interval until stop is closed.
+func (d *DiskTier) StartSync(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := d.Sync(); err != nil {
+				DefaultMetrics.IncCounter("swindlr_cache_disk_errors_total", Labels{"op": "sync"})
+				log.Printf("Error saving cache index: %s", err)
+			}
+		case <-stop:
+			d.Sync()
+			return
+		}
+	}
+}
@@ -0,0 +1,241 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func newDiskTestItem(content string) CacheItem {
+	now := time.Now()
+	return CacheItem{
+		Content:           []byte(content),
+		Expiration:        now.Add(time.Minute),
+		Header:            http.Header{"Content-Type": {"text/plain"}},
+		ResponseTime:      now,
+		FreshnessLifetime: time.Minute,
+	}
+}
+
+func countObjects(t *testing.T, dir string) int {
+	count := 0
+	filepath.WalkDir(filepath.Join(dir, "objects"), func(path string, entry os.DirEntry, err error) error {
+		if err == nil && !entry.IsDir() {
+			count++
+		}
+		return err
+	})
+	return count
+}
+
+func TestDiskTierPutGet(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := OpenDiskTier(dir, 0, 2)
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/a", nil)
+	assert.NoError(t, disk.Put("a", "/a", nil, "", newDiskTestItem("same")))
+	assert.NoError(t, disk.Put("b", "/b", nil, "", newDiskTestItem("same")))
+
+	// Identical bodies are stored once
+	assert.Equal(t, 1, countObjects(t, dir))
+	entries, bytes := disk.Stats()
+	assert.Equal(t, 2, entries)
+	assert.Equal(t, int64(4), bytes)
+
+	item, hot, found := disk.Get("a", req)
+	assert.True(t, found)
+	assert.False(t, hot)
+	assert.Equal(t, "same", string(item.Content))
+	assert.Equal(t, "text/plain", item.Header.Get("Content-Type"))
+
+	_, hot, _ = disk.Get("a", req)
+	assert.True(t, hot)
+
+	disk.Delete("a", "")
+	disk.unlinkRemoved()
+	assert.Equal(t, 1, countObjects(t, dir))
+	disk.Delete("b", "")
+	// Bodies are only deleted once no lock is held
+	assert.Equal(t, 1, countObjects(t, dir))
+	disk.unlinkRemoved()
+	assert.Equal(t, 0, countObjects(t, dir))
+}
+
+func TestDiskTierUnlinkReinsertedBody(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := OpenDiskTier(dir, 0, 2)
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/a", nil)
+	assert.NoError(t, disk.Put("a", "/a", nil, "", newDiskTestItem("hello")))
+	disk.Delete("a", "")
+	// Stored again before the removed body is deleted
+	assert.NoError(t, disk.Put("b", "/b", nil, "", newDiskTestItem("hello")))
+	disk.unlinkRemoved()
+
+	item, _, found := disk.Get("b", req)
+	assert.True(t, found)
+	assert.Equal(t, "hello", string(item.Content))
+	assert.Equal(t, 1, countObjects(t, dir))
+}
+
+func TestDiskTierPutSameBody(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := OpenDiskTier(dir, 0, 2)
+	assert.NoError(t, err)
+
+	// Refreshing an unchanged response keeps its body
+	req, _ := http.NewRequest("GET", "/a", nil)
+	assert.NoError(t, disk.Put("a", "/a", nil, "", newDiskTestItem("hello")))
+	_, _, found := disk.Get("a", req)
+	assert.True(t, found)
+	assert.NoError(t, disk.Put("a", "/a", nil, "", newDiskTestItem("hello")))
+
+	item, _, found := disk.Get("a", req)
+	assert.True(t, found)
+	assert.Equal(t, "hello", string(item.Content))
+	assert.Equal(t, 1, countObjects(t, dir))
+	entries, bytes := disk.Stats()
+	assert.Equal(t, 1, entries)
+	assert.Equal(t, int64(5), bytes)
+}
+
+func TestDiskTierSurvivesRestart(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := OpenDiskTier(dir, 0, 1)
+	assert.NoError(t, err)
+	assert.NoError(t, disk.Put("a", "/a", nil, "", newDiskTestItem("hello")))
+	assert.NoError(t, disk.Sync())
+
+	// Bodies not in the index are removed on startup
+	orphan := filepath.Join(dir, "objects", "ff", "ffff")
+	assert.NoError(t, os.MkdirAll(filepath.Dir(orphan), 0o755))
+	assert.NoError(t, os.WriteFile(orphan, []byte("orphan"), 0o644))
+
+	disk, err = OpenDiskTier(dir, 0, 1)
+	assert.NoError(t, err)
+	req, _ := http.NewRequest("GET", "/a", nil)
+	item, _, found := disk.Get("a", req)
+	assert.True(t, found)
+	assert.Equal(t, "hello", string(item.Content))
+	assert.NoFileExists(t, orphan)
+}
+
+func TestDiskTierEviction(t *testing.T) {
+	disk, err := OpenDiskTier(t.TempDir(), 10, 1)
+	assert.NoError(t, err)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	disk.Put("a", "/a", nil, "", newDiskTestItem("aaaa"))
+	disk.Put("b", "/b", nil, "", newDiskTestItem("bbbb"))
+	disk.Get("a", req)
+	disk.Put("c", "/c", nil, "", newDiskTestItem("cccc"))
+
+	_, _, found := disk.Get("b", req)
+	assert.False(t, found)
+	_, _, found = disk.Get("a", req)
+	assert.True(t, found)
+	_, _, found = disk.Get("c", req)
+	assert.True(t, found)
+}
+
+func TestDiskTierWriteQueue(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := OpenDiskTier(dir, 0, 1)
+	assert.NoError(t, err)
+	// Queue writes without a writer, until it's started below
+	disk.queueSize = 2
+
+	assert.NoError(t, disk.Put("a", "/a", nil, "", newDiskTestItem("aaaa")))
+	assert.NoError(t, disk.Put("b", "/b", nil, "", newDiskTestItem("bbbb")))
+	// The queue is full
+	assert.NoError(t, disk.Put("c", "/c", nil, "", newDiskTestItem("cccc")))
+	entries, _ := disk.Stats()
+	assert.Equal(t, 0, entries)
+
+	// A purge covers the responses waiting to be written
+	disk.Remove(func(entry *cacheEntry, _ CacheItem) bool { return entry.key == "a" })
+	go disk.startWriter()
+
+	assert.Eventually(t, func() bool {
+		disk.mux.Lock()
+		defer disk.mux.Unlock()
+		return len(disk.pending) == 0
+	}, time.Second, time.Millisecond)
+
+	req, _ := http.NewRequest("GET", "/", nil)
+	_, _, found := disk.Get("a", req)
+	assert.False(t, found)
+	item, _, found := disk.Get("b", req)
+	assert.True(t, found)
+	assert.Equal(t, "bbbb", string(item.Content))
+	_, _, found = disk.Get("c", req)
+	assert.False(t, found)
+	assert.Equal(t, 1, countObjects(t, dir))
+}
+
+func TestCacheDiskTier(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := OpenDiskTier(dir, 0, 2)
+	assert.NoError(t, err)
+
+	store := NewMemoryStore()
+	store.SetLimits(0, 1)
+	store.SetDiskTier(disk)
+	cache := NewCache(1*time.Minute, store)
+
+	reqA, _ := http.NewRequest("GET", "/a", nil)
+	reqB, _ := http.NewRequest("GET", "/b", nil)
+	cache.Set(cache.Key(reqA), reqA, newDiskTestItem("a"))
+	cache.Set(cache.Key(reqB), reqB, newDiskTestItem("b"))
+
+	// a was evicted from memory, but is still on disk
+	stats := cache.Stats()
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, 2, stats.DiskEntries)
+
+	item, found := cache.Get(cache.Key(reqA), reqA)
+	assert.True(t, found)
+	assert.Equal(t, "a", string(item.Content))
+	_, found = store.lookupMemory(cache.Key(reqA), reqA)
+	assert.False(t, found)
+
+	// The second hit promotes it into memory
+	cache.Get(cache.Key(reqA), reqA)
+	_, found = store.lookupMemory(cache.Key(reqA), reqA)
+	assert.True(t, found)
+
+	purged, err := cache.Purge(PurgeSelector{Prefix: "/"})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, purged)
+	_, found = cache.Get(cache.Key(reqB), reqB)
+	assert.False(t, found)
+	// The purged bodies are deleted once the store's lock is released
+	assert.Equal(t, 0, countObjects(t, dir))
+}
+
+func TestCacheDiskWriteFailure(t *testing.T) {
+	dir := t.TempDir()
+	disk, err := OpenDiskTier(dir, 0, 1)
+	assert.NoError(t, err)
+
+	// Make writing bodies fail
+	assert.NoError(t, os.RemoveAll(filepath.Join(dir, "objects")))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "objects"), nil, 0o644))
+
+	store := NewMemoryStore()
+	store.SetDiskTier(disk)
+	cache := NewCache(1*time.Minute, store)
+
+	req, _ := http.NewRequest("GET", "/a", nil)
+	cache.Set(cache.Key(req), req, newDiskTestItem("a"))
+	item, found := cache.Get(cache.Key(req), req)
+	assert.True(t, found)
+	assert.Equal(t, "a", string(item.Content))
+	assert.Equal(t, 0, cache.Stats().DiskEntries)
+}
@@ -0,0 +1,353 @@
+package loadbalancer
+
+import (
+	"errors"
+	"log"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+var errLimitStoreUnavailable = errors.New("rate limit store unavailable")
+
+// sharedRateLimits counts backend limits and policies across replicas,
+// when set.
+var sharedRateLimits *DistributedLimiter
+
+func SetSharedRateLimits(limiter *DistributedLimiter) {
+	sharedRateLimits = limiter
+}
+
+// DistributedLimiter counts requests in fixed windows, in a store shared
+// by all replicas. Sliding windows are approximated from the counts of the
+// current and previous fixed windows. To keep the store off the path of
+// most requests, each replica takes a batch of requests from a counter at
+// once and hands them out locally. Requests left in a batch at the end of
+// a window are lost, so batches should be small compared to the limits.
+type DistributedLimiter struct {
+	client    *respClient
+	prefix    string
+	batchSize int
+	// failOpen lets requests through while the store is unavailable
+	failOpen bool
+	// After a failure, the store isn't used for retryInterval
+	retryInterval time.Duration
+	failedUntil   time.Time
+	mux           sync.Mutex
+}
+
+func NewDistributedLimiter(client *respClient, prefix string, batchSize int, failOpen bool, retryInterval time.Duration) *DistributedLimiter {
+	if batchSize < 1 {
+		batchSize = 1
+	}
+	return &DistributedLimiter{
+		client:        client,
+		prefix:        prefix,
+		batchSize:     batchSize,
+		failOpen:      failOpen,
+		retryInterval: retryInterval,
+	}
+}
+
+// newState returns the state of a limit of limit requests per period,
+// counted under key.
+func (d *DistributedLimiter) newState(key string, limit int, period time.Duration) limitState {
+	return &distributedState{limiter: d, key: d.prefix + key, limit: limit, period: period}
+}
+
+// newSlidingState returns the state of a limit of limit requests in any
+// window of period, counted under key.
+func (d *DistributedLimiter) newSlidingState(key string, limit int, period time.Duration) limitState {
+	return &distributedState{limiter: d, key: d.prefix + key, limit: limit, period: period, sliding: true}
+}
+
+// unavailable returns until when the store isn't used after a failure.
+func (d *DistributedLimiter) unavailable(now time.Time) (time.Time, bool) {
+	d.mux.Lock()
+	defer d.mux.Unlock()
+	return d.failedUntil, now.Before(d.failedUntil)
+}
+
+func (d *DistributedLimiter) failed(err error) {
+	d.mux.Lock()
+	d.failedUntil = time.Now().Add(d.retryInterval)
+	d.mux.Unlock()
+	DefaultMetrics.IncCounter("swindlr_rate_limit_store_errors_total", nil)
+	log.Printf("Rate limit store failed, failing %s for %s: %s", d.failMode(), d.retryInterval, err)
+}
+
+func (d *DistributedLimiter) failMode() string {
+	if d.failOpen {
+		return "open"
+	}
+	return "closed"
+}
+
+// allocate takes up to n requests from the counter of a window, which
+// allows limit requests in total. It returns how many were taken and the
+// counter's value. Requests that weren't taken are given back, so the
+// counter only counts allowed requests.
+func (d *DistributedLimiter) allocate(key string, n int, limit int64, ttl time.Duration) (int, int64, error) {
+	if _, unavailable := d.unavailable(time.Now()); unavailable {
+		return 0, 0, errLimitStoreUnavailable
+	}
+
+	replies, err := d.client.Pipeline([][]string{
+		{"INCRBY", key, strconv.Itoa(n)},
+		{"PEXPIRE", key, pxMillis(ttl)},
+	})
+	if err == nil {
+		err = firstError(replies)
+	}
+	if err != nil {
+		d.failed(err)
+		return 0, 0, err
+	}
+
+	count, ok := replies[0].(int64)
+	if !ok {
+		err := errors.New("unexpected INCRBY reply")
+		d.failed(err)
+		return 0, 0, err
+	}
+	granted := n
+	if over := count - limit; over > 0 {
+		granted = n - int(over)
+		if granted < 0 {
+			granted = 0
+		}
+	}
+	if granted < n {
+		if _, err := d.client.Do("INCRBY", key, strconv.Itoa(granted-n)); err != nil {
+			d.failed(err)
+			return 0, 0, err
+		}
+		count -= int64(n - granted)
+	}
+	return granted, count, nil
+}
+
+// count returns the value of a window's counter.
+func (d *DistributedLimiter) count(key string) (int64, error) {
+	if _, unavailable := d.unavailable(time.Now()); unavailable {
+		return 0, errLimitStoreUnavailable
+	}
+
+	reply, err := d.client.Do("GET", key)
+	if err == nil {
+		err = firstError([]interface{}{reply})
+	}
+	if err != nil {
+		d.failed(err)
+		return 0, err
+	}
+	value, _ := reply.([]byte)
+	if value == nil {
+		return 0, nil
+	}
+	count, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		d.failed(err)
+		return 0, err
+	}
+	return count, nil
+}
+
+// distributedState hands out the requests of the current window's batch.
+type distributedState struct {
+	limiter *DistributedLimiter
+	key     string
+	limit   int
+	period  time.Duration
+	// sliding weighs in the previous window, for the part of it that is
+	// still within period
+	sliding bool
+	window  int64
+	// tokens is the number of requests left in the batch
+	tokens int
+	// count is the counter's value after the last batch was taken
+	count int64
+	// previous is the previous window's count, or -1 until it's read
+	previous int64
+	// fetching is closed once the round trip to the store in progress
+	// is done
+	fetching chan struct{}
+	mux      sync.Mutex
+}
+
+func (s *distributedState) counterKey(window int64) string {
+	return s.key + ":" + strconv.FormatInt(window, 10)
+}
+
+func (s *distributedState) take(now time.Time) rateLimitStatus {
+	window := now.UnixNano() / int64(s.period)
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	var limit int64
+	for {
+		if window > s.window {
+			s.window, s.tokens, s.count, s.previous = window, 0, 0, -1
+		}
+		// Requests a bit late count in the window that already started
+		window = s.window
+		start := time.Unix(0, window*int64(s.period))
+		end := start.Add(s.period)
+		status := rateLimitStatus{limit: s.limit, reset: end.Sub(now), policy: policyItem(s.limit, s.period)}
+
+		if s.sliding && s.previous < 0 {
+			if s.waitFetch() {
+				continue
+			}
+			var previous int64
+			var err error
+			s.fetch(func() { previous, err = s.limiter.count(s.counterKey(window - 1)) })
+			if err != nil {
+				return s.unavailable(status, now)
+			}
+			if s.window == window {
+				s.previous = previous
+			}
+			continue
+		}
+
+		limit = int64(s.limit)
+		if s.sliding {
+			limit -= s.weighted(now.Sub(start))
+		}
+
+		if s.tokens == 0 && s.count < limit {
+			if s.waitFetch() {
+				continue
+			}
+			n := s.limiter.batchSize
+			if n > s.limit {
+				n = s.limit
+			}
+			// The counter outlives its window, so replicas with clocks a
+			// bit apart share it, and sliding windows can read it in the
+			// next one
+			var granted int
+			var count int64
+			var err error
+			s.fetch(func() { granted, count, err = s.limiter.allocate(s.counterKey(window), n, limit, 2*s.period) })
+			if err != nil {
+				return s.unavailable(status, now)
+			}
+			if s.window == window {
+				s.tokens, s.count = granted, count
+			}
+			if granted > 0 {
+				continue
+			}
+		}
+
+		if s.tokens > 0 {
+			s.tokens--
+			status.allowed = true
+		} else {
+			status.retryAfter = s.retryAfter(now, start, end)
+		}
+
+		if unallocated := limit - s.count; unallocated > 0 {
+			status.remaining = int(unallocated)
+		}
+		status.remaining += s.tokens
+		return status
+	}
+}
+
+// fetch runs a round trip to the store without holding the lock, which
+// it must be called with, so requests that don't need the store don't
+// wait for it. Those that do wait for the round trip with waitFetch.
+func (s *distributedState) fetch(f func()) {
+	done := make(chan struct{})
+	s.fetching = done
+	s.mux.Unlock()
+	f()
+	s.mux.Lock()
+	s.fetching = nil
+	close(done)
+}
+
+// waitFetch waits for a round trip to the store another request is
+// making, and reports whether there was one. It must be called with the
+// lock held, which is released meanwhile.
+func (s *distributedState) waitFetch() bool {
+	fetching := s.fetching
+	if fetching == nil {
+		return false
+	}
+	s.mux.Unlock()
+	<-fetching
+	s.mux.Lock()
+	return true
+}
+
+// weighted is the part of the previous window's count that still counts,
+// elapsed into the current window.
+func (s *distributedState) weighted(elapsed time.Duration) int64 {
+	return int64(math.Ceil(float64(s.previous) * (1 - float64(elapsed)/float64(s.period))))
+}
+
+// retryAfter returns how long until another request fits in the limit.
+// With a sliding window, that may be before the window ends, as the
+// previous window's count fades.
+func (s *distributedState) retryAfter(now, start, end time.Time) time.Duration {
+	free := int64(s.limit) - s.count
+	if !s.sliding || s.previous <= 0 || free <= 0 {
+		return end.Sub(now)
+	}
+	elapsed := time.Duration(float64(s.period) * (1 - float64(free-1)/float64(s.previous)))
+	if at := start.Add(elapsed); at.After(now) {
+		return at.Sub(now)
+	}
+	return 0
+}
+
+// unavailable returns the status of a request while the store can't be
+// used.
+func (s *distributedState) unavailable(status rateLimitStatus, now time.Time) rateLimitStatus {
+	if s.limiter.failOpen {
+		status.allowed = true
+		status.remaining = s.limit
+	} else {
+		failedUntil, _ := s.limiter.unavailable(now)
+		status.retryAfter = failedUntil.Sub(now)
+	}
+	return status
+}
+
+func SetupDistributedRateLimiter() {
+	switch viper.GetString("rate_limiting.store") {
+	case "local":
+		return
+	case "redis":
+	default:
+		log.Fatalf("Invalid rate limiting store: %s", viper.GetString("rate_limiting.store"))
+	}
+	// Shared counters can't reserve a turn in a later window
+	if viper.GetBool("rate_limiting.queue.enabled") {
+		log.Fatalf("rate_limiting.queue can't be used with the redis rate limiting store")
+	}
+
+	client := newRESPClient(
+		viper.GetString("rate_limiting.redis.address"),
+		viper.GetString("rate_limiting.redis.password"),
+		viper.GetInt("rate_limiting.redis.db"),
+		viper.GetDuration("rate_limiting.redis.timeout"),
+		viper.GetInt("rate_limiting.redis.pool_size"),
+	)
+	limiter := NewDistributedLimiter(
+		client,
+		viper.GetString("rate_limiting.redis.key_prefix"),
+		viper.GetInt("rate_limiting.redis.batch_size"),
+		viper.GetBool("rate_limiting.redis.fail_open"),
+		viper.GetDuration("rate_limiting.redis.retry_interval"),
+	)
+	SetSharedRateLimits(limiter)
+	log.Printf("Sharing rate limits through Redis at %s", viper.GetString("rate_limiting.redis.address"))
+}
@@ -0,0 +1,267 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func newTestDistributedLimiter(server *fakeRESPServer, batchSize int, failOpen bool) *DistributedLimiter {
+	return NewDistributedLimiter(server.client(), "test:", batchSize, failOpen, time.Minute)
+}
+
+func TestDistributedLimiterShared(t *testing.T) {
+	server := newFakeRESPServer(t)
+	// Two replicas sharing the store
+	replicas := []limitState{
+		newTestDistributedLimiter(server, 3, true).newState("limit", 10, time.Hour),
+		newTestDistributedLimiter(server, 3, true).newState("limit", 10, time.Hour),
+	}
+	now := time.Now().Truncate(time.Hour)
+
+	allowed := 0
+	for i := 0; i < 30; i++ {
+		status := replicas[i%2].take(now)
+		if status.allowed {
+			allowed++
+			continue
+		}
+		if status.retryAfter != time.Hour {
+			t.Errorf("Expected to retry at the end of the window, got %s", status.retryAfter)
+		}
+		if status.remaining != 0 {
+			t.Errorf("Expected nothing to remain, got %d", status.remaining)
+		}
+	}
+	if allowed != 10 {
+		t.Errorf("Expected 10 requests allowed across replicas, got %d", allowed)
+	}
+
+	status := replicas[0].take(now.Add(time.Hour))
+	if !status.allowed {
+		t.Errorf("Expected requests to be allowed in the next window")
+	}
+	if status.policy != "10;w=3600" {
+		t.Errorf("Unexpected policy %q", status.policy)
+	}
+}
+
+func TestDistributedLimiterBatches(t *testing.T) {
+	server := newFakeRESPServer(t)
+	state := newTestDistributedLimiter(server, 5, true).newState("limit", 100, time.Hour)
+	now := time.Now().Truncate(time.Hour)
+	key := "test:limit:" + strconv.FormatInt(now.UnixNano()/int64(time.Hour), 10)
+
+	counter := func() string {
+		server.mux.Lock()
+		defer server.mux.Unlock()
+		if v := server.lookup(key); v != nil {
+			return v.value
+		}
+		return ""
+	}
+
+	for i := 0; i < 5; i++ {
+		status := state.take(now)
+		if !status.allowed {
+			t.Fatalf("Expected request %d to be allowed", i)
+		}
+		if status.remaining != 95+4-i {
+			t.Errorf("Expected %d remaining, got %d", 95+4-i, status.remaining)
+		}
+	}
+	if c := counter(); c != "5" {
+		t.Errorf("Expected a single batch to be taken, counter is %q", c)
+	}
+
+	state.take(now)
+	if c := counter(); c != "10" {
+		t.Errorf("Expected a second batch to be taken, counter is %q", c)
+	}
+
+	server.mux.Lock()
+	ttl := time.Until(server.lookup(key).expireAt)
+	server.mux.Unlock()
+	if ttl <= time.Hour || ttl > 2*time.Hour {
+		t.Errorf("Expected the counter to outlive its window, expires in %s", ttl)
+	}
+}
+
+func TestDistributedSlidingWindow(t *testing.T) {
+	server := newFakeRESPServer(t)
+	replicas := []limitState{
+		newTestDistributedLimiter(server, 1, true).newSlidingState("limit", 10, time.Hour),
+		newTestDistributedLimiter(server, 1, true).newSlidingState("limit", 10, time.Hour),
+	}
+	start := time.Now().Truncate(time.Hour)
+	previous := "test:limit:" + strconv.FormatInt(start.UnixNano()/int64(time.Hour)-1, 10)
+	server.mux.Lock()
+	server.data[previous] = &fakeRESPValue{value: "10"}
+	server.mux.Unlock()
+
+	// Half way through the window, half of the previous one still counts
+	now := start.Add(30 * time.Minute)
+	allowed := 0
+	for i := 0; i < 10; i++ {
+		if replicas[i%2].take(now).allowed {
+			allowed++
+		}
+	}
+	if allowed != 5 {
+		t.Errorf("Expected 5 requests allowed, got %d", allowed)
+	}
+
+	status := replicas[0].take(now)
+	if status.allowed || status.retryAfter != 6*time.Minute {
+		t.Errorf("Expected to retry once the previous window fades enough, got %s", status.retryAfter)
+	}
+	if !replicas[1].take(now.Add(6 * time.Minute)).allowed {
+		t.Errorf("Expected a request to be allowed as the previous window fades")
+	}
+}
+
+func TestDistributedLimiterConcurrent(t *testing.T) {
+	server := newFakeRESPServer(t)
+	state := newTestDistributedLimiter(server, 3, true).newState("limit", 20, time.Hour).(*distributedState)
+	now := time.Now().Truncate(time.Hour)
+
+	// The store is slow, so the first request waits for it
+	server.mux.Lock()
+	results := make(chan bool, 50)
+	go func() { results <- state.take(now).allowed }()
+
+	// Meanwhile the state isn't locked
+	deadline := time.Now().Add(time.Second)
+	for {
+		if state.mux.TryLock() {
+			fetching := state.fetching != nil
+			state.mux.Unlock()
+			if fetching {
+				break
+			}
+		}
+		if time.Now().After(deadline) {
+			server.mux.Unlock()
+			t.Fatalf("Expected the state to be unlocked while the store is used")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	for i := 1; i < 50; i++ {
+		go func() { results <- state.take(now).allowed }()
+	}
+	server.mux.Unlock()
+
+	allowed := 0
+	for i := 0; i < 50; i++ {
+		if <-results {
+			allowed++
+		}
+	}
+	if allowed != 20 {
+		t.Errorf("Expected 20 requests allowed, got %d", allowed)
+	}
+}
+
+func TestDistributedLimiterUnavailable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error reserving an address: %s", err)
+	}
+	address := listener.Addr().String()
+	listener.Close()
+
+	for _, failOpen := range []bool{true, false} {
+		limiter := NewDistributedLimiter(newRESPClient(address, "", 0, time.Second, 1), "test:", 10, failOpen, time.Minute)
+		state := limiter.newState("limit", 10, time.Hour)
+
+		for i := 0; i < 2; i++ {
+			status := state.take(time.Now())
+			if status.allowed != failOpen {
+				t.Errorf("Expected allowed to be %t with fail open %t", failOpen, failOpen)
+			}
+			if !failOpen && (status.retryAfter <= 0 || status.retryAfter > time.Minute+time.Second) {
+				t.Errorf("Expected to retry once the store is tried again, got %s", status.retryAfter)
+			}
+		}
+		if _, unavailable := limiter.unavailable(time.Now()); !unavailable {
+			t.Errorf("Expected the store to be skipped after a failure")
+		}
+	}
+}
+
+func TestDistributedRateLimitPolicies(t *testing.T) {
+	server := newFakeRESPServer(t)
+	var replicas []*RateLimitPolicies
+	for i := 0; i < 2; i++ {
+		config := RateLimitPolicyConfig{
+			Policies: []*RateLimitPolicy{{Name: "per-ip", Algorithm: "token_bucket", Limit: 2, Period: time.Hour, Key: "ip"}},
+			Global:   "per-ip",
+		}
+		policies, err := NewRateLimitPolicies(config, newTestDistributedLimiter(server, 1, true))
+		if err != nil {
+			t.Fatalf("Failed to create rate limit policies: %s", err)
+		}
+		replicas = append(replicas, policies)
+	}
+
+	rejected := 0
+	for i := 0; i < 4; i++ {
+		if policy, _ := replicas[i%2].Check(requestFrom("10.0.0.1:1234", "/")); policy != nil {
+			rejected++
+		}
+	}
+	if rejected != 2 {
+		t.Errorf("Expected 2 of 4 requests rejected across replicas, got %d", rejected)
+	}
+
+	if policy, _ := replicas[0].Check(requestFrom("10.0.0.2:1234", "/")); policy != nil {
+		t.Errorf("Expected other clients to have their own limit")
+	}
+}
+
+func TestDistributedBackendRateLimit(t *testing.T) {
+	server := newFakeRESPServer(t)
+	viper.Set("rate_limiting.rate", 1)
+	viper.Set("rate_limiting.bucket_size", 2)
+	t.Cleanup(func() {
+		viper.Set("rate_limiting.rate", 10.0)
+		viper.Set("rate_limiting.bucket_size", 5)
+		SetSharedRateLimits(nil)
+	})
+
+	serverURL, _ := url.Parse("http://backend.test")
+	var backends []*Backend
+	for i := 0; i < 2; i++ {
+		SetSharedRateLimits(newTestDistributedLimiter(server, 1, true))
+		backends = append(backends, CreateNewBackend(serverURL, &ServerPool{}))
+	}
+
+	// A bucket of 2 at 1 per second is shared as 2 requests per 2 seconds
+	now := time.Now().Truncate(2 * time.Second)
+	for i, expected := range []bool{true, true, false, false} {
+		status := backends[i%2].sharedLimit.take(now)
+		if status.allowed != expected {
+			t.Errorf("Expected request %d allowed to be %t", i, expected)
+		}
+		if status.policy != "2;w=2" {
+			t.Errorf("Unexpected policy %q", status.policy)
+		}
+	}
+
+	handler := RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), backends[0])
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK && rec.Code != http.StatusTooManyRequests {
+		t.Errorf("Unexpected status %d", rec.Code)
+	}
+	if rec.Header().Get("RateLimit-Policy") != "2;w=2" {
+		t.Errorf("Expected the shared policy to be reported, got %q", rec.Header().Get("RateLimit-Policy"))
+	}
+}
@@ -0,0 +1,256 @@
+package loadbalancer
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/oschwald/maxminddb-golang"
+	"github.com/spf13/viper"
+)
+
+type GeoLocation struct {
+	Country string
+	Region  string
+}
+
+type GeoDB interface {
+	Lookup(ip net.IP) (GeoLocation, bool)
+}
+
+type csvGeoEntry struct {
+	network  *net.IPNet
+	location GeoLocation
+}
+
+// csvGeoDB is a GeoIP database loaded from a CSV file with
+// network,country,region rows, e.g. 81.2.69.0/24,GB,eu.
+type csvGeoDB struct {
+	entries []csvGeoEntry
+}
+
+func loadCSVGeoDB(path string) (*csvGeoDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	reader := csv.NewReader(f)
+	reader.Comment = '#'
+	reader.FieldsPerRecord = -1
+
+	db := &csvGeoDB{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(record) < 2 {
+			return nil, fmt.Errorf("%s:%d: expected network,country[,region]", path, line)
+		}
+
+		_, network, err := net.ParseCIDR(strings.TrimSpace(record[0]))
+		if err != nil {
+			// Allow a header row
+			if line == 1 {
+				continue
+			}
+			return nil, fmt.Errorf("%s:%d: %w", path, line, err)
+		}
+
+		location := GeoLocation{Country: strings.ToUpper(strings.TrimSpace(record[1]))}
+		if len(record) > 2 {
+			location.Region = strings.ToLower(strings.TrimSpace(record[2]))
+		}
+		db.entries = append(db.entries, csvGeoEntry{network: network, location: location})
+	}
+
+	// Most specific networks first, so the first match wins
+	sort.SliceStable(db.entries, func(i, j int) bool {
+		iOnes, _ := db.entries[i].network.Mask.Size()
+		jOnes, _ := db.entries[j].network.Mask.Size()
+		return iOnes > jOnes
+	})
+	return db, nil
+}
+
+func (db *csvGeoDB) Lookup(ip net.IP) (GeoLocation, bool) {
+	for _, entry := range db.entries {
+		if entry.network.Contains(ip) {
+			return entry.location, true
+		}
+	}
+	return GeoLocation{}, false
+}
+
+// mmdbGeoDB reads MaxMind-format databases such as GeoLite2-Country.
+// The continent code is used as the region.
+type mmdbGeoDB struct {
+	reader *maxminddb.Reader
+}
+
+func (db *mmdbGeoDB) Lookup(ip net.IP) (GeoLocation, bool) {
+	var record struct {
+		Country struct {
+			ISOCode string `maxminddb:"iso_code"`
+		} `maxminddb:"country"`
+		Continent struct {
+			Code string `maxminddb:"code"`
+		} `maxminddb:"continent"`
+	}
+
+	if err := db.reader.Lookup(ip, &record); err != nil || record.Country.ISOCode == "" {
+		return GeoLocation{}, false
+	}
+	return GeoLocation{
+		Country: strings.ToUpper(record.Country.ISOCode),
+		Region:  strings.ToLower(record.Continent.Code),
+	}, true
+}
+
+// OpenGeoDB opens a .mmdb or .csv GeoIP database.
+func OpenGeoDB(path string) (GeoDB, error) {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mmdb":
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		return &mmdbGeoDB{reader: reader}, nil
+	case ".csv":
+		return loadCSVGeoDB(path)
+	}
+	return nil, fmt.Errorf("unsupported GeoIP database format: %s", path)
+}
+
+// GeoRouter resolves the client's region so the server pool can prefer
+// backends in it, and enforces the country allow and deny lists.
+type GeoRouter struct {
+	db             GeoDB
+	countryRegions map[string]string
+	fallback       map[string][]string
+	allow          map[string]bool
+	deny           map[string]bool
+}
+
+func NewGeoRouter(db GeoDB, countryRegions map[string]string, fallback map[string][]string, allow, deny []string) *GeoRouter {
+	g := &GeoRouter{
+		db:             db,
+		countryRegions: make(map[string]string),
+		fallback:       make(map[string][]string),
+		allow:          make(map[string]bool),
+		deny:           make(map[string]bool),
+	}
+	for country, region := range countryRegions {
+		g.countryRegions[strings.ToUpper(country)] = strings.ToLower(region)
+	}
+	for region, regions := range fallback {
+		for _, r := range regions {
+			g.fallback[strings.ToLower(region)] = append(g.fallback[strings.ToLower(region)], strings.ToLower(r))
+		}
+	}
+	for _, country := range allow {
+		g.allow[strings.ToUpper(country)] = true
+	}
+	for _, country := range deny {
+		g.deny[strings.ToUpper(country)] = true
+	}
+	return g
+}
+
+func (g *GeoRouter) Locate(r *http.Request) (GeoLocation, bool) {
+	ip := clientIP(r)
+	if ip == nil {
+		return GeoLocation{}, false
+	}
+
+	location, found := g.db.Lookup(ip)
+	if !found {
+		return GeoLocation{}, false
+	}
+	if region, ok := g.countryRegions[location.Country]; ok {
+		location.Region = region
+	}
+	return location, true
+}
+
+// Allowed checks the country against the allow and deny lists. Clients
+// of unknown origin are only rejected when an allow list is configured.
+func (g *GeoRouter) Allowed(location GeoLocation, found bool) bool {
+	if !found {
+		return len(g.allow) == 0
+	}
+	if g.deny[location.Country] {
+		return false
+	}
+	return len(g.allow) == 0 || g.allow[location.Country]
+}
+
+// Regions returns the client's region followed by its fallback regions.
+func (g *GeoRouter) Regions(region string) []string {
+	if region == "" {
+		return nil
+	}
+	return append([]string{region}, g.fallback[region]...)
+}
+
+func GetRegionsFromContext(r *http.Request) []string {
+	if regions, ok := r.Context().Value(RegionsKey).([]string); ok {
+		return regions
+	}
+	return nil
+}
+
+func GeoMiddleware(g *GeoRouter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if g == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		location, found := g.Locate(r)
+		if !g.Allowed(location, found) {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+
+		if regions := g.Regions(location.Region); len(regions) > 0 {
+			r = r.WithContext(context.WithValue(r.Context(), RegionsKey, regions))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetupGeoRouter returns nil when geo routing is disabled.
+func SetupGeoRouter() *GeoRouter {
+	if !viper.GetBool("use_geo_routing") {
+		return nil
+	}
+
+	path := viper.GetString("geo_routing.database")
+	db, err := OpenGeoDB(path)
+	if err != nil {
+		log.Fatalf("Error opening GeoIP database: %s", err)
+	}
+
+	log.Printf("Geo routing enabled with database %s", path)
+	return NewGeoRouter(
+		db,
+		viper.GetStringMapString("geo_routing.country_regions"),
+		viper.GetStringMapStringSlice("geo_routing.fallback"),
+		viper.GetStringSlice("geo_routing.allow_countries"),
+		viper.GetStringSlice("geo_routing.deny_countries"),
+	)
+}
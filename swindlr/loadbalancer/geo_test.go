@@ -0,0 +1,146 @@
+package loadbalancer
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestCSVGeoDB(t *testing.T) {
+	db, err := OpenGeoDB("testdata/geoip.csv")
+	if err != nil {
+		t.Fatalf("Failed to open GeoIP database: %v", err)
+	}
+
+	tests := []struct {
+		ip       string
+		country  string
+		region   string
+		expected bool
+	}{
+		{"192.0.2.10", "DE", "eu", true},
+		{"198.51.100.10", "US", "us", true},
+		{"198.51.100.200", "CA", "us", true},
+		{"2001:db8::1", "FR", "eu", true},
+		{"10.0.0.1", "", "", false},
+	}
+
+	for _, tt := range tests {
+		location, found := db.Lookup(net.ParseIP(tt.ip))
+		if found != tt.expected || location.Country != tt.country || location.Region != tt.region {
+			t.Errorf("Lookup(%s) = %+v, %t, expected %s/%s, %t", tt.ip, location, found, tt.country, tt.region, tt.expected)
+		}
+	}
+}
+
+func TestMMDBGeoDB(t *testing.T) {
+	// Generated by testdata/gen_geoip_mmdb.go
+	db, err := OpenGeoDB("testdata/geoip.mmdb")
+	if err != nil {
+		t.Fatalf("Failed to open GeoIP database: %v", err)
+	}
+	if _, ok := db.(*mmdbGeoDB); !ok {
+		t.Fatalf("Expected a MaxMind database, got %T", db)
+	}
+
+	tests := []struct {
+		ip       string
+		country  string
+		region   string
+		expected bool
+	}{
+		{"192.0.2.10", "DE", "eu", true},
+		{"198.51.100.10", "US", "na", true},
+		{"198.51.100.200", "CA", "na", true},
+		{"::ffff:203.0.113.10", "KP", "as", true},
+		{"2001:db8::1", "FR", "eu", true},
+		{"10.0.0.1", "", "", false},
+		{"2001:db9::1", "", "", false},
+	}
+
+	for _, tt := range tests {
+		location, found := db.Lookup(net.ParseIP(tt.ip))
+		if found != tt.expected || location.Country != tt.country || location.Region != tt.region {
+			t.Errorf("Lookup(%s) = %+v, %t, expected %s/%s, %t", tt.ip, location, found, tt.country, tt.region, tt.expected)
+		}
+	}
+
+	// country_regions overrides the continent
+	geo := NewGeoRouter(db, map[string]string{"ca": "us"}, nil, nil, nil)
+	req := httptest.NewRequest("GET", "http://swindlr.test/", nil)
+	req.RemoteAddr = "198.51.100.200:1234"
+	if location, found := geo.Locate(req); !found || location.Region != "us" {
+		t.Errorf("Expected CA to be located in region us, got %+v, %t", location, found)
+	}
+}
+
+func TestGeoMiddleware(t *testing.T) {
+	viper.Set("use_sticky_sessions", false)
+
+	db, err := OpenGeoDB("testdata/geoip.csv")
+	if err != nil {
+		t.Fatalf("Failed to open GeoIP database: %v", err)
+	}
+	geo := NewGeoRouter(db, map[string]string{"ca": "eu"}, map[string][]string{"eu": {"us"}}, nil, []string{"kp"})
+
+	eu := &Backend{URL: parseURL("http://eu.test"), Alive: true, Region: "eu"}
+	us := &Backend{URL: parseURL("http://us.test"), Alive: true, Region: "us"}
+	sp := NewServerPool(&RoundRobin{})
+	sp.AddBackend(eu)
+	sp.AddBackend(us)
+
+	var selected *Backend
+	handler := GeoMiddleware(geo, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		selected = sp.GetNextPeer(r)
+	}))
+
+	request := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "http://swindlr.test/", nil)
+		req.RemoteAddr = remoteAddr
+		rr := httptest.NewRecorder()
+		selected = nil
+		handler.ServeHTTP(rr, req)
+		return rr
+	}
+
+	for i := 0; i < 3; i++ {
+		request("198.51.100.10:1234")
+		if selected != us {
+			t.Errorf("Expected the us backend for a US client")
+		}
+		// Country mapping overrides the region from the database
+		request("198.51.100.200:1234")
+		if selected != eu {
+			t.Errorf("Expected the eu backend for a CA client")
+		}
+	}
+
+	// The eu region has no healthy backends, fall back to us
+	eu.setAlive(false)
+	request("192.0.2.10:1234")
+	if selected != us {
+		t.Errorf("Expected a fallback to the us backend")
+	}
+
+	if rr := request("203.0.113.5:1234"); rr.Code != http.StatusForbidden {
+		t.Errorf("Expected status %d for a denied country, got %d", http.StatusForbidden, rr.Code)
+	}
+}
+
+func TestGeoAllowList(t *testing.T) {
+	db, _ := OpenGeoDB("testdata/geoip.csv")
+	geo := NewGeoRouter(db, nil, nil, []string{"de"}, nil)
+
+	if !geo.Allowed(GeoLocation{Country: "DE"}, true) {
+		t.Error("Expected DE to be allowed")
+	}
+	if geo.Allowed(GeoLocation{Country: "US"}, true) {
+		t.Error("Expected US to be rejected by the allow list")
+	}
+	if geo.Allowed(GeoLocation{}, false) {
+		t.Error("Expected unknown clients to be rejected when an allow list is set")
+	}
+}
@@ -0,0 +1,195 @@
+package loadbalancer
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"math/big"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+// jwtVerifier verifies the bearer tokens clients are identified by. Without
+// it, tokens aren't trusted and clients are identified by IP.
+var jwtVerifier *JWTVerifier
+
+func SetJWTVerifier(verifier *JWTVerifier) {
+	jwtVerifier = verifier
+}
+
+// JWTVerifier checks the signature of tokens, with a shared secret for the
+// HS algorithms or a public key for the RS and ES ones, and that they are
+// within their validity period.
+type JWTVerifier struct {
+	secret    []byte
+	publicKey crypto.PublicKey
+	// leeway is the clock skew allowed when checking exp and nbf
+	leeway time.Duration
+}
+
+// NewJWTVerifier creates a verifier from a secret, a PEM encoded public
+// key, or both.
+func NewJWTVerifier(secret string, publicKeyPEM []byte, leeway time.Duration) (*JWTVerifier, error) {
+	v := &JWTVerifier{secret: []byte(secret), leeway: leeway}
+	if len(publicKeyPEM) > 0 {
+		block, _ := pem.Decode(publicKeyPEM)
+		if block == nil {
+			return nil, errors.New("no PEM block in JWT public key")
+		}
+		key, err := x509.ParsePKIXPublicKey(block.Bytes)
+		if err != nil {
+			return nil, fmt.Errorf("invalid JWT public key: %w", err)
+		}
+		switch key.(type) {
+		case *rsa.PublicKey, *ecdsa.PublicKey:
+		default:
+			return nil, fmt.Errorf("unsupported JWT public key type %T", key)
+		}
+		v.publicKey = key
+	}
+	if len(v.secret) == 0 && v.publicKey == nil {
+		return nil, errors.New("JWT verification needs a secret or a public key")
+	}
+	return v, nil
+}
+
+func jwtHash(alg string) (crypto.Hash, func() hash.Hash, bool) {
+	switch alg[2:] {
+	case "256":
+		return crypto.SHA256, sha256.New, true
+	case "384":
+		return crypto.SHA384, sha512.New384, true
+	case "512":
+		return crypto.SHA512, sha512.New, true
+	}
+	return 0, nil, false
+}
+
+// verifySignature checks the signature of the token's signing input with
+// the algorithm from its header.
+func (v *JWTVerifier) verifySignature(alg string, input, signature []byte) error {
+	if len(alg) != 5 {
+		return fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+	hashID, newHash, ok := jwtHash(alg)
+	if !ok {
+		return fmt.Errorf("unsupported JWT algorithm %q", alg)
+	}
+
+	switch alg[:2] {
+	case "HS":
+		if len(v.secret) == 0 {
+			return errors.New("no JWT secret")
+		}
+		mac := hmac.New(newHash, v.secret)
+		mac.Write(input)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	case "RS":
+		key, ok := v.publicKey.(*rsa.PublicKey)
+		if !ok {
+			return errors.New("no RSA public key")
+		}
+		h := newHash()
+		h.Write(input)
+		return rsa.VerifyPKCS1v15(key, hashID, h.Sum(nil), signature)
+	case "ES":
+		key, ok := v.publicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return errors.New("no ECDSA public key")
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return errors.New("invalid JWT signature")
+		}
+		h := newHash()
+		h.Write(input)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, h.Sum(nil), r, s) {
+			return errors.New("invalid JWT signature")
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported JWT algorithm %q", alg)
+}
+
+// Subject returns the sub claim of a token with a valid signature, within
+// its validity period at now.
+func (v *JWTVerifier) Subject(token string, now time.Time) (string, error) {
+	parts := strings.Split(strings.TrimSpace(token), ".")
+	if len(parts) != 3 {
+		return "", errors.New("malformed JWT")
+	}
+	decoded := make([][]byte, 3)
+	for i, part := range parts {
+		var err error
+		if decoded[i], err = base64.RawURLEncoding.DecodeString(strings.TrimRight(part, "=")); err != nil {
+			return "", fmt.Errorf("malformed JWT: %w", err)
+		}
+	}
+
+	var header struct {
+		Algorithm string `json:"alg"`
+	}
+	if err := json.Unmarshal(decoded[0], &header); err != nil {
+		return "", fmt.Errorf("malformed JWT header: %w", err)
+	}
+	if err := v.verifySignature(header.Algorithm, []byte(parts[0]+"."+parts[1]), decoded[2]); err != nil {
+		return "", err
+	}
+
+	var claims struct {
+		Subject   string   `json:"sub"`
+		Expires   *float64 `json:"exp"`
+		NotBefore *float64 `json:"nbf"`
+	}
+	if err := json.Unmarshal(decoded[1], &claims); err != nil {
+		return "", fmt.Errorf("malformed JWT claims: %w", err)
+	}
+	if claims.Expires != nil && now.Add(-v.leeway).After(time.Unix(int64(*claims.Expires), 0)) {
+		return "", errors.New("expired JWT")
+	}
+	if claims.NotBefore != nil && now.Add(v.leeway).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return "", errors.New("JWT not valid yet")
+	}
+	return claims.Subject, nil
+}
+
+// SetupJWTVerifier enables verifying bearer tokens if a secret or public
+// key is configured.
+func SetupJWTVerifier() {
+	secret := viper.GetString("jwt.secret")
+	var publicKey []byte
+	if path := viper.GetString("jwt.public_key_file"); path != "" {
+		var err error
+		if publicKey, err = os.ReadFile(path); err != nil {
+			log.Fatalf("Error reading JWT public key: %s", err)
+		}
+	}
+	if secret == "" && publicKey == nil {
+		return
+	}
+
+	verifier, err := NewJWTVerifier(secret, publicKey, viper.GetDuration("jwt.leeway"))
+	if err != nil {
+		log.Fatalf("Error setting up JWT verification: %s", err)
+	}
+	SetJWTVerifier(verifier)
+}
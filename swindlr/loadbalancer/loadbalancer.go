@@ -25,6 +25,10 @@ type contextKey int
 const (
 	AttemptsKey contextKey = iota
 	RetryKey
+	TagsKey
+	RegionsKey
+	PoolKey
+	RateLimitKey
 )
 
 var HealthUpdates = make(chan HealthStatus)
@@ -57,7 +61,7 @@ func CreateReverseProxy(serverURL *url.URL, sp *ServerPool) *httputil.ReversePro
 		}
 
 		sp.MarkBackendStatus(serverURL, false)
-		http.Error(writer, "Service not available", http.StatusServiceUnavailable)
+		unavailable(writer)
 	}
 	return proxy
 }
@@ -82,27 +86,68 @@ func LB(w http.ResponseWriter, r *http.Request, sp *ServerPool, cache *Cache) {
 		}
 	}
 
+	// The cache wraps peer selection, so it can serve stale content when
+	// no backend is available
+	cacheProxy := CacheMiddleware(cache, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		proxy(w, r, sp)
+	}))
+	cacheProxy.ServeHTTP(w, r)
+}
+
+func proxy(w http.ResponseWriter, r *http.Request, sp *ServerPool) {
 	attempts := GetAttemptsFromContext(r)
 	if attempts > 3 {
 		log.Printf("%s(%s) Max attempts reached, terminating\n", r.RemoteAddr, r.URL.Path)
-		http.Error(w, "Service not available", http.StatusServiceUnavailable)
+		unavailable(w)
 		return
 	}
 
-	peer := sp.GetNextPeer(r)
-
+	peer, err := sp.AcquirePeer(r)
+	if !acquired(w, r, err) {
+		return
+	}
 	if peer == nil {
-		http.Error(w, "Service not available", http.StatusServiceUnavailable)
+		unavailable(w)
 		return
 	}
 
-	peer.IncrementConnections()
-	defer peer.DecrementConnections()
+	r, turn, ok := peer.admit(w, r)
+	if !ok {
+		sp.ReleasePeer(peer)
+		return
+	}
+	// Requests queued under the backend's rate limit don't hold one of
+	// its connection slots while they wait
+	if turn != nil {
+		sp.ReleasePeer(peer)
+		if !turn.wait(r) || !acquired(w, r, sp.AcquireBackend(r, peer)) {
+			return
+		}
+	}
+	defer sp.ReleasePeer(peer)
 
-	// Proxy chain
-	rateLimitedProxy := RateLimitMiddleware(peer.ReverseProxy, peer)
-	cacheProxy := CacheMiddleware(cache, rateLimitedProxy)
-	cacheProxy.ServeHTTP(w, r)
+	AdaptiveConcurrencyMiddleware(peer.Adaptive, peer.ReverseProxy).ServeHTTP(w, r)
+}
+
+// acquired handles the error of taking a connection slot, and reports
+// whether the request can go on.
+func acquired(w http.ResponseWriter, r *http.Request, err error) bool {
+	if err == errPoolSaturated {
+		DefaultMetrics.IncCounter("swindlr_connections_rejected_total", Labels{"pool": GetPoolFromContext(r)})
+		setRetryAfter(w, viper.GetDuration("connection_queue.retry_after"))
+		unavailable(w)
+		return false
+	}
+	// Otherwise the client is gone
+	return err == nil
+}
+
+// unavailable tells the client no backend could take the request. The
+// response is generated by swindlr and says nothing about the resource,
+// so it must not be cached.
+func unavailable(w http.ResponseWriter) {
+	w.Header().Set("Cache-Control", "no-store")
+	http.Error(w, "Service not available", http.StatusServiceUnavailable)
 }
 
 func BackendStatus(u *url.URL) (bool, time.Duration) {
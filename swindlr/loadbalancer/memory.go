@@ -0,0 +1,262 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// cacheEntry holds the variants of a response stored under one primary
+// key, selected by the request headers listed in the response's Vary.
+type cacheEntry struct {
+	key      string
+	path     string
+	vary     []string
+	variants map[string]CacheItem
+	size     int64
+}
+
+// MemoryStore is an in-memory CacheStore bounded by size and number of
+// entries. When a limit is exceeded, the least recently used entries are
+// evicted. An optional disk tier keeps responses that don't fit in memory.
+type MemoryStore struct {
+	items      map[string]*list.Element
+	lru        *list.List
+	mux        sync.Mutex
+	maxBytes   int64
+	maxEntries int
+	stats      CacheStats
+	bans       []cacheBan
+	disk       *DiskTier
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		items: make(map[string]*list.Element),
+		lru:   list.New(),
+	}
+}
+
+// SetLimits bounds the store. A limit of zero disables it.
+func (m *MemoryStore) SetLimits(maxBytes int64, maxEntries int) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.maxBytes = maxBytes
+	m.maxEntries = maxEntries
+	m.evict()
+}
+
+// SetDiskTier adds a second tier behind the memory. All stored responses
+// are written to it, and those read from it often enough are promoted
+// back into memory.
+func (m *MemoryStore) SetDiskTier(disk *DiskTier) {
+	m.disk = disk
+}
+
+// Get returns the variant matching the request. The disk tier is only
+// consulted on a memory miss.
+func (m *MemoryStore) Get(key string, r *http.Request) (CacheItem, bool) {
+	if item, found := m.lookupMemory(key, r); found || m.disk == nil {
+		return item, found
+	}
+	// The lookup may have removed a banned response
+	m.disk.unlinkRemoved()
+
+	item, hot, found := m.disk.Get(key, r)
+	if !found {
+		return CacheItem{}, false
+	}
+
+	m.mux.Lock()
+	banned := m.banned(&cacheEntry{key: key, path: r.URL.Path}, item)
+	m.mux.Unlock()
+	if banned {
+		vary, _ := varyHeaders(item.Header)
+		m.disk.Delete(key, varyKey(r, vary))
+		m.disk.unlinkRemoved()
+		DefaultMetrics.IncCounter("swindlr_cache_purged_total", Labels{"mode": "ban"})
+		return CacheItem{}, false
+	}
+
+	DefaultMetrics.IncCounter("swindlr_cache_disk_hits_total", nil)
+	if hot {
+		vary, _ := varyHeaders(item.Header)
+		m.store(key, r, item, vary)
+	}
+	return item, true
+}
+
+func (m *MemoryStore) lookupMemory(key string, r *http.Request) (CacheItem, bool) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	element, found := m.items[key]
+	if !found {
+		return CacheItem{}, false
+	}
+	entry := element.Value.(*cacheEntry)
+	variant := varyKey(r, entry.vary)
+	item, found := entry.variants[variant]
+	if !found {
+		return CacheItem{}, false
+	}
+	if m.banned(entry, item) {
+		delete(entry.variants, variant)
+		entry.size -= item.size()
+		m.stats.Bytes -= item.size()
+		if len(entry.variants) == 0 {
+			m.removeElement(element)
+		}
+		if m.disk != nil {
+			m.disk.Delete(key, variant)
+		}
+		DefaultMetrics.IncCounter("swindlr_cache_purged_total", Labels{"mode": "ban"})
+		m.publishStats()
+		return CacheItem{}, false
+	}
+	m.lru.MoveToFront(element)
+	return item, true
+}
+
+// Set stores the item as the variant for the request. If the response
+// varies on a different set of headers than the stored variants, they
+// are replaced. The item is removed by the janitor after ttl, or kept
+// until evicted if ttl isn't positive.
+func (m *MemoryStore) Set(key string, r *http.Request, item CacheItem, ttl time.Duration) {
+	vary, wildcard := varyHeaders(item.Header)
+	if wildcard {
+		return
+	}
+
+	if ttl > 0 {
+		item.StoredUntil = time.Now().Add(ttl)
+	}
+	m.store(key, r, item, vary)
+	if m.disk != nil {
+		m.disk.Put(key, r.URL.Path, vary, varyKey(r, vary), item)
+	}
+}
+
+// store puts the item in the memory tier.
+func (m *MemoryStore) store(key string, r *http.Request, item CacheItem, vary []string) {
+	size := item.size()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	var entry *cacheEntry
+	if element, found := m.items[key]; found {
+		entry = element.Value.(*cacheEntry)
+		m.lru.MoveToFront(element)
+	} else {
+		entry = &cacheEntry{key: key, path: r.URL.Path, variants: make(map[string]CacheItem)}
+		m.items[key] = m.lru.PushFront(entry)
+	}
+
+	if !equalStrings(entry.vary, vary) {
+		m.stats.Bytes -= entry.size
+		entry.vary = vary
+		entry.variants = make(map[string]CacheItem)
+		entry.size = 0
+	}
+
+	variant := varyKey(r, vary)
+	if previous, found := entry.variants[variant]; found {
+		entry.size -= previous.size()
+		m.stats.Bytes -= previous.size()
+	}
+	entry.variants[variant] = item
+	entry.size += size
+	m.stats.Bytes += size
+
+	m.evict()
+	m.publishStats()
+}
+
+// Delete removes all variants stored under the key.
+func (m *MemoryStore) Delete(key string) {
+	defer m.unlinkRemoved()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	if element, found := m.items[key]; found {
+		m.removeElement(element)
+		m.publishStats()
+	}
+	if m.disk != nil {
+		m.disk.Remove(func(entry *cacheEntry, _ CacheItem) bool { return entry.key == key })
+	}
+}
+
+// evict drops the least recently used entries until the store is within
+// its limits. It must be called with the lock held.
+func (m *MemoryStore) evict() {
+	for m.lru.Len() > 0 && ((m.maxBytes > 0 && m.stats.Bytes > m.maxBytes) || (m.maxEntries > 0 && m.lru.Len() > m.maxEntries)) {
+		m.removeElement(m.lru.Back())
+		m.stats.Evictions++
+		DefaultMetrics.IncCounter("swindlr_cache_evictions_total", nil)
+	}
+}
+
+func (m *MemoryStore) removeElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	m.lru.Remove(element)
+	delete(m.items, entry.key)
+	m.stats.Bytes -= entry.size
+}
+
+// unlinkRemoved deletes the disk bodies of removed responses. It's
+// deferred before taking the lock, so the filesystem work happens once
+// it's released and lookups don't wait for it.
+func (m *MemoryStore) unlinkRemoved() {
+	if m.disk != nil {
+		m.disk.unlinkRemoved()
+	}
+}
+
+func (m *MemoryStore) publishStats() {
+	DefaultMetrics.SetGauge("swindlr_cache_entries", nil, float64(m.lru.Len()))
+	DefaultMetrics.SetGauge("swindlr_cache_bytes", nil, float64(m.stats.Bytes))
+}
+
+func (m *MemoryStore) Stats() CacheStats {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	stats := m.stats
+	stats.Entries = m.lru.Len()
+	if m.disk != nil {
+		stats.DiskEntries, stats.DiskBytes = m.disk.Stats()
+	}
+	return stats
+}
+
+func (m *MemoryStore) DeleteExpired() {
+	defer m.unlinkRemoved()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.applyBans()
+
+	now := time.Now()
+	expired := func(_ *cacheEntry, item CacheItem) bool {
+		return !item.StoredUntil.IsZero() && now.After(item.StoredUntil)
+	}
+	for _, element := range m.items {
+		m.stats.Expired += uint64(m.removeVariants(element, expired))
+	}
+	if m.disk != nil {
+		m.disk.Remove(expired)
+	}
+	m.publishStats()
+}
+
+// StartJanitor removes expired items every interval until stop is closed.
+func (m *MemoryStore) StartJanitor(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			m.DeleteExpired()
+		case <-stop:
+			return
+		}
+	}
+}
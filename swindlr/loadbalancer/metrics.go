@@ -0,0 +1,130 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type Labels map[string]string
+
+type summary struct {
+	count uint64
+	sum   float64
+}
+
+// Metrics is a small in-process registry of counters, gauges and summaries
+// which can be rendered in the Prometheus text format.
+type Metrics struct {
+	counters  map[string]float64
+	gauges    map[string]float64
+	summaries map[string]*summary
+	mux       sync.Mutex
+}
+
+var DefaultMetrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		counters:  make(map[string]float64),
+		gauges:    make(map[string]float64),
+		summaries: make(map[string]*summary),
+	}
+}
+
+func (m *Metrics) IncCounter(name string, labels Labels) {
+	m.AddCounter(name, labels, 1)
+}
+
+func (m *Metrics) AddCounter(name string, labels Labels, value float64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.counters[seriesName(name, labels)] += value
+}
+
+func (m *Metrics) SetGauge(name string, labels Labels, value float64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.gauges[seriesName(name, labels)] = value
+}
+
+func (m *Metrics) Observe(name string, labels Labels, value float64) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	series := seriesName(name, labels)
+	s, ok := m.summaries[series]
+	if !ok {
+		s = &summary{}
+		m.summaries[series] = s
+	}
+	s.count++
+	s.sum += value
+}
+
+func (m *Metrics) Counter(name string, labels Labels) float64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.counters[seriesName(name, labels)]
+}
+
+func (m *Metrics) Gauge(name string, labels Labels) float64 {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	return m.gauges[seriesName(name, labels)]
+}
+
+func (m *Metrics) WritePrometheus(w io.Writer) {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	for _, series := range sortedKeys(m.counters) {
+		fmt.Fprintf(w, "%s %g\n", series, m.counters[series])
+	}
+	for _, series := range sortedKeys(m.gauges) {
+		fmt.Fprintf(w, "%s %g\n", series, m.gauges[series])
+	}
+
+	summaries := make([]string, 0, len(m.summaries))
+	for series := range m.summaries {
+		summaries = append(summaries, series)
+	}
+	sort.Strings(summaries)
+	for _, series := range summaries {
+		s := m.summaries[series]
+		name, labels := series, ""
+		if i := strings.Index(series, "{"); i >= 0 {
+			name, labels = series[:i], series[i:]
+		}
+		fmt.Fprintf(w, "%s_count%s %d\n", name, labels, s.count)
+		fmt.Fprintf(w, "%s_sum%s %g\n", name, labels, s.sum)
+	}
+}
+
+func seriesName(name string, labels Labels) string {
+	if len(labels) == 0 {
+		return name
+	}
+
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", k, labels[k]))
+	}
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
+
+func sortedKeys(values map[string]float64) []string {
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,168 @@
+package loadbalancer
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+type mirroredRequest struct {
+	request *http.Request
+	body    []byte
+}
+
+// Mirror copies a sample of the incoming requests to a shadow pool. Shadow
+// requests are sent from a bounded queue by background workers and their
+// responses are discarded, so a slow or failing shadow pool never affects
+// the primary response.
+type Mirror struct {
+	pool       *ServerPool
+	sampleRate float64
+	maxBody    int64
+	client     *http.Client
+	queue      chan mirroredRequest
+	rand       *rand.Rand
+	randMux    sync.Mutex
+}
+
+func NewMirror(pool *ServerPool, sampleRate float64, maxBody int64, timeout time.Duration, workers, queueSize int) *Mirror {
+	m := &Mirror{
+		pool:       pool,
+		sampleRate: sampleRate,
+		maxBody:    maxBody,
+		client: &http.Client{
+			Timeout:   timeout,
+			Transport: http.DefaultTransport.(*http.Transport).Clone(),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		queue: make(chan mirroredRequest, queueSize),
+		rand:  rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	for i := 0; i < workers; i++ {
+		go m.worker()
+	}
+	return m
+}
+
+func (m *Mirror) sampled() bool {
+	m.randMux.Lock()
+	defer m.randMux.Unlock()
+	return m.rand.Float64() < m.sampleRate
+}
+
+// Enqueue buffers the request body and schedules a copy of the request for
+// the shadow pool. The original body is restored so the primary request is
+// unaffected. Requests with bodies larger than the limit are not mirrored.
+func (m *Mirror) Enqueue(r *http.Request) {
+	var body []byte
+	if r.Body != nil && r.Body != http.NoBody {
+		buf, err := io.ReadAll(io.LimitReader(r.Body, m.maxBody+1))
+		r.Body = readCloser{io.MultiReader(bytes.NewReader(buf), r.Body), r.Body}
+		if err != nil || int64(len(buf)) > m.maxBody {
+			DefaultMetrics.IncCounter("swindlr_mirror_skipped_total", Labels{"reason": "body_too_large"})
+			return
+		}
+		body = buf
+	}
+
+	shadow := r.Clone(context.Background())
+	shadow.RequestURI = ""
+
+	select {
+	case m.queue <- mirroredRequest{request: shadow, body: body}:
+	default:
+		DefaultMetrics.IncCounter("swindlr_mirror_skipped_total", Labels{"reason": "queue_full"})
+	}
+}
+
+func (m *Mirror) worker() {
+	for mr := range m.queue {
+		m.send(mr)
+	}
+}
+
+func (m *Mirror) send(mr mirroredRequest) {
+	peer := m.pool.GetNextPeer(mr.request)
+	if peer == nil {
+		DefaultMetrics.IncCounter("swindlr_mirror_requests_total", mirrorLabels("", "no_backend", ""))
+		return
+	}
+
+	req := mr.request
+	req.URL.Scheme = peer.URL.Scheme
+	req.URL.Host = peer.URL.Host
+	req.Host = peer.URL.Host
+	req.Body = io.NopCloser(bytes.NewReader(mr.body))
+	req.ContentLength = int64(len(mr.body))
+	req.Header.Set("X-Swindlr-Mirror", "true")
+
+	start := time.Now()
+	resp, err := m.client.Do(req)
+	latency := time.Since(start)
+
+	result, status := "error", ""
+	if err != nil {
+		log.Printf("Mirrored request to %s failed: %s", peer.URL.Host, err)
+	} else {
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		result, status = "response", strconv.Itoa(resp.StatusCode)
+	}
+
+	DefaultMetrics.IncCounter("swindlr_mirror_requests_total", mirrorLabels(peer.URL.Host, result, status))
+	DefaultMetrics.Observe("swindlr_mirror_latency_seconds", Labels{"backend": peer.URL.Host}, latency.Seconds())
+}
+
+// mirrorLabels are the labels of swindlr_mirror_requests_total. result is
+// response, error or no_backend, and status is only set for responses.
+func mirrorLabels(backend, result, status string) Labels {
+	return Labels{"backend": backend, "result": result, "status": status}
+}
+
+type readCloser struct {
+	io.Reader
+	io.Closer
+}
+
+func MirrorMiddleware(m *Mirror, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m != nil && m.sampled() {
+			m.Enqueue(r)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// SetupMirror returns nil when no mirror pool is configured.
+func SetupMirror(router *Router) *Mirror {
+	poolName := viper.GetString("mirror.pool")
+	if poolName == "" {
+		return nil
+	}
+
+	pool := router.Pool(poolName)
+	if pool == nil {
+		log.Fatalf("Mirror pool '%s' is not defined in pools", poolName)
+	}
+
+	log.Printf("Mirroring %.1f%% of requests to pool '%s'", viper.GetFloat64("mirror.sample_rate")*100, poolName)
+	return NewMirror(
+		pool,
+		viper.GetFloat64("mirror.sample_rate"),
+		viper.GetInt64("mirror.max_body_bytes"),
+		viper.GetDuration("mirror.timeout"),
+		viper.GetInt("mirror.workers"),
+		viper.GetInt("mirror.queue_size"),
+	)
+}
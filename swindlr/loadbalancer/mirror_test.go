@@ -0,0 +1,110 @@
+package loadbalancer
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMirrorMiddleware(t *testing.T) {
+	shadowBodies := make(chan string, 1)
+	shadowServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		shadowBodies <- string(body)
+
+		// A slow shadow must not delay the primary response
+		time.Sleep(500 * time.Millisecond)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer shadowServer.Close()
+
+	shadowPool := NewServerPool(&RoundRobin{})
+	shadowPool.AddBackend(&Backend{URL: parseURL(shadowServer.URL), Alive: true})
+
+	mirror := NewMirror(shadowPool, 1.0, 1024, time.Second, 1, 10)
+
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+	handler := MirrorMiddleware(mirror, primary)
+
+	req := httptest.NewRequest("POST", "http://swindlr.test/orders", strings.NewReader("order=1"))
+	rr := httptest.NewRecorder()
+
+	start := time.Now()
+	handler.ServeHTTP(rr, req)
+	if elapsed := time.Since(start); elapsed > 200*time.Millisecond {
+		t.Errorf("Primary response was delayed by the shadow pool: %s", elapsed)
+	}
+
+	if rr.Body.String() != "order=1" {
+		t.Errorf("Expected primary to receive the full body, got %q", rr.Body.String())
+	}
+
+	select {
+	case body := <-shadowBodies:
+		if body != "order=1" {
+			t.Errorf("Expected shadow to receive the full body, got %q", body)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Shadow pool never received the mirrored request")
+	}
+
+	labels := mirrorLabels(parseURL(shadowServer.URL).Host, "response", "418")
+	deadline := time.Now().Add(2 * time.Second)
+	for DefaultMetrics.Counter("swindlr_mirror_requests_total", labels) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("Shadow response status was not recorded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestMirrorSkipsLargeBodies(t *testing.T) {
+	mirror := NewMirror(NewServerPool(&RoundRobin{}), 1.0, 4, time.Second, 0, 10)
+
+	primary := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Write(body)
+	})
+
+	req := httptest.NewRequest("POST", "http://swindlr.test/upload", strings.NewReader("a much larger body"))
+	rr := httptest.NewRecorder()
+	MirrorMiddleware(mirror, primary).ServeHTTP(rr, req)
+
+	if rr.Body.String() != "a much larger body" {
+		t.Errorf("Expected primary to receive the full body, got %q", rr.Body.String())
+	}
+	if len(mirror.queue) != 0 {
+		t.Errorf("Expected oversized request not to be mirrored")
+	}
+}
+
+func TestMirrorFailureMetrics(t *testing.T) {
+	// Nothing listens on the backend's address
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend := &Backend{URL: parseURL(server.URL), Alive: true}
+	server.Close()
+
+	pool := NewServerPool(&RoundRobin{})
+	mirror := NewMirror(pool, 1.0, 1024, time.Second, 0, 10)
+	noBackend := mirrorLabels("", "no_backend", "")
+	failed := mirrorLabels(backend.URL.Host, "error", "")
+
+	before := DefaultMetrics.Counter("swindlr_mirror_requests_total", noBackend)
+	mirror.send(mirroredRequest{request: httptest.NewRequest("GET", "http://swindlr.test/", nil)})
+	if DefaultMetrics.Counter("swindlr_mirror_requests_total", noBackend) != before+1 {
+		t.Errorf("Expected a mirrored request without a backend to be counted")
+	}
+
+	pool.AddBackend(backend)
+	before = DefaultMetrics.Counter("swindlr_mirror_requests_total", failed)
+	mirror.send(mirroredRequest{request: httptest.NewRequest("GET", "http://swindlr.test/", nil)})
+	if DefaultMetrics.Counter("swindlr_mirror_requests_total", failed) != before+1 {
+		t.Errorf("Expected a failed mirrored request to be counted with the same labels")
+	}
+}
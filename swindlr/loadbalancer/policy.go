@@ -0,0 +1,470 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+// RateLimitPolicy is a named limit of Limit requests per Period. Key
+// selects what the requests are counted by: all requests together when
+// empty, or each client when ip, header or jwt. Algorithm is one of:
+//   - token_bucket: the rate is Limit per Period, with bursts of Burst
+//   - sliding_window: at most Limit requests in any window of Period
+//   - gcra: like token_bucket, with requests evenly spaced and Burst
+//     allowed at once, using a single timestamp per client
+type RateLimitPolicy struct {
+	Name      string        `mapstructure:"name"`
+	Algorithm string        `mapstructure:"algorithm"`
+	Limit     int           `mapstructure:"limit"`
+	Period    time.Duration `mapstructure:"period"`
+	Burst     int           `mapstructure:"burst"`
+	Key       string        `mapstructure:"key"`
+	Header    string        `mapstructure:"header"`
+	states    *limiterStates
+	shared    *DistributedLimiter
+}
+
+// RateLimitAttachment applies a policy to the requests matching all of
+// its selectors. Empty selectors match every request.
+type RateLimitAttachment struct {
+	Policy      string   `mapstructure:"policy"`
+	PathPrefix  string   `mapstructure:"path_prefix"`
+	Pool        string   `mapstructure:"pool"`
+	Methods     []string `mapstructure:"methods"`
+	ClientClass string   `mapstructure:"client_class"`
+	policy      *RateLimitPolicy
+}
+
+// ClientClass groups clients by request properties, so policies can be
+// attached to them. A request belongs to the first class whose matchers
+// all match.
+type ClientClass struct {
+	Name     string    `mapstructure:"name"`
+	Matchers []Matcher `mapstructure:"matchers"`
+}
+
+// RateLimitResponse is the response sent to rejected requests.
+type RateLimitResponse struct {
+	Status      int    `mapstructure:"status"`
+	Body        string `mapstructure:"body"`
+	ContentType string `mapstructure:"content_type"`
+	RetryAfter  bool   `mapstructure:"retry_after"`
+}
+
+// rateLimitResponse is sent to requests rejected by backend and client
+// limits, as it is by policies.
+var rateLimitResponse = RateLimitResponse{
+	Status:      http.StatusTooManyRequests,
+	Body:        "Rate limit exceeded\n",
+	ContentType: "text/plain; charset=utf-8",
+	RetryAfter:  true,
+}
+
+func SetRateLimitResponse(response RateLimitResponse) {
+	if response.Status == 0 {
+		response.Status = http.StatusTooManyRequests
+	}
+	rateLimitResponse = response
+}
+
+func (resp RateLimitResponse) write(w http.ResponseWriter, retryAfter time.Duration) {
+	if resp.RetryAfter {
+		setRetryAfter(w, retryAfter)
+	}
+	if resp.ContentType != "" {
+		w.Header().Set("Content-Type", resp.ContentType)
+	}
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	// The rejection only holds until the limit refills, so it must not
+	// be cached
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(resp.Status)
+	w.Write([]byte(resp.Body))
+}
+
+type RateLimitPolicyConfig struct {
+	Policies      []*RateLimitPolicy    `mapstructure:"policies"`
+	Attachments   []RateLimitAttachment `mapstructure:"attachments"`
+	ClientClasses []ClientClass         `mapstructure:"client_classes"`
+	// Global is the policy applied to every request
+	Global     string            `mapstructure:"global"`
+	Response   RateLimitResponse `mapstructure:"response"`
+	MaxClients int               `mapstructure:"max_clients"`
+}
+
+// limitState is the state of a policy for one client.
+type limitState interface {
+	// take counts a request at now if it is within the limit
+	take(now time.Time) rateLimitStatus
+}
+
+type tokenBucketState struct {
+	limiter *rate.Limiter
+}
+
+func (s *tokenBucketState) take(now time.Time) rateLimitStatus {
+	return takeToken(s.limiter, now)
+}
+
+// slidingWindowState keeps the time of each request in the window.
+type slidingWindowState struct {
+	limit  int
+	period time.Duration
+	log    []time.Time
+	mux    sync.Mutex
+}
+
+func (s *slidingWindowState) take(now time.Time) rateLimitStatus {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	start := now.Add(-s.period)
+	expired := 0
+	for expired < len(s.log) && !s.log[expired].After(start) {
+		expired++
+	}
+	s.log = s.log[expired:]
+
+	status := rateLimitStatus{limit: s.limit, policy: policyItem(s.limit, s.period)}
+	if len(s.log) >= s.limit {
+		status.retryAfter = s.log[0].Sub(start)
+	} else {
+		status.allowed = true
+		s.log = append(s.log, now)
+	}
+	status.remaining = s.limit - len(s.log)
+	status.reset = s.log[len(s.log)-1].Add(s.period).Sub(now)
+	return status
+}
+
+// gcraState keeps the theoretical arrival time of the next request.
+type gcraState struct {
+	interval  time.Duration
+	tolerance time.Duration
+	tat       time.Time
+	mux       sync.Mutex
+}
+
+func (s *gcraState) take(now time.Time) rateLimitStatus {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	burst := int(s.tolerance/s.interval) + 1
+	status := rateLimitStatus{limit: burst, policy: policyItem(burst, time.Duration(burst)*s.interval)}
+
+	tat := s.tat
+	if tat.Before(now) {
+		tat = now
+	}
+	if wait := tat.Sub(now) - s.tolerance; wait > 0 {
+		status.retryAfter = wait
+	} else {
+		status.allowed = true
+		tat = tat.Add(s.interval)
+		s.tat = tat
+	}
+
+	// Each interval the arrival time is ahead of now uses up a request
+	// of the burst
+	status.reset = tat.Sub(now)
+	used := int((status.reset + s.interval - 1) / s.interval)
+	if used < burst {
+		status.remaining = burst - used
+	}
+	return status
+}
+
+func (p *RateLimitPolicy) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("rate limit policy has no name")
+	}
+	switch p.Algorithm {
+	case "token_bucket", "sliding_window", "gcra":
+	default:
+		return fmt.Errorf("rate limit policy %s: invalid algorithm %q", p.Name, p.Algorithm)
+	}
+	if p.Limit < 1 || p.Period < time.Duration(p.Limit) {
+		return fmt.Errorf("rate limit policy %s needs a positive limit and period", p.Name)
+	}
+	if p.Burst == 0 {
+		p.Burst = p.Limit
+	}
+	if p.Burst < 1 {
+		return fmt.Errorf("rate limit policy %s: invalid burst %d", p.Name, p.Burst)
+	}
+	switch p.Key {
+	case "", "ip", "jwt":
+	case "header":
+		if p.Header == "" {
+			return fmt.Errorf("rate limit policy %s counts by header but has no header name", p.Name)
+		}
+	default:
+		return fmt.Errorf("rate limit policy %s: invalid key %q", p.Name, p.Key)
+	}
+	return nil
+}
+
+// idleTimeout is how long it takes for the state of a client to be the
+// same as new state.
+func (p *RateLimitPolicy) idleTimeout() time.Duration {
+	refill := time.Duration(float64(p.Period) * float64(p.Burst) / float64(p.Limit))
+	if refill > p.Period {
+		return refill
+	}
+	return p.Period
+}
+
+// newState returns the state of the client with the given key. Shared
+// across replicas, sliding windows are approximated, and the other
+// algorithms count requests in fixed windows of Period.
+func (p *RateLimitPolicy) newState(key string) interface{} {
+	if p.shared != nil {
+		key = "policy:" + p.Name + ":" + hashKey(key)
+		if p.Algorithm == "sliding_window" {
+			return p.shared.newSlidingState(key, p.Limit, p.Period)
+		}
+		return p.shared.newState(key, p.Limit, p.Period)
+	}
+	interval := p.Period / time.Duration(p.Limit)
+	switch p.Algorithm {
+	case "sliding_window":
+		return &slidingWindowState{limit: p.Limit, period: p.Period}
+	case "gcra":
+		return &gcraState{interval: interval, tolerance: interval * time.Duration(p.Burst-1)}
+	}
+	return &tokenBucketState{limiter: rate.NewLimiter(rate.Every(interval), p.Burst)}
+}
+
+func (p *RateLimitPolicy) take(r *http.Request, now time.Time) rateLimitStatus {
+	key := ""
+	if p.Key != "" {
+		key = identifyClient(r, p.Key, p.Header).String()
+	}
+	state := p.states.get(key, func() interface{} { return p.newState(key) })
+	return state.(limitState).take(now)
+}
+
+func (a *RateLimitAttachment) matches(r *http.Request, class string) bool {
+	if a.PathPrefix != "" && !strings.HasPrefix(r.URL.Path, a.PathPrefix) {
+		return false
+	}
+	if a.Pool != "" && a.Pool != GetPoolFromContext(r) {
+		return false
+	}
+	if a.ClientClass != "" && a.ClientClass != class {
+		return false
+	}
+	if len(a.Methods) == 0 {
+		return true
+	}
+	for _, method := range a.Methods {
+		if strings.EqualFold(method, r.Method) {
+			return true
+		}
+	}
+	return false
+}
+
+// RateLimitPolicies applies the global policy and the policies attached
+// to a request. A request is only let through if all of them allow it.
+type RateLimitPolicies struct {
+	policies    map[string]*RateLimitPolicy
+	global      *RateLimitPolicy
+	attachments []RateLimitAttachment
+	classes     []ClientClass
+	response    RateLimitResponse
+}
+
+// NewRateLimitPolicies creates the policies of config. With shared set,
+// they are counted across replicas.
+func NewRateLimitPolicies(config RateLimitPolicyConfig, shared *DistributedLimiter) (*RateLimitPolicies, error) {
+	p := &RateLimitPolicies{
+		policies: make(map[string]*RateLimitPolicy),
+		classes:  config.ClientClasses,
+		response: config.Response,
+	}
+	if p.response.Status == 0 {
+		p.response.Status = http.StatusTooManyRequests
+	}
+
+	for _, policy := range config.Policies {
+		if err := policy.validate(); err != nil {
+			return nil, err
+		}
+		if _, found := p.policies[policy.Name]; found {
+			return nil, fmt.Errorf("rate limit policy %s already exists", policy.Name)
+		}
+		policy.shared = shared
+		if shared != nil && policy.Algorithm != "sliding_window" {
+			log.Printf("Rate limit policy %s is shared across replicas, so it counts requests in fixed windows of %s instead of using %s", policy.Name, policy.Period, policy.Algorithm)
+		}
+		policy.states = newLimiterStates(config.MaxClients, policy.idleTimeout(), Labels{"limiter": "policy:" + policy.Name})
+		p.policies[policy.Name] = policy
+	}
+
+	if config.Global != "" {
+		p.global = p.policies[config.Global]
+		if p.global == nil {
+			return nil, fmt.Errorf("global rate limit policy %s doesn't exist", config.Global)
+		}
+	}
+
+	classes := make(map[string]bool)
+	for i := range p.classes {
+		class := &p.classes[i]
+		if class.Name == "" || len(class.Matchers) == 0 {
+			return nil, fmt.Errorf("client classes need a name and matchers")
+		}
+		for j := range class.Matchers {
+			if err := class.Matchers[j].compile(); err != nil {
+				return nil, fmt.Errorf("client class %s: %w", class.Name, err)
+			}
+		}
+		classes[class.Name] = true
+	}
+
+	for _, attachment := range config.Attachments {
+		attachment.policy = p.policies[attachment.Policy]
+		if attachment.policy == nil {
+			return nil, fmt.Errorf("attached rate limit policy %s doesn't exist", attachment.Policy)
+		}
+		if attachment.ClientClass != "" && !classes[attachment.ClientClass] {
+			return nil, fmt.Errorf("client class %s doesn't exist", attachment.ClientClass)
+		}
+		p.attachments = append(p.attachments, attachment)
+	}
+	return p, nil
+}
+
+// clientClass returns the class of the request's client, or an empty
+// string if it matches none.
+func (p *RateLimitPolicies) clientClass(r *http.Request) string {
+	for _, class := range p.classes {
+		matches := true
+		for i := range class.Matchers {
+			if !class.Matchers[i].Matches(r) {
+				matches = false
+				break
+			}
+		}
+		if matches {
+			return class.Name
+		}
+	}
+	return ""
+}
+
+// applicable returns the policies that apply to the request, each once.
+func (p *RateLimitPolicies) applicable(r *http.Request) []*RateLimitPolicy {
+	var policies []*RateLimitPolicy
+	if p.global != nil {
+		policies = append(policies, p.global)
+	}
+
+	class := p.clientClass(r)
+	for i := range p.attachments {
+		attachment := &p.attachments[i]
+		if !attachment.matches(r, class) {
+			continue
+		}
+		duplicate := false
+		for _, policy := range policies {
+			if policy == attachment.policy {
+				duplicate = true
+				break
+			}
+		}
+		if !duplicate {
+			policies = append(policies, attachment.policy)
+		}
+	}
+	return policies
+}
+
+// Check applies the policies to the request, stopping at the first one
+// that rejects it. The policies checked before it still count the
+// request. The statuses of the checked policies are returned.
+func (p *RateLimitPolicies) Check(r *http.Request) (rejectedBy *RateLimitPolicy, statuses []rateLimitStatus) {
+	now := time.Now()
+	for _, policy := range p.applicable(r) {
+		status := policy.take(r, now)
+		statuses = append(statuses, status)
+		if !status.allowed {
+			return policy, statuses
+		}
+	}
+	return nil, statuses
+}
+
+func (p *RateLimitPolicies) reject(w http.ResponseWriter, retryAfter time.Duration) {
+	p.response.write(w, retryAfter)
+}
+
+// DeleteIdle drops the state of clients that are back to a full budget.
+func (p *RateLimitPolicies) DeleteIdle() {
+	for _, policy := range p.policies {
+		policy.states.DeleteIdle()
+	}
+}
+
+// StartJanitor drops idle state every interval until stop is closed.
+func (p *RateLimitPolicies) StartJanitor(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			p.DeleteIdle()
+		case <-stop:
+			return
+		}
+	}
+}
+
+// RateLimitPolicyMiddleware has to run after routing, so policies can be
+// attached to pools.
+func RateLimitPolicyMiddleware(p *RateLimitPolicies, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if p == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		policy, statuses := p.Check(r)
+		r = reportRateLimit(w, r, statuses...)
+		if policy != nil {
+			DefaultMetrics.IncCounter("swindlr_rate_limited_total", Labels{"scope": "policy:" + policy.Name})
+			p.reject(w, statuses[len(statuses)-1].retryAfter)
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func SetupRateLimitPolicies() *RateLimitPolicies {
+	var config RateLimitPolicyConfig
+	if err := viper.UnmarshalKey("rate_limiting", &config); err != nil {
+		log.Fatalf("Error parsing rate limit policies: %s", err)
+	}
+	SetRateLimitResponse(config.Response)
+	if len(config.Policies) == 0 {
+		return nil
+	}
+
+	policies, err := NewRateLimitPolicies(config, sharedRateLimits)
+	if err != nil {
+		log.Fatalf("Error setting up rate limit policies: %s", err)
+	}
+
+	go policies.StartJanitor(time.Minute, nil)
+	log.Printf("Loaded %d rate limit policies with %d attachments", len(config.Policies), len(config.Attachments))
+	return policies
+}
@@ -0,0 +1,198 @@
+package loadbalancer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+)
+
+func newTestPolicies(t *testing.T, config RateLimitPolicyConfig) *RateLimitPolicies {
+	policies, err := NewRateLimitPolicies(config, nil)
+	if err != nil {
+		t.Fatalf("Failed to create rate limit policies: %s", err)
+	}
+	return policies
+}
+
+func TestLimitAlgorithms(t *testing.T) {
+	now := time.Now()
+
+	tests := []struct {
+		policy RateLimitPolicy
+		// allowed lists whether each request, one every 100ms, is let
+		// through
+		allowed []bool
+	}{
+		{
+			RateLimitPolicy{Algorithm: "token_bucket", Limit: 5, Period: time.Second, Burst: 2},
+			[]bool{true, true, true, false, true, false, true},
+		},
+		{
+			RateLimitPolicy{Algorithm: "sliding_window", Limit: 3, Period: time.Second},
+			[]bool{true, true, true, false, false, false, false, false, false, false, true},
+		},
+		{
+			RateLimitPolicy{Algorithm: "gcra", Limit: 5, Period: time.Second, Burst: 2},
+			[]bool{true, true, true, false, true, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.policy.Algorithm, func(t *testing.T) {
+			tt.policy.Name = tt.policy.Algorithm
+			if err := tt.policy.validate(); err != nil {
+				t.Fatalf("Invalid policy: %s", err)
+			}
+			state := tt.policy.newState("").(limitState)
+			for i, expected := range tt.allowed {
+				status := state.take(now.Add(time.Duration(i) * 100 * time.Millisecond))
+				if status.allowed != expected {
+					t.Errorf("Expected request %d allowed to be %t", i, expected)
+				}
+				if !status.allowed && status.retryAfter <= 0 {
+					t.Errorf("Expected a positive retry delay for request %d, got %s", i, status.retryAfter)
+				}
+			}
+		})
+	}
+}
+
+func TestSlidingWindowRetryAfter(t *testing.T) {
+	state := &slidingWindowState{limit: 1, period: time.Second}
+	now := time.Now()
+	state.take(now)
+	status := state.take(now.Add(300 * time.Millisecond))
+	if status.retryAfter != 700*time.Millisecond {
+		t.Errorf("Expected to retry after 700ms, got %s", status.retryAfter)
+	}
+}
+
+func TestRateLimitPolicyAttachments(t *testing.T) {
+	policies := newTestPolicies(t, RateLimitPolicyConfig{
+		Policies: []*RateLimitPolicy{
+			{Name: "writes", Algorithm: "token_bucket", Limit: 1, Period: time.Minute},
+			{Name: "v2", Algorithm: "sliding_window", Limit: 2, Period: time.Minute},
+			{Name: "free", Algorithm: "gcra", Limit: 1, Period: time.Minute, Key: "header", Header: "X-API-Key"},
+		},
+		Attachments: []RateLimitAttachment{
+			{Policy: "writes", PathPrefix: "/api", Methods: []string{"post", "PUT"}},
+			{Policy: "v2", Pool: "v2"},
+			{Policy: "free", ClientClass: "free"},
+		},
+		ClientClasses: []ClientClass{
+			{Name: "free", Matchers: []Matcher{{Source: "header", Name: "X-Plan", Match: "exact", Value: "free"}}},
+		},
+	})
+
+	request := func(method, path, pool string, header http.Header) *http.Request {
+		req := httptest.NewRequest(method, path, nil)
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		if pool != "" {
+			req = req.WithContext(context.WithValue(req.Context(), PoolKey, pool))
+		}
+		return req
+	}
+	check := func(req *http.Request) string {
+		if policy, _ := policies.Check(req); policy != nil {
+			return policy.Name
+		}
+		return ""
+	}
+
+	steps := []struct {
+		req      *http.Request
+		rejected string
+	}{
+		{request("POST", "/api/users", "", nil), ""},
+		{request("POST", "/api/users", "", nil), "writes"},
+		{request("GET", "/api/users", "", nil), ""},
+		{request("PUT", "/other", "", nil), ""},
+		{request("GET", "/", "v2", nil), ""},
+		{request("GET", "/", "v2", nil), ""},
+		{request("GET", "/", "v2", nil), "v2"},
+		{request("GET", "/", "default", nil), ""},
+		{request("GET", "/", "", http.Header{"X-Plan": {"free"}, "X-Api-Key": {"a"}}), ""},
+		{request("GET", "/", "", http.Header{"X-Plan": {"free"}, "X-Api-Key": {"a"}}), "free"},
+		// Each client of the class has its own budget
+		{request("GET", "/", "", http.Header{"X-Plan": {"free"}, "X-Api-Key": {"b"}}), ""},
+		{request("GET", "/", "", http.Header{"X-Plan": {"paid"}, "X-Api-Key": {"a"}}), ""},
+	}
+
+	for i, step := range steps {
+		if rejected := check(step.req); rejected != step.rejected {
+			t.Errorf("Step %d: expected rejection by %q, got %q", i, step.rejected, rejected)
+		}
+	}
+}
+
+func TestRateLimitPolicyMiddleware(t *testing.T) {
+	policies := newTestPolicies(t, RateLimitPolicyConfig{
+		Policies: []*RateLimitPolicy{{Name: "ceiling", Algorithm: "token_bucket", Limit: 1, Period: 10 * time.Second}},
+		Global:   "ceiling",
+		Response: RateLimitResponse{Status: http.StatusServiceUnavailable, Body: `{"error":"slow down"}`, ContentType: "application/json", RetryAfter: true},
+	})
+	handler := RateLimitPolicyMiddleware(policies, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Errorf("Expected status code %d, got %d", http.StatusOK, rr.Code)
+	}
+
+	// The global policy counts all requests together
+	req := httptest.NewRequest("GET", "/other", nil)
+	req.RemoteAddr = "10.0.0.2:1234"
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status code %d, got %d", http.StatusServiceUnavailable, rr.Code)
+	}
+	if rr.Body.String() != `{"error":"slow down"}` || rr.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("Unexpected response: %s %q", rr.Header().Get("Content-Type"), rr.Body.String())
+	}
+	if retryAfter := rr.Header().Get("Retry-After"); retryAfter != "10" {
+		t.Errorf("Expected Retry-After 10, got %q", retryAfter)
+	}
+}
+
+func TestRateLimitPolicyValidation(t *testing.T) {
+	valid := &RateLimitPolicy{Name: "p", Algorithm: "gcra", Limit: 1, Period: time.Second}
+
+	configs := []RateLimitPolicyConfig{
+		{Policies: []*RateLimitPolicy{{Name: "p", Algorithm: "leaky", Limit: 1, Period: time.Second}}},
+		{Policies: []*RateLimitPolicy{{Name: "p", Algorithm: "gcra", Period: time.Second}}},
+		{Policies: []*RateLimitPolicy{{Name: "p", Algorithm: "gcra", Limit: 1, Period: time.Second, Key: "header"}}},
+		{Policies: []*RateLimitPolicy{valid, valid}},
+		{Policies: []*RateLimitPolicy{valid}, Global: "missing"},
+		{Policies: []*RateLimitPolicy{valid}, Attachments: []RateLimitAttachment{{Policy: "missing"}}},
+		{Policies: []*RateLimitPolicy{valid}, Attachments: []RateLimitAttachment{{Policy: "p", ClientClass: "missing"}}},
+		{ClientClasses: []ClientClass{{Name: "c", Matchers: []Matcher{{Source: "body"}}}}},
+	}
+
+	for i, config := range configs {
+		if _, err := NewRateLimitPolicies(config, nil); err == nil {
+			t.Errorf("Expected an error for config %d", i)
+		}
+	}
+}
+
+func TestSetupRateLimitPolicies(t *testing.T) {
+	viper.Set("rate_limiting.policies", []map[string]interface{}{
+		{"name": "api", "algorithm": "sliding_window", "limit": 100, "period": "1m", "key": "ip"},
+	})
+	viper.Set("rate_limiting.attachments", []map[string]interface{}{{"policy": "api", "path_prefix": "/api"}})
+	defer viper.Set("rate_limiting.policies", nil)
+
+	policies := SetupRateLimitPolicies()
+	if policies == nil || policies.policies["api"].Period != time.Minute || len(policies.attachments) != 1 {
+		t.Errorf("Unexpected policies: %+v", policies)
+	}
+}
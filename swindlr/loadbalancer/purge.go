@@ -0,0 +1,282 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"crypto/tls"
+	"errors"
+	"net/http"
+	"path"
+	"strings"
+	"time"
+)
+
+// PurgeSelector selects cached responses by exactly one of their primary
+// cache key, the URL they were requested with, a path prefix, a path glob
+// or a surrogate key.
+type PurgeSelector struct {
+	Key    string `json:"key"`
+	URL    string `json:"url"`
+	Prefix string `json:"prefix"`
+	Glob   string `json:"glob"`
+	Tag    string `json:"tag"`
+	// urlKeys are the primary keys a URL resolves to, one per method,
+	// which match the URL on every route
+	urlKeys []string
+}
+
+// cacheBan lazily invalidates the responses matching the selector that
+// were received before the ban was added.
+type cacheBan struct {
+	selector PurgeSelector
+	created  time.Time
+}
+
+// surrogateKeys returns the tags of a response from its Surrogate-Key
+// (space separated) and Cache-Tag (comma separated) headers.
+func surrogateKeys(header http.Header) []string {
+	var tags []string
+	seen := map[string]bool{}
+	add := func(tag string) {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !seen[tag] {
+			seen[tag] = true
+			tags = append(tags, tag)
+		}
+	}
+
+	for _, line := range header.Values("Surrogate-Key") {
+		for _, tag := range strings.Fields(line) {
+			add(tag)
+		}
+	}
+	for _, line := range header.Values("Cache-Tag") {
+		for _, tag := range strings.Split(line, ",") {
+			add(tag)
+		}
+	}
+	return tags
+}
+
+func (item CacheItem) HasTag(tag string) bool {
+	for _, t := range item.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve checks that exactly one criterion is set, and turns a URL into
+// the primary keys of GET and HEAD requests for it, without a route.
+func (c *Cache) resolve(selector PurgeSelector) (PurgeSelector, error) {
+	set := 0
+	for _, value := range []string{selector.Key, selector.URL, selector.Prefix, selector.Glob, selector.Tag} {
+		if value != "" {
+			set++
+		}
+	}
+	if set != 1 {
+		return selector, errors.New("exactly one of key, url, prefix, glob or tag is required")
+	}
+
+	if selector.Glob != "" {
+		if _, err := path.Match(selector.Glob, ""); err != nil {
+			return selector, err
+		}
+	}
+
+	if selector.URL != "" {
+		var keys []string
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			r, err := http.NewRequest(method, selector.URL, nil)
+			if err != nil {
+				return selector, err
+			}
+			// The key takes the scheme from the connection
+			if r.URL.Scheme == "https" {
+				r.TLS = &tls.ConnectionState{}
+			}
+			keys = append(keys, c.Key(r))
+		}
+		selector = PurgeSelector{urlKeys: keys}
+	}
+	return selector, nil
+}
+
+// matchesEntry reports whether the selector covers all variants of the
+// entry. Tags are matched per variant.
+func (s PurgeSelector) matchesEntry(entry *cacheEntry) bool {
+	switch {
+	case s.Key != "":
+		return entry.key == s.Key
+	case len(s.urlKeys) > 0:
+		for _, key := range s.urlKeys {
+			if entry.key == key || strings.HasPrefix(entry.key, key+routeKeySeparator) {
+				return true
+			}
+		}
+		return false
+	case s.Prefix != "":
+		return strings.HasPrefix(entry.path, s.Prefix)
+	case s.Glob != "":
+		matched, _ := path.Match(s.Glob, entry.path)
+		return matched
+	}
+	return false
+}
+
+func (s PurgeSelector) matches(entry *cacheEntry, item CacheItem) bool {
+	if s.Tag != "" {
+		return item.HasTag(s.Tag)
+	}
+	return s.matchesEntry(entry)
+}
+
+// Purge removes the matching responses right away and returns how many
+// were removed.
+func (c *Cache) Purge(selector PurgeSelector) (int, error) {
+	selector, err := c.resolve(selector)
+	if err != nil {
+		return 0, err
+	}
+	return c.store.Purge(selector)
+}
+
+// Ban invalidates the matching responses that are currently stored. Stores
+// may do so lazily.
+func (c *Cache) Ban(selector PurgeSelector) error {
+	selector, err := c.resolve(selector)
+	if err != nil {
+		return err
+	}
+	return c.store.Ban(selector)
+}
+
+// Flush removes all responses and returns how many were removed.
+func (c *Cache) Flush() int {
+	return c.store.Flush()
+}
+
+// Purge removes the matching responses right away and returns how many
+// were removed.
+func (m *MemoryStore) Purge(selector PurgeSelector) (int, error) {
+	defer m.unlinkRemoved()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	purged := 0
+	if selector.Key != "" {
+		if element, found := m.items[selector.Key]; found {
+			purged = len(element.Value.(*cacheEntry).variants)
+			m.removeElement(element)
+		}
+	} else {
+		for _, element := range m.items {
+			purged += m.removeVariants(element, func(entry *cacheEntry, item CacheItem) bool {
+				return selector.matches(entry, item)
+			})
+		}
+	}
+
+	// The disk tier holds every stored response, including those in memory
+	if m.disk != nil {
+		if removed := m.disk.Remove(selector.matches); removed > purged {
+			purged = removed
+		}
+	}
+
+	DefaultMetrics.AddCounter("swindlr_cache_purged_total", Labels{"mode": "purge"}, float64(purged))
+	m.publishStats()
+	return purged, nil
+}
+
+// Ban invalidates the matching responses the next time they are looked
+// up, or when the janitor runs, whichever comes first. Unlike Purge, it
+// doesn't have to walk the whole cache.
+func (m *MemoryStore) Ban(selector PurgeSelector) error {
+	m.mux.Lock()
+	defer m.mux.Unlock()
+	m.bans = append(m.bans, cacheBan{selector: selector, created: time.Now()})
+	DefaultMetrics.SetGauge("swindlr_cache_bans", nil, float64(len(m.bans)))
+	return nil
+}
+
+// Flush removes all responses and bans, and returns how many responses
+// were removed.
+func (m *MemoryStore) Flush() int {
+	defer m.unlinkRemoved()
+	m.mux.Lock()
+	defer m.mux.Unlock()
+
+	purged := 0
+	for _, element := range m.items {
+		purged += len(element.Value.(*cacheEntry).variants)
+	}
+	m.items = make(map[string]*list.Element)
+	m.lru.Init()
+	m.stats.Bytes = 0
+	m.bans = nil
+	if m.disk != nil {
+		if removed := m.disk.Flush(); removed > purged {
+			purged = removed
+		}
+	}
+
+	DefaultMetrics.AddCounter("swindlr_cache_purged_total", Labels{"mode": "flush"}, float64(purged))
+	DefaultMetrics.SetGauge("swindlr_cache_bans", nil, 0)
+	m.publishStats()
+	return purged
+}
+
+// banned reports whether the item was received before a ban matching it.
+// It must be called with the lock held.
+func (m *MemoryStore) banned(entry *cacheEntry, item CacheItem) bool {
+	for _, ban := range m.bans {
+		if item.ResponseTime.Before(ban.created) && ban.selector.matches(entry, item) {
+			return true
+		}
+	}
+	return false
+}
+
+// applyBans removes all banned responses, after which the bans are no
+// longer needed. It must be called with the lock held.
+func (m *MemoryStore) applyBans() {
+	if len(m.bans) == 0 {
+		return
+	}
+
+	purged := 0
+	for _, element := range m.items {
+		purged += m.removeVariants(element, m.banned)
+	}
+	if m.disk != nil {
+		if removed := m.disk.Remove(m.banned); removed > purged {
+			purged = removed
+		}
+	}
+	m.bans = nil
+
+	DefaultMetrics.AddCounter("swindlr_cache_purged_total", Labels{"mode": "ban"}, float64(purged))
+	DefaultMetrics.SetGauge("swindlr_cache_bans", nil, 0)
+}
+
+// removeVariants removes the variants of the entry for which remove
+// returns true, and the entry itself once it has none left. It must be
+// called with the lock held.
+func (m *MemoryStore) removeVariants(element *list.Element, remove func(*cacheEntry, CacheItem) bool) int {
+	entry := element.Value.(*cacheEntry)
+	removed := 0
+	for variant, item := range entry.variants {
+		if remove(entry, item) {
+			delete(entry.variants, variant)
+			entry.size -= item.size()
+			m.stats.Bytes -= item.size()
+			removed++
+		}
+	}
+	if len(entry.variants) == 0 {
+		m.removeElement(element)
+	}
+	return removed
+}
@@ -0,0 +1,436 @@
+package loadbalancer
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+// rateLimitStatus is the state of a limit after a request, reported in
+// the RateLimit headers (draft-ietf-httpapi-ratelimit-headers).
+type rateLimitStatus struct {
+	allowed bool
+	// retryAfter is how long until a rejected request would be allowed
+	retryAfter time.Duration
+	limit      int
+	remaining  int
+	// reset is how long until the full quota is available again
+	reset time.Duration
+	// policy describes the limit as a quota per window of seconds
+	policy string
+}
+
+func ceilSeconds(d time.Duration) int64 {
+	return int64(math.Ceil(d.Seconds()))
+}
+
+func policyItem(quota int, window time.Duration) string {
+	return fmt.Sprintf("%d;w=%d", quota, ceilSeconds(window))
+}
+
+// takeToken takes a token from the limiter if one is available at now.
+// The delay of a rejected request comes from the limiter's reservation.
+func takeToken(limiter *rate.Limiter, now time.Time) rateLimitStatus {
+	status, _, _ := reserveToken(limiter, now, 0)
+	return status
+}
+
+// reserveToken takes a token, or reserves one available within maxDelay.
+// It returns the reservation and how long the request has to wait for
+// it. The reservation of a request that isn't allowed is canceled.
+func reserveToken(limiter *rate.Limiter, now time.Time, maxDelay time.Duration) (rateLimitStatus, *rate.Reservation, time.Duration) {
+	status := rateLimitStatus{limit: limiter.Burst()}
+	reservation := limiter.ReserveN(now, 1)
+	delay := reservation.DelayFrom(now)
+	if delay > maxDelay || !reservation.OK() {
+		reservation.CancelAt(now)
+		status.retryAfter = delay
+	} else {
+		status.allowed = true
+	}
+
+	tokens := limiter.TokensAt(now)
+	status.remaining = int(math.Max(0, math.Floor(tokens)))
+	if limit := float64(limiter.Limit()); limit > 0 && !math.IsInf(limit, 1) {
+		status.reset = time.Duration((float64(limiter.Burst()) - tokens) / limit * float64(time.Second))
+		status.policy = policyItem(limiter.Burst(), time.Duration(float64(limiter.Burst())/limit*float64(time.Second)))
+	}
+	if !status.allowed {
+		return status, nil, 0
+	}
+	return status, reservation, delay
+}
+
+// rateLimitReport collects the status of every limit a request is
+// covered by, so each layer of limits can report all of them.
+type rateLimitReport struct {
+	statuses []rateLimitStatus
+	mux      sync.Mutex
+}
+
+// reportRateLimit adds the statuses to the request's report and writes
+// the RateLimit headers for all of the limits reported so far. The limit
+// with the least remaining quota is the one described in detail.
+func reportRateLimit(w http.ResponseWriter, r *http.Request, statuses ...rateLimitStatus) *http.Request {
+	report, ok := r.Context().Value(RateLimitKey).(*rateLimitReport)
+	if !ok {
+		report = &rateLimitReport{}
+		r = r.WithContext(context.WithValue(r.Context(), RateLimitKey, report))
+	}
+
+	report.mux.Lock()
+	defer report.mux.Unlock()
+	report.statuses = append(report.statuses, statuses...)
+	if len(report.statuses) == 0 {
+		return r
+	}
+
+	header := w.Header()
+	header.Del("RateLimit-Policy")
+	closest := report.statuses[0]
+	for _, status := range report.statuses {
+		if status.remaining < closest.remaining || (status.remaining == closest.remaining && status.reset > closest.reset) {
+			closest = status
+		}
+		if status.policy != "" {
+			header.Add("RateLimit-Policy", status.policy)
+		}
+	}
+	header.Set("RateLimit-Limit", strconv.Itoa(closest.limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(closest.remaining))
+	header.Set("RateLimit-Reset", strconv.FormatInt(ceilSeconds(closest.reset), 10))
+	return r
+}
+
+// rejectRateLimited answers a request over a limit with the configured
+// response, telling the client when to retry.
+func rejectRateLimited(w http.ResponseWriter, retryAfter time.Duration) {
+	rateLimitResponse.write(w, retryAfter)
+}
+
+// setRetryAfter sets Retry-After to the delay in whole seconds, at least
+// one.
+func setRetryAfter(w http.ResponseWriter, retryAfter time.Duration) {
+	seconds := ceilSeconds(retryAfter)
+	if seconds < 1 {
+		seconds = 1
+	}
+	w.Header().Set("Retry-After", strconv.FormatInt(seconds, 10))
+}
+
+// ClientRateLimitRoute overrides the client limits for requests whose path
+// starts with PathPrefix. Each client has a separate bucket per route.
+type ClientRateLimitRoute struct {
+	PathPrefix string  `mapstructure:"path_prefix"`
+	Rate       float64 `mapstructure:"rate"`
+	Burst      int     `mapstructure:"burst"`
+}
+
+// ClientRateLimitConfig configures per-client rate limiting. Key is one
+// of ip, header or jwt. Clients without the API key header or a bearer
+// token are limited by IP.
+type ClientRateLimitConfig struct {
+	Key         string                 `mapstructure:"key"`
+	Header      string                 `mapstructure:"header"`
+	Rate        float64                `mapstructure:"rate"`
+	Burst       int                    `mapstructure:"burst"`
+	MaxClients  int                    `mapstructure:"max_clients"`
+	IdleTimeout time.Duration          `mapstructure:"idle_timeout"`
+	AllowIPs    []string               `mapstructure:"allow_ips"`
+	AllowKeys   []string               `mapstructure:"allow_keys"`
+	Routes      []ClientRateLimitRoute `mapstructure:"routes"`
+}
+
+// limiterState is the state of a limit for one client.
+type limiterState struct {
+	key      string
+	value    interface{}
+	lastSeen time.Time
+}
+
+// limiterStates holds the state of a limit for the most recently seen
+// clients. State that was idle long enough to be the same as new state
+// can be dropped without letting a client through any sooner.
+type limiterStates struct {
+	states      map[string]*list.Element
+	lru         *list.List
+	maxClients  int
+	idleTimeout time.Duration
+	labels      Labels
+	mux         sync.Mutex
+}
+
+func newLimiterStates(maxClients int, idleTimeout time.Duration, labels Labels) *limiterStates {
+	return &limiterStates{
+		states:      make(map[string]*list.Element),
+		lru:         list.New(),
+		maxClients:  maxClients,
+		idleTimeout: idleTimeout,
+		labels:      labels,
+	}
+}
+
+// get returns the state for the key, created with create if there is none.
+func (s *limiterStates) get(key string, create func() interface{}) interface{} {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if element, found := s.states[key]; found {
+		state := element.Value.(*limiterState)
+		state.lastSeen = time.Now()
+		s.lru.MoveToFront(element)
+		return state.value
+	}
+
+	state := &limiterState{key: key, value: create(), lastSeen: time.Now()}
+	s.states[key] = s.lru.PushFront(state)
+	for s.maxClients > 0 && s.lru.Len() > s.maxClients {
+		s.remove(s.lru.Back())
+		DefaultMetrics.IncCounter("swindlr_rate_limit_client_evictions_total", s.labels)
+	}
+	DefaultMetrics.SetGauge("swindlr_rate_limit_clients", s.labels, float64(s.lru.Len()))
+	return state.value
+}
+
+func (s *limiterStates) remove(element *list.Element) {
+	s.lru.Remove(element)
+	delete(s.states, element.Value.(*limiterState).key)
+}
+
+func (s *limiterStates) Len() int {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+	return s.lru.Len()
+}
+
+// DeleteIdle drops the state of clients not seen for the idle timeout.
+func (s *limiterStates) DeleteIdle() {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	cutoff := time.Now().Add(-s.idleTimeout)
+	for element := s.lru.Back(); element != nil; element = s.lru.Back() {
+		if element.Value.(*limiterState).lastSeen.After(cutoff) {
+			break
+		}
+		s.remove(element)
+	}
+	DefaultMetrics.SetGauge("swindlr_rate_limit_clients", s.labels, float64(s.lru.Len()))
+}
+
+// ClientRateLimiter limits the rate of requests of each client.
+type ClientRateLimiter struct {
+	config    ClientRateLimitConfig
+	allowIPs  []*net.IPNet
+	allowKeys map[string]bool
+	// routes are sorted by decreasing prefix length, so the most
+	// specific route matches first
+	routes  []ClientRateLimitRoute
+	clients *limiterStates
+}
+
+func NewClientRateLimiter(config ClientRateLimitConfig) (*ClientRateLimiter, error) {
+	switch config.Key {
+	case "ip", "jwt":
+	case "header":
+		if config.Header == "" {
+			return nil, fmt.Errorf("client rate limiting by header needs a header name")
+		}
+	default:
+		return nil, fmt.Errorf("invalid client rate limiting key: %q", config.Key)
+	}
+	if config.Rate <= 0 || config.Burst < 1 {
+		return nil, fmt.Errorf("client rate limit needs a positive rate and burst")
+	}
+	for _, route := range config.Routes {
+		if route.PathPrefix == "" || route.Rate <= 0 || route.Burst < 1 {
+			return nil, fmt.Errorf("client rate limit route %q needs a path prefix, a positive rate and burst", route.PathPrefix)
+		}
+	}
+
+	allowIPs, err := parseNetworks(config.AllowIPs)
+	if err != nil {
+		return nil, err
+	}
+	allowKeys := make(map[string]bool)
+	for _, key := range config.AllowKeys {
+		allowKeys[key] = true
+	}
+
+	routes := append([]ClientRateLimitRoute(nil), config.Routes...)
+	sort.SliceStable(routes, func(i, j int) bool {
+		return len(routes[i].PathPrefix) > len(routes[j].PathPrefix)
+	})
+
+	return &ClientRateLimiter{
+		config:    config,
+		allowIPs:  allowIPs,
+		allowKeys: allowKeys,
+		routes:    routes,
+		clients:   newLimiterStates(config.MaxClients, config.IdleTimeout, Labels{"limiter": "client"}),
+	}, nil
+}
+
+// jwtSubject returns the sub claim of the request's bearer token, if it
+// is verified. Unverified tokens would let clients pick their own
+// buckets, so without a verifier no subject is returned.
+func jwtSubject(r *http.Request) string {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || jwtVerifier == nil {
+		return ""
+	}
+	subject, err := jwtVerifier.Subject(token, time.Now())
+	if err != nil {
+		DefaultMetrics.IncCounter("swindlr_jwt_rejected_total", nil)
+		return ""
+	}
+	return subject
+}
+
+// clientIdentity identifies a client by the value of an API key header
+// or its JWT subject, or by its address if the request has neither.
+type clientIdentity struct {
+	key string
+	id  string
+	ip  net.IP
+}
+
+// identifyClient identifies the client of the request. key is one of ip,
+// header or jwt.
+func identifyClient(r *http.Request, key, header string) clientIdentity {
+	client := clientIdentity{key: key, ip: clientIP(r)}
+	switch key {
+	case "header":
+		client.id = r.Header.Get(header)
+	case "jwt":
+		client.id = jwtSubject(r)
+	}
+	return client
+}
+
+func (c clientIdentity) String() string {
+	if c.id != "" {
+		return c.key + ":" + c.id
+	}
+	if c.ip == nil {
+		return "ip:unknown"
+	}
+	return "ip:" + c.ip.String()
+}
+
+// allowed reports whether the client's key or address is on an allow
+// list.
+func (l *ClientRateLimiter) allowed(client clientIdentity) bool {
+	if client.id != "" && l.allowKeys[client.id] {
+		return true
+	}
+	return client.ip != nil && containsIP(l.allowIPs, client.ip)
+}
+
+func (l *ClientRateLimiter) route(path string) ClientRateLimitRoute {
+	for _, route := range l.routes {
+		if strings.HasPrefix(path, route.PathPrefix) {
+			return route
+		}
+	}
+	return ClientRateLimitRoute{Rate: l.config.Rate, Burst: l.config.Burst}
+}
+
+// take counts the request against the limit of its client. covered is
+// false for clients on an allow list.
+func (l *ClientRateLimiter) take(r *http.Request) (status rateLimitStatus, covered bool) {
+	client := identifyClient(r, l.config.Key, l.config.Header)
+	if l.allowed(client) {
+		return rateLimitStatus{}, false
+	}
+	route := l.route(r.URL.Path)
+	limiter := l.clients.get(client.String()+" "+route.PathPrefix, func() interface{} {
+		return rate.NewLimiter(rate.Limit(route.Rate), route.Burst)
+	})
+	return takeToken(limiter.(*rate.Limiter), time.Now()), true
+}
+
+// Allow reports whether the request is within the limits of its client.
+func (l *ClientRateLimiter) Allow(r *http.Request) bool {
+	status, covered := l.take(r)
+	return !covered || status.allowed
+}
+
+// Clients returns the number of clients a limiter is kept for.
+func (l *ClientRateLimiter) Clients() int {
+	return l.clients.Len()
+}
+
+func (l *ClientRateLimiter) DeleteIdle() {
+	l.clients.DeleteIdle()
+}
+
+// StartJanitor drops idle limiters every interval until stop is closed.
+func (l *ClientRateLimiter) StartJanitor(interval time.Duration, stop <-chan struct{}) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			l.DeleteIdle()
+		case <-stop:
+			return
+		}
+	}
+}
+
+func ClientRateLimitMiddleware(l *ClientRateLimiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if l == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if status, covered := l.take(r); covered {
+			r = reportRateLimit(w, r, status)
+			if !status.allowed {
+				DefaultMetrics.IncCounter("swindlr_rate_limited_total", Labels{"scope": "client"})
+				rejectRateLimited(w, status.retryAfter)
+				return
+			}
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
+
+func SetupClientRateLimiter() *ClientRateLimiter {
+	if !viper.GetBool("client_rate_limiting.enabled") {
+		return nil
+	}
+
+	var config ClientRateLimitConfig
+	if err := viper.UnmarshalKey("client_rate_limiting", &config); err != nil {
+		log.Fatalf("Error parsing client rate limiting configuration: %s", err)
+	}
+	limiter, err := NewClientRateLimiter(config)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+
+	if config.IdleTimeout > 0 {
+		go limiter.StartJanitor(config.IdleTimeout, nil)
+	}
+	if config.Key == "jwt" && jwtVerifier == nil {
+		log.Printf("Warning: no jwt.secret or jwt.public_key_file is set, so clients are limited by IP instead of JWT subject")
+	}
+	log.Printf("Client rate limiting enabled by %s", config.Key)
+	return limiter
+}
@@ -0,0 +1,386 @@
+package loadbalancer
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"golang.org/x/time/rate"
+)
+
+func newTestClientRateLimiter(t *testing.T, config ClientRateLimitConfig) *ClientRateLimiter {
+	limiter, err := NewClientRateLimiter(config)
+	if err != nil {
+		t.Fatalf("Failed to create client rate limiter: %s", err)
+	}
+	return limiter
+}
+
+func requestFrom(remoteAddr, path string) *http.Request {
+	req := httptest.NewRequest("GET", path, nil)
+	req.RemoteAddr = remoteAddr
+	return req
+}
+
+func TestClientRateLimitMiddleware(t *testing.T) {
+	limiter := newTestClientRateLimiter(t, ClientRateLimitConfig{Key: "ip", Rate: 1, Burst: 1})
+	handler := ClientRateLimitMiddleware(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	tests := []struct {
+		remoteAddr string
+		expected   int
+	}{
+		{"10.0.0.1:1234", http.StatusOK},
+		{"10.0.0.1:1235", http.StatusTooManyRequests},
+		// Other clients have their own budget
+		{"10.0.0.2:1234", http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, requestFrom(tt.remoteAddr, "/"))
+		if rr.Code != tt.expected {
+			t.Errorf("Expected status code %d for %s, got %d", tt.expected, tt.remoteAddr, rr.Code)
+		}
+	}
+}
+
+func TestRateLimitResponse(t *testing.T) {
+	SetRateLimitResponse(RateLimitResponse{Status: http.StatusServiceUnavailable, Body: `{"error":"slow down"}`, ContentType: "application/json"})
+	defer SetRateLimitResponse(RateLimitResponse{Status: http.StatusTooManyRequests, Body: "Rate limit exceeded\n", ContentType: "text/plain; charset=utf-8", RetryAfter: true})
+
+	limiter := newTestClientRateLimiter(t, ClientRateLimitConfig{Key: "ip", Rate: 1, Burst: 1})
+	client := ClientRateLimitMiddleware(limiter, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	backend := &Backend{URL: parseURL("http://response.test"), Limiter: rate.NewLimiter(1, 1)}
+	backendLimited := RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), backend)
+
+	// Backend and client limits reject requests as policies do
+	for _, handler := range []http.Handler{client, backendLimited} {
+		handler.ServeHTTP(httptest.NewRecorder(), requestFrom("10.0.0.1:1234", "/"))
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, requestFrom("10.0.0.1:1234", "/"))
+		if rr.Code != http.StatusServiceUnavailable {
+			t.Errorf("Expected the configured status, got %d", rr.Code)
+		}
+		if rr.Body.String() != `{"error":"slow down"}` || rr.Header().Get("Content-Type") != "application/json" {
+			t.Errorf("Expected the configured body, got %q (%s)", rr.Body.String(), rr.Header().Get("Content-Type"))
+		}
+		if rr.Header().Get("Retry-After") != "" {
+			t.Errorf("Expected no Retry-After header, got %q", rr.Header().Get("Retry-After"))
+		}
+	}
+}
+
+func TestClientRateLimitKeys(t *testing.T) {
+	limiter := newTestClientRateLimiter(t, ClientRateLimitConfig{Key: "header", Header: "X-API-Key", Rate: 1, Burst: 1, AllowKeys: []string{"internal"}})
+
+	withKey := func(key string) *http.Request {
+		req := requestFrom("10.0.0.1:1234", "/")
+		req.Header.Set("X-API-Key", key)
+		return req
+	}
+
+	if !limiter.Allow(withKey("a")) || limiter.Allow(withKey("a")) {
+		t.Errorf("Expected the second request with key a to be limited")
+	}
+	if !limiter.Allow(withKey("b")) {
+		t.Errorf("Expected key b to have its own budget")
+	}
+	// Requests without a key are limited by IP
+	if !limiter.Allow(requestFrom("10.0.0.1:1234", "/")) {
+		t.Errorf("Expected the first request without a key to be allowed")
+	}
+	for i := 0; i < 5; i++ {
+		if !limiter.Allow(withKey("internal")) {
+			t.Errorf("Expected allowed key not to be limited")
+		}
+	}
+}
+
+func TestClientRateLimitAllowListsWithKey(t *testing.T) {
+	limiter := newTestClientRateLimiter(t, ClientRateLimitConfig{Key: "header", Header: "X-API-Key", Rate: 1, Burst: 1, AllowIPs: []string{"10.0.0.0/8"}})
+
+	// An allowed address isn't limited because the request also has a key
+	for i := 0; i < 5; i++ {
+		req := requestFrom("10.0.0.1:1234", "/")
+		req.Header.Set("X-API-Key", "a")
+		if !limiter.Allow(req) {
+			t.Errorf("Expected request from an allowed address not to be limited")
+		}
+	}
+
+	req := requestFrom("192.168.0.1:1234", "/")
+	req.Header.Set("X-API-Key", "a")
+	if !limiter.Allow(req) || limiter.Allow(req) {
+		t.Errorf("Expected the second request from another address to be limited")
+	}
+}
+
+func signHS256(secret, header, claims string) string {
+	input := base64.RawURLEncoding.EncodeToString([]byte(header)) + "." + base64.RawURLEncoding.EncodeToString([]byte(claims))
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(input))
+	return input + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func TestJWTSubject(t *testing.T) {
+	header := `{"alg":"HS256","typ":"JWT"}`
+	valid := signHS256("secret", header, `{"sub":"user-1","name":"Test"}`)
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"none"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-1"}`)) + "."
+	expired := signHS256("secret", header, fmt.Sprintf(`{"sub":"user-1","exp":%d}`, time.Now().Add(-time.Hour).Unix()))
+	notYet := signHS256("secret", header, fmt.Sprintf(`{"sub":"user-1","nbf":%d}`, time.Now().Add(time.Hour).Unix()))
+
+	verifier, err := NewJWTVerifier("secret", nil, time.Minute)
+	if err != nil {
+		t.Fatalf("Failed to create JWT verifier: %s", err)
+	}
+
+	tests := []struct {
+		authorization string
+		expected      string
+	}{
+		{"Bearer " + valid, "user-1"},
+		{"Bearer " + signHS256("other", header, `{"sub":"user-1"}`), ""},
+		{"Bearer " + unsigned, ""},
+		{"Bearer " + expired, ""},
+		{"Bearer " + notYet, ""},
+		{"Bearer not-a-token", ""},
+		{"Basic dXNlcjpwYXNz", ""},
+		{"", ""},
+	}
+
+	SetJWTVerifier(verifier)
+	defer SetJWTVerifier(nil)
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("Authorization", tt.authorization)
+		if subject := jwtSubject(req); subject != tt.expected {
+			t.Errorf("Expected subject %q for %q, got %q", tt.expected, tt.authorization, subject)
+		}
+	}
+
+	// Without a verifier tokens aren't trusted
+	SetJWTVerifier(nil)
+	req := httptest.NewRequest("GET", "/", nil)
+	req.Header.Set("Authorization", "Bearer "+valid)
+	if subject := jwtSubject(req); subject != "" {
+		t.Errorf("Expected no subject without a verifier, got %q", subject)
+	}
+}
+
+func TestJWTVerifierPublicKey(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %s", err)
+	}
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		t.Fatalf("Failed to marshal public key: %s", err)
+	}
+	verifier, err := NewJWTVerifier("", pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: der}), 0)
+	if err != nil {
+		t.Fatalf("Failed to create JWT verifier: %s", err)
+	}
+
+	input := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"ES256"}`)) + "." +
+		base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"user-2"}`))
+	digest := sha256.Sum256([]byte(input))
+	r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign token: %s", err)
+	}
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	token := input + "." + base64.RawURLEncoding.EncodeToString(signature)
+
+	if subject, err := verifier.Subject(token, time.Now()); err != nil || subject != "user-2" {
+		t.Errorf("Expected subject user-2, got %q (%v)", subject, err)
+	}
+	// An HS256 token can't be verified with the public key as a secret
+	if _, err := verifier.Subject(signHS256(string(der), `{"alg":"HS256"}`, `{"sub":"user-2"}`), time.Now()); err == nil {
+		t.Errorf("Expected HS256 token to be rejected without a secret")
+	}
+}
+
+func TestClientRateLimitRoutes(t *testing.T) {
+	limiter := newTestClientRateLimiter(t, ClientRateLimitConfig{
+		Key:   "ip",
+		Rate:  1,
+		Burst: 1,
+		Routes: []ClientRateLimitRoute{
+			{PathPrefix: "/api", Rate: 1, Burst: 3},
+			{PathPrefix: "/api/login", Rate: 1, Burst: 1},
+		},
+	})
+
+	allowed := func(path string, n int) int {
+		count := 0
+		for i := 0; i < n; i++ {
+			if limiter.Allow(requestFrom("10.0.0.1:1234", path)) {
+				count++
+			}
+		}
+		return count
+	}
+
+	if count := allowed("/api/users", 5); count != 3 {
+		t.Errorf("Expected 3 requests to /api to be allowed, got %d", count)
+	}
+	if count := allowed("/api/login", 5); count != 1 {
+		t.Errorf("Expected 1 request to /api/login to be allowed, got %d", count)
+	}
+	if count := allowed("/", 5); count != 1 {
+		t.Errorf("Expected 1 request to / to be allowed, got %d", count)
+	}
+}
+
+func TestClientRateLimitAllowIPs(t *testing.T) {
+	limiter := newTestClientRateLimiter(t, ClientRateLimitConfig{Key: "ip", Rate: 1, Burst: 1, AllowIPs: []string{"192.168.0.0/16", "10.0.0.5"}})
+
+	for _, addr := range []string{"192.168.1.1:1234", "10.0.0.5:1234"} {
+		for i := 0; i < 3; i++ {
+			if !limiter.Allow(requestFrom(addr, "/")) {
+				t.Errorf("Expected %s not to be limited", addr)
+			}
+		}
+	}
+	if limiter.Clients() != 0 {
+		t.Errorf("Expected no limiters for allowed clients, got %d", limiter.Clients())
+	}
+}
+
+func TestClientRateLimitBounds(t *testing.T) {
+	limiter := newTestClientRateLimiter(t, ClientRateLimitConfig{Key: "ip", Rate: 1, Burst: 1, MaxClients: 2, IdleTimeout: 50 * time.Millisecond})
+
+	limiter.Allow(requestFrom("10.0.0.1:1234", "/"))
+	limiter.Allow(requestFrom("10.0.0.2:1234", "/"))
+	limiter.Allow(requestFrom("10.0.0.3:1234", "/"))
+	if limiter.Clients() != 2 {
+		t.Errorf("Expected 2 limiters, got %d", limiter.Clients())
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	limiter.Allow(requestFrom("10.0.0.4:1234", "/"))
+	limiter.DeleteIdle()
+	if limiter.Clients() != 1 {
+		t.Errorf("Expected 1 limiter after removing idle ones, got %d", limiter.Clients())
+	}
+}
+
+func TestClientRateLimitValidation(t *testing.T) {
+	configs := []ClientRateLimitConfig{
+		{Key: "cookie", Rate: 1, Burst: 1},
+		{Key: "header", Rate: 1, Burst: 1},
+		{Key: "ip", Rate: 0, Burst: 1},
+		{Key: "ip", Rate: 1, Burst: 1, AllowIPs: []string{"not-an-ip"}},
+		{Key: "ip", Rate: 1, Burst: 1, Routes: []ClientRateLimitRoute{{PathPrefix: "/api"}}},
+	}
+
+	for _, config := range configs {
+		if _, err := NewClientRateLimiter(config); err == nil {
+			t.Errorf("Expected an error for %+v", config)
+		}
+	}
+}
+
+func TestSetupClientRateLimiter(t *testing.T) {
+	viper.Set("client_rate_limiting.enabled", true)
+	viper.Set("client_rate_limiting.key", "ip")
+	viper.Set("client_rate_limiting.rate", 5)
+	viper.Set("client_rate_limiting.burst", 2)
+	viper.Set("client_rate_limiting.idle_timeout", "1m")
+	viper.Set("client_rate_limiting.routes", []map[string]interface{}{{"path_prefix": "/api", "rate": 1, "burst": 1}})
+	defer viper.Set("client_rate_limiting.enabled", false)
+
+	limiter := SetupClientRateLimiter()
+	if limiter.config.Burst != 2 || limiter.config.IdleTimeout != time.Minute || len(limiter.routes) != 1 {
+		t.Errorf("Unexpected configuration: %+v", limiter.config)
+	}
+}
+
+func TestRateLimitHeaders(t *testing.T) {
+	limiter := newTestClientRateLimiter(t, ClientRateLimitConfig{Key: "ip", Rate: 1, Burst: 2})
+	policies := newTestPolicies(t, RateLimitPolicyConfig{
+		Policies: []*RateLimitPolicy{{Name: "hourly", Algorithm: "sliding_window", Limit: 100, Period: time.Hour}},
+		Global:   "hourly",
+		Response: RateLimitResponse{Status: http.StatusTooManyRequests, RetryAfter: true},
+	})
+	handler := ClientRateLimitMiddleware(limiter, RateLimitPolicyMiddleware(policies, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	expected := []struct {
+		status    int
+		remaining string
+	}{
+		{http.StatusOK, "1"},
+		{http.StatusOK, "0"},
+		{http.StatusTooManyRequests, "0"},
+	}
+
+	for i, e := range expected {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, requestFrom("10.0.0.1:1234", "/"))
+		if rr.Code != e.status {
+			t.Errorf("Request %d: expected status code %d, got %d", i, e.status, rr.Code)
+		}
+		// The client limit is closer to being reached than the policy
+		if rr.Header().Get("RateLimit-Limit") != "2" || rr.Header().Get("RateLimit-Remaining") != e.remaining {
+			t.Errorf("Request %d: unexpected RateLimit-Limit %q and RateLimit-Remaining %q", i, rr.Header().Get("RateLimit-Limit"), rr.Header().Get("RateLimit-Remaining"))
+		}
+		if reset := rr.Header().Get("RateLimit-Reset"); reset != "1" && reset != "2" {
+			t.Errorf("Request %d: unexpected RateLimit-Reset %q", i, reset)
+		}
+		if e.status == http.StatusTooManyRequests {
+			if rr.Header().Get("Retry-After") != "1" {
+				t.Errorf("Expected Retry-After 1, got %q", rr.Header().Get("Retry-After"))
+			}
+			continue
+		}
+		policies := rr.Header().Values("RateLimit-Policy")
+		if len(policies) != 2 || policies[0] != "2;w=2" || policies[1] != "100;w=3600" {
+			t.Errorf("Request %d: unexpected RateLimit-Policy %q", i, policies)
+		}
+	}
+}
+
+func TestRateLimitHeadersNotCached(t *testing.T) {
+	viper.Set("use_cache", true)
+	viper.Set("rate_limiting.rate", 10)
+	viper.Set("rate_limiting.bucket_size", 5)
+
+	serverURL, _ := url.Parse("http://example.com")
+	backend := CreateNewBackend(serverURL, NewServerPool(nil))
+	cache := NewCache(time.Minute, NewMemoryStore())
+	handler := CacheMiddleware(cache, RateLimitMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, World!"))
+	}), backend))
+
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Header().Get("RateLimit-Remaining") != "4" {
+		t.Errorf("Expected RateLimit-Remaining 4, got %q", rr.Header().Get("RateLimit-Remaining"))
+	}
+
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, httptest.NewRequest("GET", "/", nil))
+	if rr.Header().Get("X-Swindlr-Cache") != "HIT" || rr.Header().Get("RateLimit-Remaining") != "" {
+		t.Errorf("Expected a cache hit without RateLimit headers, got %q", rr.Header())
+	}
+}
@@ -0,0 +1,326 @@
+package loadbalancer
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisScanCount is the number of keys asked for per SCAN call.
+const redisScanCount = "500"
+
+// redisRecord is a response stored in Redis, along with what's needed to
+// match it against purge selectors.
+type redisRecord struct {
+	Key  string    `json:"key"`
+	Path string    `json:"path"`
+	Vary []string  `json:"vary,omitempty"`
+	Item CacheItem `json:"item"`
+}
+
+// redisMeta lists the headers the variants of a primary key vary on.
+type redisMeta struct {
+	Vary []string `json:"vary,omitempty"`
+}
+
+// RedisStore is a CacheStore shared by all replicas, kept in a server
+// speaking the Redis protocol. Keys expire on the server, so there is no
+// janitor. When the server can't be reached, lookups miss and responses
+// aren't stored.
+type RedisStore struct {
+	client *respClient
+	prefix string
+}
+
+func NewRedisStore(client *respClient, prefix string) *RedisStore {
+	return &RedisStore{client: client, prefix: prefix}
+}
+
+func hashKey(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:16])
+}
+
+func (s *RedisStore) metaKey(key string) string {
+	return s.prefix + "meta:" + hashKey(key)
+}
+
+func (s *RedisStore) itemKey(key, variant string) string {
+	return s.prefix + "item:" + hashKey(key) + ":" + hashKey(variant)
+}
+
+// indexKey is a sorted set of the stored responses' keys, scored by when
+// they expire, so they can be counted without walking the keyspace.
+func (s *RedisStore) indexKey() string {
+	return s.prefix + "index"
+}
+
+// pxMillis formats a TTL for the PX option, which has to be positive.
+func pxMillis(ttl time.Duration) string {
+	return strconv.FormatInt(positiveMillis(ttl), 10)
+}
+
+func positiveMillis(ttl time.Duration) int64 {
+	if ms := ttl.Milliseconds(); ms > 0 {
+		return ms
+	}
+	return 1
+}
+
+func (s *RedisStore) failed(op string, err error) {
+	DefaultMetrics.IncCounter("swindlr_cache_store_errors_total", Labels{"store": "redis", "op": op})
+	log.Printf("Redis cache store %s failed: %s", op, err)
+}
+
+func (s *RedisStore) Get(key string, r *http.Request) (CacheItem, bool) {
+	reply, err := s.client.Do("GET", s.metaKey(key))
+	if err != nil {
+		s.failed("get", err)
+		return CacheItem{}, false
+	}
+	data, _ := reply.([]byte)
+	if data == nil {
+		return CacheItem{}, false
+	}
+	var meta redisMeta
+	if err := json.Unmarshal(data, &meta); err != nil {
+		return CacheItem{}, false
+	}
+
+	reply, err = s.client.Do("GET", s.itemKey(key, varyKey(r, meta.Vary)))
+	if err != nil {
+		s.failed("get", err)
+		return CacheItem{}, false
+	}
+	data, _ = reply.([]byte)
+	if data == nil {
+		return CacheItem{}, false
+	}
+	var record redisRecord
+	if err := json.Unmarshal(data, &record); err != nil {
+		return CacheItem{}, false
+	}
+	return record.Item, true
+}
+
+func (s *RedisStore) Set(key string, r *http.Request, item CacheItem, ttl time.Duration) {
+	vary, wildcard := varyHeaders(item.Header)
+	if wildcard {
+		return
+	}
+
+	record, err := json.Marshal(redisRecord{Key: key, Path: r.URL.Path, Vary: vary, Item: item})
+	if err != nil {
+		return
+	}
+	meta, _ := json.Marshal(redisMeta{Vary: vary})
+
+	// The primary key has to outlive all of its variants. Variants stored
+	// under a different Vary header can't be looked up anymore, so they
+	// are deleted instead.
+	metaTTL := ttl
+	if replies, err := s.client.Pipeline([][]string{{"GET", s.metaKey(key)}, {"PTTL", s.metaKey(key)}}); err == nil {
+		var previous redisMeta
+		data, _ := replies[0].([]byte)
+		if data != nil && json.Unmarshal(data, &previous) == nil && !equalStrings(previous.Vary, vary) {
+			if _, err := s.deleteVariants(key); err != nil {
+				s.failed("set", err)
+			}
+		} else if remaining, ok := replies[1].(int64); ok && time.Duration(remaining)*time.Millisecond > metaTTL {
+			metaTTL = time.Duration(remaining) * time.Millisecond
+		}
+	}
+
+	itemKey := s.itemKey(key, varyKey(r, vary))
+	now := time.Now().UnixMilli()
+	replies, err := s.client.Pipeline([][]string{
+		{"SET", s.metaKey(key), string(meta), "PX", pxMillis(metaTTL)},
+		{"SET", itemKey, string(record), "PX", pxMillis(ttl)},
+		{"ZADD", s.indexKey(), strconv.FormatInt(now+positiveMillis(ttl), 10), itemKey},
+		{"ZREMRANGEBYSCORE", s.indexKey(), "-inf", strconv.FormatInt(now, 10)},
+	})
+	if err == nil {
+		err = firstError(replies)
+	}
+	if err != nil {
+		s.failed("set", err)
+	}
+}
+
+// scan calls fn with batches of the keys matching the pattern.
+func (s *RedisStore) scan(pattern string, fn func(keys []string) error) error {
+	cursor := "0"
+	for {
+		reply, err := s.client.Do("SCAN", cursor, "MATCH", pattern, "COUNT", redisScanCount)
+		if err != nil {
+			return err
+		}
+		values, _ := reply.([]interface{})
+		if len(values) != 2 {
+			return errors.New("unexpected SCAN reply")
+		}
+		next, _ := values[0].([]byte)
+		batch, _ := values[1].([]interface{})
+
+		keys := make([]string, 0, len(batch))
+		for _, key := range batch {
+			if key, ok := key.([]byte); ok {
+				keys = append(keys, string(key))
+			}
+		}
+		if len(keys) > 0 {
+			if err := fn(keys); err != nil {
+				return err
+			}
+		}
+
+		cursor = string(next)
+		if cursor == "0" || cursor == "" {
+			return nil
+		}
+	}
+}
+
+// del deletes the keys, and removes them from the index, and returns how
+// many existed.
+func (s *RedisStore) del(keys []string) (int, error) {
+	replies, err := s.client.Pipeline([][]string{
+		append([]string{"DEL"}, keys...),
+		append([]string{"ZREM", s.indexKey()}, keys...),
+	})
+	if err == nil {
+		err = firstError(replies)
+	}
+	if err != nil {
+		return 0, err
+	}
+	deleted, _ := replies[0].(int64)
+	return int(deleted), nil
+}
+
+// deleteVariants deletes all variants stored under the primary key and
+// returns how many existed.
+func (s *RedisStore) deleteVariants(key string) (int, error) {
+	purged := 0
+	err := s.scan(s.prefix+"item:"+hashKey(key)+":*", func(keys []string) error {
+		deleted, err := s.del(keys)
+		purged += deleted
+		return err
+	})
+	return purged, err
+}
+
+func (s *RedisStore) deleteKey(key string) (int, error) {
+	purged, err := s.deleteVariants(key)
+	if err != nil {
+		return purged, err
+	}
+	_, err = s.del([]string{s.metaKey(key)})
+	return purged, err
+}
+
+func (s *RedisStore) Delete(key string) {
+	if _, err := s.deleteKey(key); err != nil {
+		s.failed("delete", err)
+	}
+}
+
+// Purge walks all stored responses, except when purging by key.
+func (s *RedisStore) Purge(selector PurgeSelector) (int, error) {
+	if selector.Key != "" {
+		purged, err := s.deleteKey(selector.Key)
+		if err != nil {
+			s.failed("purge", err)
+		}
+		DefaultMetrics.AddCounter("swindlr_cache_purged_total", Labels{"mode": "purge"}, float64(purged))
+		return purged, err
+	}
+
+	purged := 0
+	err := s.scan(s.prefix+"item:*", func(keys []string) error {
+		commands := make([][]string, len(keys))
+		for i, key := range keys {
+			commands[i] = []string{"GET", key}
+		}
+		replies, err := s.client.Pipeline(commands)
+		if err != nil {
+			return err
+		}
+
+		var matched []string
+		for i, reply := range replies {
+			data, _ := reply.([]byte)
+			var record redisRecord
+			if data == nil || json.Unmarshal(data, &record) != nil {
+				continue
+			}
+			if selector.matches(&cacheEntry{key: record.Key, path: record.Path, vary: record.Vary}, record.Item) {
+				matched = append(matched, keys[i])
+			}
+		}
+		if len(matched) == 0 {
+			return nil
+		}
+		deleted, err := s.del(matched)
+		purged += deleted
+		return err
+	})
+	if err != nil {
+		s.failed("purge", err)
+	}
+
+	DefaultMetrics.AddCounter("swindlr_cache_purged_total", Labels{"mode": "purge"}, float64(purged))
+	return purged, err
+}
+
+// Ban purges right away, as the replicas don't share a ban list.
+func (s *RedisStore) Ban(selector PurgeSelector) error {
+	_, err := s.Purge(selector)
+	return err
+}
+
+func (s *RedisStore) Flush() int {
+	purged := 0
+	err := s.scan(s.prefix+"*", func(keys []string) error {
+		for _, key := range keys {
+			if strings.HasPrefix(key, s.prefix+"item:") {
+				purged++
+			}
+		}
+		_, err := s.del(keys)
+		return err
+	})
+	if err != nil {
+		s.failed("flush", err)
+	}
+
+	DefaultMetrics.AddCounter("swindlr_cache_purged_total", Labels{"mode": "flush"}, float64(purged))
+	return purged
+}
+
+// Stats only reports the number of stored responses, counted in the
+// index once the expired ones are dropped from it. The other counters are
+// kept by each replica's Cache.
+func (s *RedisStore) Stats() CacheStats {
+	stats := CacheStats{}
+	replies, err := s.client.Pipeline([][]string{
+		{"ZREMRANGEBYSCORE", s.indexKey(), "-inf", strconv.FormatInt(time.Now().UnixMilli(), 10)},
+		{"ZCARD", s.indexKey()},
+	})
+	if err == nil {
+		err = firstError(replies)
+	}
+	if err != nil {
+		s.failed("stats", err)
+		return stats
+	}
+	entries, _ := replies[1].(int64)
+	stats.Entries = int(entries)
+	return stats
+}
@@ -0,0 +1,154 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRedisStore(t *testing.T) {
+	server := newFakeRESPServer(t)
+	store := NewRedisStore(server.client(), "test:")
+	cache := NewCache(1*time.Minute, store)
+
+	req := httptest.NewRequest("GET", "http://swindlr.test/products/1", nil)
+	req.Header.Set("Accept-Language", "en")
+	header := http.Header{"Vary": {"Accept-Language"}, "Surrogate-Key": {"products"}}
+	cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte("hello"), header, time.Now(), time.Now()))
+
+	item, found := cache.Get(cache.Key(req), req)
+	assert.True(t, found)
+	assert.Equal(t, "hello", string(item.Content))
+	assert.Equal(t, []string{"products"}, item.Tags)
+
+	other := req.Clone(req.Context())
+	other.Header.Set("Accept-Language", "de")
+	_, found = cache.Get(cache.Key(other), other)
+	assert.False(t, found)
+	assert.Equal(t, 1, cache.Stats().Entries)
+
+	purged, err := cache.Purge(PurgeSelector{Tag: "products"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+	_, found = cache.Get(cache.Key(req), req)
+	assert.False(t, found)
+
+	cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte("hello"), header, time.Now(), time.Now()))
+	purged, err = cache.Purge(PurgeSelector{URL: "http://swindlr.test/products/1"})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, purged)
+
+	cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte("hello"), header, time.Now(), time.Now()))
+	store.Delete(cache.Key(req))
+	_, found = cache.Get(cache.Key(req), req)
+	assert.False(t, found)
+
+	cache.Set(cache.Key(req), req, cache.NewCacheItem(http.StatusOK, []byte("hello"), header, time.Now(), time.Now()))
+	assert.Equal(t, 1, cache.Flush())
+	assert.Equal(t, 0, cache.Stats().Entries)
+}
+
+func TestRedisStoreVaryChange(t *testing.T) {
+	server := newFakeRESPServer(t)
+	store := NewRedisStore(server.client(), "test:")
+	cache := NewCache(1*time.Minute, store)
+
+	en := httptest.NewRequest("GET", "http://swindlr.test/products/1", nil)
+	en.Header.Set("Accept-Language", "en")
+	de := en.Clone(en.Context())
+	de.Header.Set("Accept-Language", "de")
+	byLanguage := http.Header{"Vary": {"Accept-Language"}}
+	cache.Set(cache.Key(en), en, cache.NewCacheItem(http.StatusOK, []byte("hello"), byLanguage, time.Now(), time.Now()))
+	cache.Set(cache.Key(de), de, cache.NewCacheItem(http.StatusOK, []byte("hallo"), byLanguage, time.Now(), time.Now()))
+	assert.Equal(t, 2, cache.Stats().Entries)
+
+	// The variants stored under the previous Vary header are deleted
+	cache.Set(cache.Key(en), en, cache.NewCacheItem(http.StatusOK, []byte("hello"), http.Header{}, time.Now(), time.Now()))
+	assert.Equal(t, 1, cache.Stats().Entries)
+	server.mux.Lock()
+	items := 0
+	for key := range server.data {
+		if strings.HasPrefix(key, "test:item:") {
+			items++
+		}
+	}
+	server.mux.Unlock()
+	assert.Equal(t, 1, items)
+}
+
+func TestRedisStoreStats(t *testing.T) {
+	server := newFakeRESPServer(t)
+	store := NewRedisStore(server.client(), "test:")
+
+	req := httptest.NewRequest("GET", "http://swindlr.test/", nil)
+	store.Set("a", req, CacheItem{Content: []byte("a")}, time.Minute)
+	store.Set("b", req, CacheItem{Content: []byte("b")}, 50*time.Millisecond)
+	// Storing a response again doesn't count it twice
+	store.Set("a", req, CacheItem{Content: []byte("a")}, time.Minute)
+	assert.Equal(t, 2, store.Stats().Entries)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 1, store.Stats().Entries)
+
+	store.Delete("a")
+	assert.Equal(t, 0, store.Stats().Entries)
+
+	// Counting the responses doesn't walk the keyspace
+	server.mux.Lock()
+	scans := server.scans
+	server.mux.Unlock()
+	store.Stats()
+	server.mux.Lock()
+	assert.Equal(t, scans, server.scans)
+	server.mux.Unlock()
+}
+
+func TestRedisStoreSharedBetweenReplicas(t *testing.T) {
+	viper.Set("use_cache", true)
+	server := newFakeRESPServer(t)
+
+	var upstream int32
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&upstream, 1)
+		w.Header().Set("Cache-Control", "max-age=60")
+		w.Write([]byte("Hello, World!"))
+	})
+
+	first := CacheMiddleware(NewCache(1*time.Minute, NewRedisStore(server.client(), "swindlr:cache:")), handler)
+	second := CacheMiddleware(NewCache(1*time.Minute, NewRedisStore(server.client(), "swindlr:cache:")), handler)
+
+	rr := httptest.NewRecorder()
+	first.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+
+	rr = httptest.NewRecorder()
+	second.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+	assert.Equal(t, "HIT", rr.Header().Get("X-Swindlr-Cache"))
+	assert.Equal(t, "Hello, World!", rr.Body.String())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&upstream))
+}
+
+func TestRedisStoreUnavailable(t *testing.T) {
+	viper.Set("use_cache", true)
+	server := newFakeRESPServer(t)
+	server.listener.Close()
+
+	cache := NewCache(1*time.Minute, NewRedisStore(newRESPClient(server.Addr(), "", 0, 100*time.Millisecond, 1), "swindlr:cache:"))
+	handler := CacheMiddleware(cache, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("Hello, World!"))
+	}))
+
+	// Requests still go through, uncached
+	for i := 0; i < 2; i++ {
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, httptest.NewRequest("GET", "/test", nil))
+		assert.Equal(t, "MISS", rr.Header().Get("X-Swindlr-Cache"))
+		assert.Equal(t, "Hello, World!", rr.Body.String())
+	}
+}
@@ -0,0 +1,287 @@
+package loadbalancer
+
+import (
+	"bufio"
+	"net"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type fakeRESPValue struct {
+	value string
+	// members holds the scores of a sorted set
+	members  map[string]float64
+	expireAt time.Time
+}
+
+// fakeRESPServer is an in-process stand-in for Redis that implements
+// the commands swindlr uses.
+type fakeRESPServer struct {
+	listener net.Listener
+	data     map[string]*fakeRESPValue
+	// scans counts SCAN commands
+	scans int
+	mux   sync.Mutex
+}
+
+func newFakeRESPServer(t *testing.T) *fakeRESPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Error starting fake RESP server: %s", err)
+	}
+	s := &fakeRESPServer{listener: listener, data: make(map[string]*fakeRESPValue)}
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return s
+}
+
+func (s *fakeRESPServer) Addr() string {
+	return s.listener.Addr().String()
+}
+
+func (s *fakeRESPServer) client() *respClient {
+	return newRESPClient(s.Addr(), "", 0, time.Second, 4)
+}
+
+func (s *fakeRESPServer) serve(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	for {
+		reply, err := readReply(reader)
+		if err != nil {
+			return
+		}
+		values, _ := reply.([]interface{})
+		args := make([]string, len(values))
+		for i, v := range values {
+			b, _ := v.([]byte)
+			args[i] = string(b)
+		}
+		s.execute(writer, args)
+		if writer.Flush() != nil {
+			return
+		}
+	}
+}
+
+// lookup returns the live value of the key. It must be called with the
+// lock held.
+func (s *fakeRESPServer) lookup(key string) *fakeRESPValue {
+	v, found := s.data[key]
+	if !found {
+		return nil
+	}
+	if !v.expireAt.IsZero() && time.Now().After(v.expireAt) {
+		delete(s.data, key)
+		return nil
+	}
+	return v
+}
+
+func writeBulk(w *bufio.Writer, value string) {
+	w.WriteString("$" + strconv.Itoa(len(value)) + "\r\n" + value + "\r\n")
+}
+
+func (s *fakeRESPServer) execute(w *bufio.Writer, args []string) {
+	s.mux.Lock()
+	defer s.mux.Unlock()
+
+	if len(args) == 0 {
+		w.WriteString("-ERR empty command\r\n")
+		return
+	}
+
+	switch strings.ToUpper(args[0]) {
+	case "PING", "AUTH", "SELECT":
+		w.WriteString("+OK\r\n")
+	case "GET":
+		if v := s.lookup(args[1]); v != nil {
+			writeBulk(w, v.value)
+		} else {
+			w.WriteString("$-1\r\n")
+		}
+	case "SET":
+		v := &fakeRESPValue{value: args[2]}
+		if len(args) == 5 && strings.ToUpper(args[3]) == "PX" {
+			ms, err := strconv.ParseInt(args[4], 10, 64)
+			if err != nil || ms <= 0 {
+				w.WriteString("-ERR invalid expire time in 'set' command\r\n")
+				return
+			}
+			v.expireAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+		}
+		s.data[args[1]] = v
+		w.WriteString("+OK\r\n")
+	case "DEL":
+		deleted := 0
+		for _, key := range args[1:] {
+			if s.lookup(key) != nil {
+				delete(s.data, key)
+				deleted++
+			}
+		}
+		w.WriteString(":" + strconv.Itoa(deleted) + "\r\n")
+	case "INCRBY":
+		v := s.lookup(args[1])
+		if v == nil {
+			v = &fakeRESPValue{value: "0"}
+			s.data[args[1]] = v
+		}
+		current, err := strconv.ParseInt(v.value, 10, 64)
+		increment, err2 := strconv.ParseInt(args[2], 10, 64)
+		if err != nil || err2 != nil {
+			w.WriteString("-ERR value is not an integer or out of range\r\n")
+			return
+		}
+		v.value = strconv.FormatInt(current+increment, 10)
+		w.WriteString(":" + v.value + "\r\n")
+	case "PEXPIRE":
+		v := s.lookup(args[1])
+		ms, err := strconv.ParseInt(args[2], 10, 64)
+		switch {
+		case err != nil:
+			w.WriteString("-ERR value is not an integer or out of range\r\n")
+		case v == nil:
+			w.WriteString(":0\r\n")
+		default:
+			v.expireAt = time.Now().Add(time.Duration(ms) * time.Millisecond)
+			w.WriteString(":1\r\n")
+		}
+	case "PTTL":
+		v := s.lookup(args[1])
+		switch {
+		case v == nil:
+			w.WriteString(":-2\r\n")
+		case v.expireAt.IsZero():
+			w.WriteString(":-1\r\n")
+		default:
+			w.WriteString(":" + strconv.FormatInt(time.Until(v.expireAt).Milliseconds(), 10) + "\r\n")
+		}
+	case "ZADD":
+		v := s.lookup(args[1])
+		if v == nil {
+			v = &fakeRESPValue{members: make(map[string]float64)}
+			s.data[args[1]] = v
+		}
+		added := 0
+		for i := 2; i+1 < len(args); i += 2 {
+			score, err := strconv.ParseFloat(args[i], 64)
+			if err != nil {
+				w.WriteString("-ERR value is not a valid float\r\n")
+				return
+			}
+			if _, found := v.members[args[i+1]]; !found {
+				added++
+			}
+			v.members[args[i+1]] = score
+		}
+		w.WriteString(":" + strconv.Itoa(added) + "\r\n")
+	case "ZREM", "ZREMRANGEBYSCORE":
+		removed := 0
+		if v := s.lookup(args[1]); v != nil {
+			for member, score := range v.members {
+				remove := false
+				if strings.ToUpper(args[0]) == "ZREM" {
+					for _, m := range args[2:] {
+						remove = remove || m == member
+					}
+				} else {
+					min, _ := strconv.ParseFloat(args[2], 64)
+					max, _ := strconv.ParseFloat(args[3], 64)
+					remove = score >= min && score <= max
+				}
+				if remove {
+					delete(v.members, member)
+					removed++
+				}
+			}
+		}
+		w.WriteString(":" + strconv.Itoa(removed) + "\r\n")
+	case "ZCARD":
+		count := 0
+		if v := s.lookup(args[1]); v != nil {
+			count = len(v.members)
+		}
+		w.WriteString(":" + strconv.Itoa(count) + "\r\n")
+	case "SCAN":
+		s.scans++
+		// Everything is returned in one batch
+		pattern := "*"
+		for i := 2; i+1 < len(args); i += 2 {
+			if strings.ToUpper(args[i]) == "MATCH" {
+				pattern = args[i+1]
+			}
+		}
+		var keys []string
+		for key := range s.data {
+			if matched, _ := path.Match(pattern, key); matched && s.lookup(key) != nil {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		w.WriteString("*2\r\n")
+		writeBulk(w, "0")
+		w.WriteString("*" + strconv.Itoa(len(keys)) + "\r\n")
+		for _, key := range keys {
+			writeBulk(w, key)
+		}
+	default:
+		w.WriteString("-ERR unknown command '" + args[0] + "'\r\n")
+	}
+}
+
+func TestRESPClient(t *testing.T) {
+	server := newFakeRESPServer(t)
+	client := server.client()
+
+	reply, err := client.Do("SET", "greeting", "hello\r\nworld")
+	assert.NoError(t, err)
+	assert.Equal(t, "OK", reply)
+
+	reply, err = client.Do("GET", "greeting")
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("hello\r\nworld"), reply)
+
+	reply, err = client.Do("GET", "missing")
+	assert.NoError(t, err)
+	assert.Nil(t, reply)
+
+	_, err = client.Do("NOPE")
+	assert.EqualError(t, err, "ERR unknown command 'NOPE'")
+
+	replies, err := client.Pipeline([][]string{
+		{"SET", "a", "1"},
+		{"DEL", "a", "b"},
+		{"PTTL", "a"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []interface{}{"OK", int64(1), int64(-2)}, replies)
+}
+
+func TestRESPClientUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	client := newRESPClient(address, "", 0, 100*time.Millisecond, 1)
+	_, err = client.Do("PING")
+	assert.Error(t, err)
+}
@@ -0,0 +1,318 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/mitchellh/mapstructure"
+	"github.com/spf13/viper"
+)
+
+const DefaultPoolName = "default"
+
+// BackendConfig describes a backend in the configuration. A plain URL
+// string is accepted as well, for backends without any extra settings.
+type BackendConfig struct {
+	URL            string   `mapstructure:"url"`
+	Tags           []string `mapstructure:"tags"`
+	Region         string   `mapstructure:"region"`
+	Zone           string   `mapstructure:"zone"`
+	MaxConnections int      `mapstructure:"max_connections"`
+}
+
+type PoolConfig struct {
+	Strategy       string          `mapstructure:"strategy"`
+	Backends       []BackendConfig `mapstructure:"backends"`
+	MaxConnections int             `mapstructure:"max_connections"`
+}
+
+type SplitConfig struct {
+	Name       string        `mapstructure:"name"`
+	PathPrefix string        `mapstructure:"path_prefix"`
+	HashOn     string        `mapstructure:"hash_on"`
+	HashKey    string        `mapstructure:"hash_key"`
+	Weights    []SplitWeight `mapstructure:"weights"`
+}
+
+// Router picks the server pool a request is sent to. Routing rules are
+// evaluated first, in order, then requests that match a traffic split are
+// divided between the split's pools. Everything else goes to the default
+// pool.
+type Router struct {
+	pools  map[string]*ServerPool
+	rules  []*RoutingRule
+	splits []*TrafficSplit
+	mux    sync.RWMutex
+}
+
+func NewRouter(defaultPool *ServerPool) *Router {
+	return &Router{
+		pools: map[string]*ServerPool{DefaultPoolName: defaultPool},
+	}
+}
+
+func (rt *Router) AddPool(name string, sp *ServerPool) {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	rt.pools[name] = sp
+}
+
+func (rt *Router) Pool(name string) *ServerPool {
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+	return rt.pools[name]
+}
+
+func (rt *Router) Pools() map[string]*ServerPool {
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+	pools := make(map[string]*ServerPool, len(rt.pools))
+	for name, sp := range rt.pools {
+		pools[name] = sp
+	}
+	return pools
+}
+
+func (rt *Router) AddSplit(split *TrafficSplit) error {
+	if err := rt.checkPools(split.Weights()); err != nil {
+		return err
+	}
+
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+	for _, s := range rt.splits {
+		if s.Name == split.Name {
+			return fmt.Errorf("split %s already exists", split.Name)
+		}
+	}
+	rt.splits = append(rt.splits, split)
+	return nil
+}
+
+func (rt *Router) Splits() []*TrafficSplit {
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+	return append([]*TrafficSplit(nil), rt.splits...)
+}
+
+func (rt *Router) SetSplitWeights(name string, weights []SplitWeight) error {
+	if err := rt.checkPools(weights); err != nil {
+		return err
+	}
+
+	for _, split := range rt.Splits() {
+		if split.Name == name {
+			return split.SetWeights(weights)
+		}
+	}
+	return fmt.Errorf("split not found with name %s", name)
+}
+
+func (rt *Router) checkPools(weights []SplitWeight) error {
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+	for _, w := range weights {
+		if _, ok := rt.pools[w.Pool]; !ok {
+			return fmt.Errorf("pool not found with name %s", w.Pool)
+		}
+	}
+	return nil
+}
+
+func (rt *Router) Rules() []*RoutingRule {
+	rt.mux.RLock()
+	defer rt.mux.RUnlock()
+	return append([]*RoutingRule(nil), rt.rules...)
+}
+
+func (rt *Router) checkRule(rule *RoutingRule) error {
+	if err := rule.Compile(); err != nil {
+		return err
+	}
+	if rule.Pool != "" {
+		if _, ok := rt.pools[rule.Pool]; !ok {
+			return fmt.Errorf("pool not found with name %s", rule.Pool)
+		}
+	}
+	for _, existing := range rt.rules {
+		if existing.Name == rule.Name {
+			return fmt.Errorf("routing rule %s already exists", rule.Name)
+		}
+	}
+	return nil
+}
+
+// AddRule inserts the rule at the given position, or appends it when the
+// position is out of range.
+func (rt *Router) AddRule(rule *RoutingRule, position int) error {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+
+	if err := rt.checkRule(rule); err != nil {
+		return err
+	}
+
+	if position < 0 || position >= len(rt.rules) {
+		rt.rules = append(rt.rules, rule)
+		return nil
+	}
+	rt.rules = append(rt.rules[:position], append([]*RoutingRule{rule}, rt.rules[position:]...)...)
+	return nil
+}
+
+func (rt *Router) RemoveRule(name string) error {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+
+	for i, rule := range rt.rules {
+		if rule.Name == name {
+			rt.rules = append(rt.rules[:i], rt.rules[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("routing rule not found with name %s", name)
+}
+
+// SetRules replaces all routing rules. Nothing is changed if any of the
+// new rules is invalid.
+func (rt *Router) SetRules(rules []*RoutingRule) error {
+	rt.mux.Lock()
+	defer rt.mux.Unlock()
+
+	previous := rt.rules
+	rt.rules = nil
+	for _, rule := range rules {
+		if err := rt.checkRule(rule); err != nil {
+			rt.rules = previous
+			return err
+		}
+		rt.rules = append(rt.rules, rule)
+	}
+	return nil
+}
+
+// Route returns the pool for the request. The name of the pool is stored
+// in the returned request's context, along with the tags when the request
+// is routed to a tagged subset of the pool.
+func (rt *Router) Route(r *http.Request) (*ServerPool, *http.Request) {
+	name, r := rt.route(r)
+	return rt.Pool(name), r.WithContext(context.WithValue(r.Context(), PoolKey, name))
+}
+
+func (rt *Router) route(r *http.Request) (string, *http.Request) {
+	for _, rule := range rt.Rules() {
+		if !rule.Matches(r) {
+			continue
+		}
+		poolName := rule.Pool
+		if poolName == "" {
+			poolName = DefaultPoolName
+		}
+		if rt.Pool(poolName) != nil {
+			return poolName, withTags(r, rule.Tags)
+		}
+	}
+
+	for _, split := range rt.Splits() {
+		if split.Matches(r) {
+			if poolName := split.PickPool(r); rt.Pool(poolName) != nil {
+				return poolName, r
+			}
+		}
+	}
+	return DefaultPoolName, r
+}
+
+func GetPoolFromContext(r *http.Request) string {
+	if pool, ok := r.Context().Value(PoolKey).(string); ok {
+		return pool
+	}
+	return ""
+}
+
+// BackendConfigs reads a list of backends from the configuration.
+func BackendConfigs(key string) []BackendConfig {
+	var backends []BackendConfig
+	if err := viper.UnmarshalKey(key, &backends, viper.DecodeHook(backendConfigHook())); err != nil {
+		log.Fatalf("Error parsing %s: %s", key, err)
+	}
+	return backends
+}
+
+func backendConfigHook() mapstructure.DecodeHookFunc {
+	return mapstructure.ComposeDecodeHookFunc(
+		mapstructure.StringToTimeDurationHookFunc(),
+		mapstructure.StringToSliceHookFunc(","),
+		func(from reflect.Type, to reflect.Type, data interface{}) (interface{}, error) {
+			if from.Kind() == reflect.String && to == reflect.TypeOf(BackendConfig{}) {
+				return BackendConfig{URL: data.(string)}, nil
+			}
+			return data, nil
+		},
+	)
+}
+
+func SetupRouter(defaultPool *ServerPool) *Router {
+	router := NewRouter(defaultPool)
+
+	var pools map[string]PoolConfig
+	if err := viper.UnmarshalKey("pools", &pools, viper.DecodeHook(backendConfigHook())); err != nil {
+		log.Fatalf("Error parsing pools: %s", err)
+	}
+
+	// Sort the names so pools are always set up in the same order
+	names := make([]string, 0, len(pools))
+	for name := range pools {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == DefaultPoolName {
+			log.Fatalf("Pool name '%s' is reserved for the top level backends", DefaultPoolName)
+		}
+		strategy := pools[name].Strategy
+		if strategy == "" {
+			strategy = viper.GetString("load_balancer.strategy")
+		}
+		pool := SetupServerPool(pools[name].Backends, strategy)
+		pool.SetMaxConnections(pools[name].MaxConnections)
+		router.AddPool(name, pool)
+		log.Printf("Pool '%s' set up with %d backends", name, len(pools[name].Backends))
+	}
+
+	var splits []SplitConfig
+	if err := viper.UnmarshalKey("traffic_splits", &splits); err != nil {
+		log.Fatalf("Error parsing traffic splits: %s", err)
+	}
+
+	for _, cfg := range splits {
+		split, err := NewTrafficSplit(cfg.Name, cfg.PathPrefix, cfg.HashOn, cfg.HashKey, cfg.Weights)
+		if err != nil {
+			log.Fatalf("Error setting up traffic split: %s", err)
+		}
+		if err := router.AddSplit(split); err != nil {
+			log.Fatalf("Error setting up traffic split: %s", err)
+		}
+		log.Printf("Traffic split '%s' set up for path prefix '%s'", cfg.Name, cfg.PathPrefix)
+	}
+
+	var rules []*RoutingRule
+	if err := viper.UnmarshalKey("routing_rules", &rules); err != nil {
+		log.Fatalf("Error parsing routing rules: %s", err)
+	}
+
+	if err := router.SetRules(rules); err != nil {
+		log.Fatalf("Error setting up routing rules: %s", err)
+	}
+	if len(rules) > 0 {
+		log.Printf("Loaded %d routing rules", len(rules))
+	}
+
+	return router
+}
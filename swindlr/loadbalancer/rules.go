@@ -0,0 +1,238 @@
+package loadbalancer
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/viper"
+)
+
+// Matcher checks a single property of a request. Source is one of header,
+// cookie, query or cidr. For the first three, Match is one of exact, prefix,
+// regex or present and Name selects the header, cookie or query parameter.
+// For cidr, Value is the network the client address has to belong to.
+type Matcher struct {
+	Source  string `json:"source" mapstructure:"source"`
+	Name    string `json:"name" mapstructure:"name"`
+	Match   string `json:"match" mapstructure:"match"`
+	Value   string `json:"value" mapstructure:"value"`
+	re      *regexp.Regexp
+	network *net.IPNet
+}
+
+// RoutingRule sends requests matching all of its matchers to Pool, or to
+// the backends of the pool carrying all of Tags.
+type RoutingRule struct {
+	Name     string    `json:"name" mapstructure:"name"`
+	Matchers []Matcher `json:"matchers" mapstructure:"matchers"`
+	Pool     string    `json:"pool" mapstructure:"pool"`
+	Tags     []string  `json:"tags" mapstructure:"tags"`
+}
+
+func (m *Matcher) compile() error {
+	switch m.Source {
+	case "cidr":
+		_, network, err := net.ParseCIDR(m.Value)
+		if err != nil {
+			return fmt.Errorf("invalid cidr %q: %w", m.Value, err)
+		}
+		m.network = network
+		return nil
+	case "header", "cookie", "query":
+	default:
+		return fmt.Errorf("invalid matcher source %q", m.Source)
+	}
+
+	if m.Name == "" {
+		return fmt.Errorf("%s matcher has no name", m.Source)
+	}
+
+	switch m.Match {
+	case "exact", "prefix", "present":
+	case "regex":
+		re, err := regexp.Compile(m.Value)
+		if err != nil {
+			return fmt.Errorf("invalid regex %q: %w", m.Value, err)
+		}
+		m.re = re
+	default:
+		return fmt.Errorf("invalid match type %q", m.Match)
+	}
+	return nil
+}
+
+func (m *Matcher) Matches(r *http.Request) bool {
+	if m.Source == "cidr" {
+		ip := clientIP(r)
+		return ip != nil && m.network.Contains(ip)
+	}
+
+	value, present := m.lookup(r)
+	if !present {
+		return false
+	}
+
+	switch m.Match {
+	case "exact":
+		return value == m.Value
+	case "prefix":
+		return strings.HasPrefix(value, m.Value)
+	case "regex":
+		return m.re.MatchString(value)
+	case "present":
+		return true
+	}
+	return false
+}
+
+func (m *Matcher) lookup(r *http.Request) (string, bool) {
+	switch m.Source {
+	case "header":
+		values, ok := r.Header[http.CanonicalHeaderKey(m.Name)]
+		if !ok || len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	case "cookie":
+		cookie, err := r.Cookie(m.Name)
+		if err != nil {
+			return "", false
+		}
+		return cookie.Value, true
+	case "query":
+		values, ok := r.URL.Query()[m.Name]
+		if !ok || len(values) == 0 {
+			return "", false
+		}
+		return values[0], true
+	}
+	return "", false
+}
+
+func (rule *RoutingRule) Compile() error {
+	if rule.Name == "" {
+		return fmt.Errorf("routing rule has no name")
+	}
+	if len(rule.Matchers) == 0 {
+		return fmt.Errorf("routing rule %s has no matchers", rule.Name)
+	}
+	if rule.Pool == "" && len(rule.Tags) == 0 {
+		return fmt.Errorf("routing rule %s has neither a pool nor tags", rule.Name)
+	}
+
+	for i := range rule.Matchers {
+		if err := rule.Matchers[i].compile(); err != nil {
+			return fmt.Errorf("routing rule %s: %w", rule.Name, err)
+		}
+	}
+	return nil
+}
+
+func (rule *RoutingRule) Matches(r *http.Request) bool {
+	for i := range rule.Matchers {
+		if !rule.Matchers[i].Matches(r) {
+			return false
+		}
+	}
+	return true
+}
+
+func GetTagsFromContext(r *http.Request) []string {
+	if tags, ok := r.Context().Value(TagsKey).([]string); ok {
+		return tags
+	}
+	return nil
+}
+
+func withTags(r *http.Request, tags []string) *http.Request {
+	if len(tags) == 0 {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), TagsKey, tags))
+}
+
+// trustedProxies are the networks of the proxies in front of swindlr.
+// Requests they forward are attributed to the address they add to
+// X-Forwarded-For.
+var trustedProxies []*net.IPNet
+
+// parseNetworks parses CIDR networks. Plain addresses are taken as
+// networks of a single address.
+func parseNetworks(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, value := range values {
+		value = strings.TrimSpace(value)
+		if !strings.Contains(value, "/") {
+			if ip := net.ParseIP(value); ip != nil && ip.To4() != nil {
+				value += "/32"
+			} else {
+				value += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q: %w", value, err)
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func SetTrustedProxies(values []string) error {
+	networks, err := parseNetworks(values)
+	if err != nil {
+		return err
+	}
+	trustedProxies = networks
+	return nil
+}
+
+func SetupTrustedProxies() {
+	if err := SetTrustedProxies(viper.GetStringSlice("trusted_proxies")); err != nil {
+		log.Fatalf("Error parsing trusted proxies: %s", err)
+	}
+}
+
+// clientIP returns the address of the client. For requests from trusted
+// proxies, X-Forwarded-For is walked from the nearest hop, and the first
+// address that isn't a trusted proxy is the client's.
+func clientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !containsIP(trustedProxies, ip) {
+		return ip
+	}
+
+	var hops []string
+	for _, line := range r.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(line, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !containsIP(trustedProxies, hop) {
+			break
+		}
+	}
+	return ip
+}
@@ -0,0 +1,170 @@
+package loadbalancer
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func TestMatchers(t *testing.T) {
+	req := httptest.NewRequest("GET", "http://swindlr.test/path?version=beta-2", nil)
+	req.RemoteAddr = "10.1.2.3:5555"
+	req.Header.Set("X-Tenant", "enterprise")
+	req.AddCookie(&http.Cookie{Name: "beta", Value: "1"})
+
+	tests := []struct {
+		name    string
+		matcher Matcher
+		want    bool
+	}{
+		{"header exact", Matcher{Source: "header", Name: "X-Tenant", Match: "exact", Value: "enterprise"}, true},
+		{"header exact mismatch", Matcher{Source: "header", Name: "X-Tenant", Match: "exact", Value: "free"}, false},
+		{"header prefix", Matcher{Source: "header", Name: "x-tenant", Match: "prefix", Value: "enter"}, true},
+		{"header missing", Matcher{Source: "header", Name: "X-Other", Match: "present"}, false},
+		{"cookie present", Matcher{Source: "cookie", Name: "beta", Match: "present"}, true},
+		{"query regex", Matcher{Source: "query", Name: "version", Match: "regex", Value: `^beta-\d+$`}, true},
+		{"cidr inside", Matcher{Source: "cidr", Value: "10.0.0.0/8"}, true},
+		{"cidr outside", Matcher{Source: "cidr", Value: "192.168.0.0/16"}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.matcher.compile(); err != nil {
+				t.Fatalf("Failed to compile matcher: %v", err)
+			}
+			if got := tt.matcher.Matches(req); got != tt.want {
+				t.Errorf("Expected %t, got %t", tt.want, got)
+			}
+		})
+	}
+}
+
+func TestRoutingRuleValidation(t *testing.T) {
+	invalid := []RoutingRule{
+		{Name: "no-matchers", Pool: "default"},
+		{Name: "no-target", Matchers: []Matcher{{Source: "header", Name: "X-Tenant", Match: "present"}}},
+		{Name: "bad-source", Pool: "default", Matchers: []Matcher{{Source: "body", Name: "x", Match: "present"}}},
+		{Name: "bad-regex", Pool: "default", Matchers: []Matcher{{Source: "header", Name: "x", Match: "regex", Value: "("}}},
+		{Name: "bad-cidr", Pool: "default", Matchers: []Matcher{{Source: "cidr", Value: "10.0.0.0"}}},
+	}
+
+	for _, rule := range invalid {
+		if err := rule.Compile(); err == nil {
+			t.Errorf("Expected rule %s to be invalid", rule.Name)
+		}
+	}
+}
+
+func TestRouterRules(t *testing.T) {
+	viper.Set("use_sticky_sessions", false)
+
+	defaultPool := NewServerPool(&RoundRobin{})
+	shared := &Backend{URL: parseURL("http://shared.test"), Alive: true}
+	dedicated := &Backend{URL: parseURL("http://dedicated.test"), Alive: true, Tags: []string{"enterprise"}}
+	defaultPool.AddBackend(shared)
+	defaultPool.AddBackend(dedicated)
+
+	betaPool := NewServerPool(&RoundRobin{})
+	betaPool.AddBackend(&Backend{URL: parseURL("http://beta.test"), Alive: true})
+
+	router := NewRouter(defaultPool)
+	router.AddPool("beta", betaPool)
+
+	err := router.SetRules([]*RoutingRule{
+		{Name: "enterprise", Tags: []string{"enterprise"}, Matchers: []Matcher{{Source: "header", Name: "X-Tenant", Match: "exact", Value: "enterprise"}}},
+		{Name: "beta", Pool: "beta", Matchers: []Matcher{{Source: "cookie", Name: "beta", Match: "present"}}},
+	})
+	if err != nil {
+		t.Fatalf("Failed to set rules: %v", err)
+	}
+
+	// Both rules match, the first one wins
+	req := httptest.NewRequest("GET", "http://swindlr.test/", nil)
+	req.Header.Set("X-Tenant", "enterprise")
+	req.AddCookie(&http.Cookie{Name: "beta", Value: "1"})
+
+	sp, routed := router.Route(req)
+	if sp != defaultPool {
+		t.Fatalf("Expected the default pool for the enterprise rule")
+	}
+	for i := 0; i < 4; i++ {
+		if peer := sp.GetNextPeer(routed); peer != dedicated {
+			t.Errorf("Expected only the tagged backend, got %v", peer.URL)
+		}
+	}
+
+	if err := router.RemoveRule("enterprise"); err != nil {
+		t.Fatalf("Failed to remove rule: %v", err)
+	}
+	if sp, _ := router.Route(req); sp != betaPool {
+		t.Errorf("Expected the beta pool once the enterprise rule is removed")
+	}
+
+	plain := httptest.NewRequest("GET", "http://swindlr.test/", nil)
+	if sp, _ := router.Route(plain); sp != defaultPool {
+		t.Errorf("Expected the default pool when no rule matches")
+	}
+
+	err = router.AddRule(&RoutingRule{Name: "broken", Pool: "missing", Matchers: []Matcher{{Source: "cookie", Name: "x", Match: "present"}}}, 0)
+	if err == nil {
+		t.Error("Expected an error for a rule pointing at an unknown pool")
+	}
+}
+
+func TestBackendConfigs(t *testing.T) {
+	viper.Set("test_backends", []interface{}{
+		"http://plain.test",
+		map[string]interface{}{"url": "http://tagged.test", "tags": []interface{}{"enterprise"}},
+	})
+	defer viper.Set("test_backends", nil)
+
+	backends := BackendConfigs("test_backends")
+	if len(backends) != 2 {
+		t.Fatalf("Expected 2 backends, got %d", len(backends))
+	}
+	if backends[0].URL != "http://plain.test" {
+		t.Errorf("Expected plain URL to be parsed, got %q", backends[0].URL)
+	}
+	if backends[1].URL != "http://tagged.test" || len(backends[1].Tags) != 1 || backends[1].Tags[0] != "enterprise" {
+		t.Errorf("Expected tagged backend to be parsed, got %+v", backends[1])
+	}
+}
+
+func TestClientIPTrustedProxies(t *testing.T) {
+	if err := SetTrustedProxies([]string{"10.0.0.0/8", "192.168.1.1"}); err != nil {
+		t.Fatalf("Failed to set trusted proxies: %s", err)
+	}
+	defer SetTrustedProxies(nil)
+
+	tests := []struct {
+		remoteAddr   string
+		forwardedFor []string
+		expected     string
+	}{
+		// Untrusted peers can't claim another address
+		{"203.0.113.1:1234", []string{"198.51.100.1"}, "203.0.113.1"},
+		{"10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1"},
+		// Addresses added by the client before the trusted hops are ignored
+		{"10.0.0.1:1234", []string{"1.2.3.4, 198.51.100.1, 192.168.1.1"}, "198.51.100.1"},
+		{"10.0.0.1:1234", []string{"1.2.3.4", "198.51.100.1, 10.0.0.2"}, "198.51.100.1"},
+		{"10.0.0.1:1234", nil, "10.0.0.1"},
+		{"10.0.0.1:1234", []string{"garbage, 198.51.100.1"}, "198.51.100.1"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = tt.remoteAddr
+		for _, value := range tt.forwardedFor {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+		if ip := clientIP(req); ip.String() != tt.expected {
+			t.Errorf("Expected client IP %s for %s via %v, got %s", tt.expected, tt.remoteAddr, tt.forwardedFor, ip)
+		}
+	}
+
+	if err := SetTrustedProxies([]string{"10.0.0.0/33"}); err == nil {
+		t.Errorf("Expected an error for an invalid network")
+	}
+}
@@ -1,22 +1,36 @@
 package loadbalancer
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/spf13/viper"
 )
 
+var errPoolSaturated = errors.New("all backends are at max connections")
+
 type ServerPool struct {
 	backends  []*Backend
 	mux       sync.RWMutex
 	algorithm Algorithm
 	sessions  map[string]*Backend
+	zoneAware *ZoneAware
+	// maxConnections caps the requests in flight to the whole pool, if set
+	maxConnections int
+	connections    int
+	// Requests wait up to queueTimeout for a connection slot. released
+	// is closed and replaced whenever a slot is freed, to wake them up.
+	queueTimeout time.Duration
+	released     chan struct{}
+	queued       int
+	connMux      sync.Mutex
 }
 
 func (s *ServerPool) AddBackend(backend *Backend) {
@@ -26,6 +40,12 @@ func (s *ServerPool) AddBackend(backend *Backend) {
 	log.Printf("Added a new backend with url %s", backend.URL)
 }
 
+func (s *ServerPool) Backends() []*Backend {
+	s.mux.RLock()
+	defer s.mux.RUnlock()
+	return append([]*Backend(nil), s.backends...)
+}
+
 func (s *ServerPool) RemoveBackend(URL string) error {
 	s.mux.Lock()
 	defer s.mux.Unlock()
@@ -59,33 +79,234 @@ func (s *ServerPool) AssignSessionToBackend(sessionID string, backend *Backend)
 }
 
 func (s *ServerPool) GetNextPeer(r *http.Request) *Backend {
+	peer, _ := s.nextPeer(r)
+	return peer
+}
+
+// nextPeer picks a backend that isn't saturated. If there's none, it
+// reports whether that's because of saturated backends.
+func (s *ServerPool) nextPeer(r *http.Request) (*Backend, bool) {
 	//Check if sessionID exists in the request cookies
 	var sessionID *http.Cookie
 	var err error
 
+	tags := GetTagsFromContext(r)
+
 	useStickySessions := viper.GetBool("use_sticky_sessions")
 	if useStickySessions {
 		sessionID, err = r.Cookie("SESSION_ID")
 		if err == nil && sessionID != nil {
 			backend := s.GetBackendBySessionID(sessionID.Value)
-			if backend != nil {
-				return backend
+			if backend != nil && backend.HasTags(tags) && !backend.saturated() {
+				return backend, false
 			}
 		}
 	}
 
 	//There is no valid session, use an algorithm
 	//to assign backend and store it
-	newBackend := s.algorithm.SelectBackend(s.backends)
+	candidates := s.candidates(r)
+	available := candidates
+	for i, b := range candidates {
+		if !b.saturated() {
+			continue
+		}
+		// Copy on the first saturated backend, to keep the pool's slice
+		if len(available) == len(candidates) {
+			available = append([]*Backend(nil), candidates[:i]...)
+		}
+		for _, b := range candidates[i+1:] {
+			if !b.saturated() {
+				available = append(available, b)
+			}
+		}
+		break
+	}
+
+	newBackend := s.algorithm.SelectBackend(available)
 	if newBackend == nil {
-		return nil
+		return nil, len(available) < len(candidates)
 	}
 
 	if useStickySessions && sessionID != nil && sessionID.Value != "" {
 		s.AssignSessionToBackend(sessionID.Value, newBackend)
 	}
 
-	return newBackend
+	return newBackend, false
+}
+
+func (s *ServerPool) SetMaxConnections(maxConnections int) {
+	s.connMux.Lock()
+	defer s.connMux.Unlock()
+	s.maxConnections = maxConnections
+}
+
+func (s *ServerPool) SetQueueTimeout(timeout time.Duration) {
+	s.connMux.Lock()
+	defer s.connMux.Unlock()
+	s.queueTimeout = timeout
+}
+
+// tryAcquirePeer picks a backend and takes a connection slot of it and
+// of the pool.
+func (s *ServerPool) tryAcquirePeer(r *http.Request, peer *Backend) (*Backend, error) {
+	s.connMux.Lock()
+	if s.maxConnections > 0 && s.connections >= s.maxConnections {
+		s.connMux.Unlock()
+		return nil, errPoolSaturated
+	}
+	s.connections++
+	s.connMux.Unlock()
+
+	if peer != nil {
+		if peer.tryAcquire() {
+			return peer, nil
+		}
+		s.releaseSlot()
+		return nil, errPoolSaturated
+	}
+
+	// Another request may take the last slot of the picked backend
+	// between picking and acquiring it, so try a few times
+	err := errPoolSaturated
+	for i := 0; i < 3; i++ {
+		peer, saturated := s.nextPeer(r)
+		if peer == nil {
+			if !saturated {
+				err = nil
+			}
+			break
+		}
+		if peer.tryAcquire() {
+			return peer, nil
+		}
+	}
+
+	s.releaseSlot()
+	return nil, err
+}
+
+// AcquirePeer picks a backend for the request and takes one of its
+// connection slots, to be given back with ReleasePeer. While the pool or
+// every backend is saturated, the request waits in a queue for up to the
+// queue timeout, after which errPoolSaturated is returned. A nil backend
+// without an error means no backend is available at all.
+func (s *ServerPool) AcquirePeer(r *http.Request) (*Backend, error) {
+	return s.acquirePeer(r, nil)
+}
+
+// AcquireBackend takes a connection slot of the given backend, waiting as
+// AcquirePeer does.
+func (s *ServerPool) AcquireBackend(r *http.Request, backend *Backend) error {
+	_, err := s.acquirePeer(r, backend)
+	return err
+}
+
+// acquirePeer takes a slot of the given backend, or of the one picked for
+// the request if nil.
+func (s *ServerPool) acquirePeer(r *http.Request, backend *Backend) (*Backend, error) {
+	start := time.Now()
+	var timer *time.Timer
+	for {
+		s.connMux.Lock()
+		released := s.released
+		timeout := s.queueTimeout
+		s.connMux.Unlock()
+
+		peer, err := s.tryAcquirePeer(r, backend)
+		if err != errPoolSaturated || timeout <= 0 {
+			if timer != nil {
+				timer.Stop()
+				DefaultMetrics.Observe("swindlr_connection_queue_wait_seconds", Labels{"pool": GetPoolFromContext(r)}, time.Since(start).Seconds())
+			}
+			return peer, err
+		}
+
+		if timer == nil {
+			timer = time.NewTimer(timeout)
+			s.queue(r, 1)
+			defer s.queue(r, -1)
+		}
+		select {
+		case <-released:
+		case <-timer.C:
+			DefaultMetrics.Observe("swindlr_connection_queue_wait_seconds", Labels{"pool": GetPoolFromContext(r)}, time.Since(start).Seconds())
+			return nil, errPoolSaturated
+		case <-r.Context().Done():
+			timer.Stop()
+			return nil, r.Context().Err()
+		}
+	}
+}
+
+// queue updates the number of requests waiting for a connection slot.
+func (s *ServerPool) queue(r *http.Request, delta int) {
+	s.connMux.Lock()
+	defer s.connMux.Unlock()
+	s.queued += delta
+	DefaultMetrics.SetGauge("swindlr_connection_queue_depth", Labels{"pool": GetPoolFromContext(r)}, float64(s.queued))
+}
+
+// ReleasePeer gives back a connection slot taken with AcquirePeer, and
+// wakes up the requests waiting for one.
+func (s *ServerPool) ReleasePeer(peer *Backend) {
+	peer.DecrementConnections()
+	s.releaseSlot()
+}
+
+func (s *ServerPool) releaseSlot() {
+	s.connMux.Lock()
+	defer s.connMux.Unlock()
+	s.connections--
+	close(s.released)
+	s.released = make(chan struct{})
+}
+
+// candidates returns the backends the algorithm picks from. Only
+// backends carrying all of the request's tags are considered. If the
+// request has a region preference, the backends of the first region in
+// the list with healthy backends are used, or all of them if no region
+// has any. Zone-aware routing is applied last.
+func (s *ServerPool) candidates(r *http.Request) []*Backend {
+	tags := GetTagsFromContext(r)
+	regions := GetRegionsFromContext(r)
+	if len(tags) == 0 && len(regions) == 0 && s.zoneAware == nil {
+		return s.backends
+	}
+
+	s.mux.RLock()
+	var tagged []*Backend
+	for _, b := range s.backends {
+		if b.HasTags(tags) {
+			tagged = append(tagged, b)
+		}
+	}
+	s.mux.RUnlock()
+
+	candidates := tagged
+	for _, region := range regions {
+		var local []*Backend
+		for _, b := range tagged {
+			b.mux.RLock()
+			if b.Region == region && b.Alive {
+				local = append(local, b)
+			}
+			b.mux.RUnlock()
+		}
+		if len(local) > 0 {
+			candidates = local
+			break
+		}
+	}
+
+	if s.zoneAware != nil {
+		return s.zoneAware.Filter(candidates)
+	}
+	return candidates
+}
+
+func (s *ServerPool) SetZoneAware(zoneAware *ZoneAware) {
+	s.zoneAware = zoneAware
 }
 
 func (s *ServerPool) MarkBackendStatus(backendUrl *url.URL, alive bool) {
@@ -111,10 +332,11 @@ func NewServerPool(algorithm Algorithm) *ServerPool {
 	return &ServerPool{
 		algorithm: algorithm,
 		sessions:  make(map[string]*Backend),
+		released:  make(chan struct{}),
 	}
 }
 
-func SetupServerPool(backendURLs []string, strategy string) *ServerPool {
+func SetupServerPool(backends []BackendConfig, strategy string) *ServerPool {
 	var algo Algorithm
 	switch strategy {
 	case "round_robin":
@@ -131,13 +353,22 @@ func SetupServerPool(backendURLs []string, strategy string) *ServerPool {
 	}
 
 	serverPool := NewServerPool(algo)
+	serverPool.SetQueueTimeout(viper.GetDuration("connection_queue.timeout"))
+
+	if zone := viper.GetString("zone"); zone != "" && viper.GetBool("zone_aware_routing.enabled") {
+		serverPool.SetZoneAware(NewZoneAware(zone, viper.GetFloat64("zone_aware_routing.min_healthy_percent")))
+	}
 
-	for _, urlStr := range backendURLs {
-		parsedURL, err := url.Parse(urlStr)
+	for _, cfg := range backends {
+		parsedURL, err := url.Parse(cfg.URL)
 		if err != nil {
 			log.Fatalf("Error parsing backend URL: %s", err)
 		}
 		backend := CreateNewBackend(parsedURL, serverPool)
+		backend.Tags = cfg.Tags
+		backend.Region = strings.ToLower(cfg.Region)
+		backend.Zone = cfg.Zone
+		backend.MaxConnections = cfg.MaxConnections
 		serverPool.AddBackend(backend)
 	}
 
@@ -5,6 +5,7 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"testing"
+	"time"
 
 	"github.com/spf13/viper"
 )
@@ -131,3 +132,159 @@ func TestStickySessions(t *testing.T) {
 		}
 	})
 }
+
+func TestMaxConnectionsSkipsSaturated(t *testing.T) {
+	sp := NewServerPool(&RoundRobin{})
+	limited := &Backend{URL: parseURL("http://limited.test"), Alive: true, MaxConnections: 1}
+	other := &Backend{URL: parseURL("http://other.test"), Alive: true, MaxConnections: 2}
+	sp.backends = []*Backend{limited, other}
+	req := httptest.NewRequest("GET", "/", nil)
+
+	var acquired []*Backend
+	for i := 0; i < 3; i++ {
+		peer, err := sp.AcquirePeer(req)
+		if err != nil || peer == nil {
+			t.Fatalf("Expected request %d to get a backend, got %v", i, err)
+		}
+		acquired = append(acquired, peer)
+	}
+	if limited.Connections != 1 || other.Connections != 2 {
+		t.Errorf("Expected backends to be filled up to their max, got %d and %d", limited.Connections, other.Connections)
+	}
+
+	if _, err := sp.AcquirePeer(req); err != errPoolSaturated {
+		t.Errorf("Expected saturated backends to be reported, got %v", err)
+	}
+	if peer := sp.GetNextPeer(req); peer != nil {
+		t.Errorf("Expected no backend to be picked, got %s", peer.URL)
+	}
+
+	sp.ReleasePeer(acquired[0])
+	if peer, err := sp.AcquirePeer(req); err != nil || peer != acquired[0] {
+		t.Errorf("Expected the released backend to be picked again, got %v", err)
+	}
+}
+
+func TestPoolMaxConnections(t *testing.T) {
+	sp := NewServerPool(&RoundRobin{})
+	sp.backends = []*Backend{{URL: parseURL("http://backend1.test"), Alive: true}}
+	sp.SetMaxConnections(1)
+	req := httptest.NewRequest("GET", "/", nil)
+
+	peer, err := sp.AcquirePeer(req)
+	if err != nil || peer == nil {
+		t.Fatalf("Expected a backend, got %v", err)
+	}
+	if _, err := sp.AcquirePeer(req); err != errPoolSaturated {
+		t.Errorf("Expected the pool to be saturated, got %v", err)
+	}
+	sp.ReleasePeer(peer)
+	if _, err := sp.AcquirePeer(req); err != nil {
+		t.Errorf("Expected a backend once a connection was released, got %v", err)
+	}
+}
+
+func TestConnectionQueue(t *testing.T) {
+	sp := NewServerPool(&RoundRobin{})
+	sp.backends = []*Backend{{URL: parseURL("http://backend1.test"), Alive: true, MaxConnections: 1}}
+	sp.SetQueueTimeout(time.Second)
+	req := httptest.NewRequest("GET", "/", nil)
+
+	peer, _ := sp.AcquirePeer(req)
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		sp.ReleasePeer(peer)
+	}()
+
+	start := time.Now()
+	queued, err := sp.AcquirePeer(req)
+	if err != nil || queued != peer {
+		t.Fatalf("Expected the queued request to get the backend, got %v", err)
+	}
+	if waited := time.Since(start); waited < 40*time.Millisecond {
+		t.Errorf("Expected the request to wait for a free connection, waited %s", waited)
+	}
+
+	sp.SetQueueTimeout(20 * time.Millisecond)
+	start = time.Now()
+	if _, err := sp.AcquirePeer(req); err != errPoolSaturated {
+		t.Errorf("Expected the queue to time out, got %v", err)
+	}
+	if waited := time.Since(start); waited < 20*time.Millisecond {
+		t.Errorf("Expected the request to wait for the queue timeout, waited %s", waited)
+	}
+}
+
+func TestSaturatedPoolResponse(t *testing.T) {
+	sp := NewServerPool(&RoundRobin{})
+	sp.backends = []*Backend{{URL: parseURL("http://backend1.test"), Alive: true, MaxConnections: 1}}
+	sp.AcquirePeer(httptest.NewRequest("GET", "/", nil))
+
+	rec := httptest.NewRecorder()
+	proxy(rec, httptest.NewRequest("GET", "/", nil), sp)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected status %d, got %d", http.StatusServiceUnavailable, rec.Code)
+	}
+	if rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("Expected Retry-After to be 1, got %q", rec.Header().Get("Retry-After"))
+	}
+}
+
+func TestRateLimitQueueReleasesConnection(t *testing.T) {
+	viper.Set("rate_limiting.rate", 5)
+	viper.Set("rate_limiting.bucket_size", 1)
+	viper.Set("rate_limiting.queue.enabled", true)
+	viper.Set("rate_limiting.queue.max_delay", time.Second)
+	viper.Set("rate_limiting.queue.max_depth", 10)
+	defer func() {
+		viper.Set("rate_limiting.rate", 10.0)
+		viper.Set("rate_limiting.bucket_size", 5)
+		viper.Set("rate_limiting.queue.enabled", false)
+	}()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	serverURL, _ := url.Parse(server.URL)
+	sp := NewServerPool(&RoundRobin{})
+	backend := CreateNewBackend(serverURL, sp)
+	backend.MaxConnections = 1
+	sp.backends = []*Backend{backend}
+
+	rec := httptest.NewRecorder()
+	proxy(rec, httptest.NewRequest("GET", "/", nil), sp)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("Expected the first request to pass, got %d", rec.Code)
+	}
+
+	queued := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rec := httptest.NewRecorder()
+		proxy(rec, httptest.NewRequest("GET", "/", nil), sp)
+		queued <- rec
+	}()
+	for {
+		backend.mux.RLock()
+		waiting := backend.queued
+		backend.mux.RUnlock()
+		if waiting > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The backend's only connection slot is free while the request waits
+	// for its turn
+	peer, err := sp.AcquirePeer(httptest.NewRequest("GET", "/", nil))
+	if err != nil || peer != backend {
+		t.Errorf("Expected the connection slot to be free, got %v", err)
+	} else {
+		sp.ReleasePeer(peer)
+	}
+
+	if rec := <-queued; rec.Code != http.StatusOK {
+		t.Errorf("Expected the queued request to pass, got %d", rec.Code)
+	}
+	if backend.ConnectionLimit() != 1 || backend.Connections != 0 {
+		t.Errorf("Expected all connection slots to be released, %d in use", backend.Connections)
+	}
+}
@@ -0,0 +1,131 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type SplitWeight struct {
+	Pool   string `json:"pool" mapstructure:"pool"`
+	Weight int    `json:"weight" mapstructure:"weight"`
+}
+
+// TrafficSplit divides the requests matching PathPrefix between pools
+// according to percentage weights. When HashOn is set, the split bucket is
+// derived from a cookie or header value instead of being random, so the
+// same user keeps landing on the same side of the split.
+type TrafficSplit struct {
+	Name       string
+	PathPrefix string
+	HashOn     string
+	HashKey    string
+	weights    []SplitWeight
+	mux        sync.RWMutex
+	rand       *rand.Rand
+	randMux    sync.Mutex
+}
+
+func NewTrafficSplit(name, pathPrefix, hashOn, hashKey string, weights []SplitWeight) (*TrafficSplit, error) {
+	switch hashOn {
+	case "", "cookie", "header":
+	default:
+		return nil, fmt.Errorf("invalid hash_on value %q for split %s", hashOn, name)
+	}
+
+	if hashOn != "" && hashKey == "" {
+		return nil, fmt.Errorf("split %s hashes on %s but has no hash_key", name, hashOn)
+	}
+
+	ts := &TrafficSplit{
+		Name:       name,
+		PathPrefix: pathPrefix,
+		HashOn:     hashOn,
+		HashKey:    hashKey,
+		rand:       rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+
+	if err := ts.SetWeights(weights); err != nil {
+		return nil, err
+	}
+	return ts, nil
+}
+
+func (ts *TrafficSplit) Matches(r *http.Request) bool {
+	return strings.HasPrefix(r.URL.Path, ts.PathPrefix)
+}
+
+func (ts *TrafficSplit) Weights() []SplitWeight {
+	ts.mux.RLock()
+	defer ts.mux.RUnlock()
+	return append([]SplitWeight(nil), ts.weights...)
+}
+
+func (ts *TrafficSplit) SetWeights(weights []SplitWeight) error {
+	if len(weights) == 0 {
+		return fmt.Errorf("split %s has no weights", ts.Name)
+	}
+
+	total := 0
+	for _, w := range weights {
+		if w.Weight < 0 {
+			return fmt.Errorf("split %s has a negative weight for pool %s", ts.Name, w.Pool)
+		}
+		total += w.Weight
+	}
+	if total != 100 {
+		return fmt.Errorf("split %s weights add up to %d, expected 100", ts.Name, total)
+	}
+
+	ts.mux.Lock()
+	ts.weights = append([]SplitWeight(nil), weights...)
+	ts.mux.Unlock()
+	return nil
+}
+
+// PickPool returns the name of the pool the request should be sent to.
+func (ts *TrafficSplit) PickPool(r *http.Request) string {
+	bucket := ts.bucket(r)
+
+	ts.mux.RLock()
+	defer ts.mux.RUnlock()
+
+	cumulative := 0
+	for _, w := range ts.weights {
+		cumulative += w.Weight
+		if bucket < cumulative {
+			return w.Pool
+		}
+	}
+	return ts.weights[len(ts.weights)-1].Pool
+}
+
+// bucket maps the request onto [0, 100). Requests without the hash key
+// fall back to a random bucket.
+func (ts *TrafficSplit) bucket(r *http.Request) int {
+	if value := ts.hashValue(r); value != "" {
+		h := fnv.New32a()
+		h.Write([]byte(ts.Name + ":" + value))
+		return int(h.Sum32() % 100)
+	}
+
+	ts.randMux.Lock()
+	defer ts.randMux.Unlock()
+	return ts.rand.Intn(100)
+}
+
+func (ts *TrafficSplit) hashValue(r *http.Request) string {
+	switch ts.HashOn {
+	case "cookie":
+		if cookie, err := r.Cookie(ts.HashKey); err == nil {
+			return cookie.Value
+		}
+	case "header":
+		return r.Header.Get(ts.HashKey)
+	}
+	return ""
+}
@@ -0,0 +1,91 @@
+package loadbalancer
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTrafficSplitWeights(t *testing.T) {
+	_, err := NewTrafficSplit("bad", "/", "", "", []SplitWeight{{Pool: "v1", Weight: 90}})
+	if err == nil {
+		t.Error("Expected an error for weights that don't add up to 100")
+	}
+
+	_, err = NewTrafficSplit("bad", "/", "cookie", "", []SplitWeight{{Pool: "v1", Weight: 100}})
+	if err == nil {
+		t.Error("Expected an error for a hashed split without a hash key")
+	}
+
+	split, err := NewTrafficSplit("all-v2", "/", "", "", []SplitWeight{{Pool: "v1", Weight: 0}, {Pool: "v2", Weight: 100}})
+	if err != nil {
+		t.Fatalf("Failed to create split: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://swindlr.test/", nil)
+	for i := 0; i < 50; i++ {
+		if pool := split.PickPool(req); pool != "v2" {
+			t.Fatalf("Expected pool v2, got %s", pool)
+		}
+	}
+}
+
+func TestTrafficSplitHashMode(t *testing.T) {
+	split, err := NewTrafficSplit("canary", "/", "header", "X-User-ID", []SplitWeight{{Pool: "v1", Weight: 50}, {Pool: "v2", Weight: 50}})
+	if err != nil {
+		t.Fatalf("Failed to create split: %v", err)
+	}
+
+	counts := map[string]int{}
+	for i := 0; i < 200; i++ {
+		req := httptest.NewRequest("GET", "http://swindlr.test/", nil)
+		req.Header.Set("X-User-ID", fmt.Sprintf("user-%d", i))
+
+		first := split.PickPool(req)
+		for j := 0; j < 5; j++ {
+			if pool := split.PickPool(req); pool != first {
+				t.Fatalf("User %d bounced between %s and %s", i, first, pool)
+			}
+		}
+		counts[first]++
+	}
+
+	if counts["v1"] == 0 || counts["v2"] == 0 {
+		t.Errorf("Expected users on both sides of the split, got %v", counts)
+	}
+}
+
+func TestRouterRoute(t *testing.T) {
+	defaultPool := NewServerPool(&RoundRobin{})
+	canaryPool := NewServerPool(&RoundRobin{})
+
+	router := NewRouter(defaultPool)
+	router.AddPool("v2", canaryPool)
+
+	split, _ := NewTrafficSplit("api", "/api", "", "", []SplitWeight{{Pool: DefaultPoolName, Weight: 100}, {Pool: "v2", Weight: 0}})
+	if err := router.AddSplit(split); err != nil {
+		t.Fatalf("Failed to add split: %v", err)
+	}
+
+	req := httptest.NewRequest("GET", "http://swindlr.test/api/users", nil)
+	if sp, _ := router.Route(req); sp != defaultPool {
+		t.Errorf("Expected the default pool before shifting weights")
+	}
+
+	if err := router.SetSplitWeights("api", []SplitWeight{{Pool: DefaultPoolName, Weight: 0}, {Pool: "v2", Weight: 100}}); err != nil {
+		t.Fatalf("Failed to update weights: %v", err)
+	}
+	if sp, _ := router.Route(req); sp != canaryPool {
+		t.Errorf("Expected the v2 pool after shifting weights")
+	}
+
+	other := httptest.NewRequest(http.MethodGet, "http://swindlr.test/static/app.js", nil)
+	if sp, _ := router.Route(other); sp != defaultPool {
+		t.Errorf("Expected requests outside the split to use the default pool")
+	}
+
+	if err := router.SetSplitWeights("api", []SplitWeight{{Pool: "missing", Weight: 100}}); err == nil {
+		t.Error("Expected an error for an unknown pool")
+	}
+}
@@ -0,0 +1,96 @@
+package loadbalancer
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// ZoneAware keeps traffic inside the local zone while enough of its
+// backends are available, alive and below their connection limit. Below
+// MinHealthyPercent, the local zone gets the share of traffic its
+// remaining capacity can take, its available percentage over
+// MinHealthyPercent, and the rest spills over to the other zones in
+// proportion to their available backends.
+type ZoneAware struct {
+	LocalZone         string
+	MinHealthyPercent float64
+	rand              *rand.Rand
+	mux               sync.Mutex
+}
+
+func NewZoneAware(localZone string, minHealthyPercent float64) *ZoneAware {
+	return &ZoneAware{
+		LocalZone:         localZone,
+		MinHealthyPercent: minHealthyPercent,
+		rand:              rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+func (z *ZoneAware) Filter(backends []*Backend) []*Backend {
+	var local, remote []*Backend
+	var remoteZones []string
+	byZone := map[string][]*Backend{}
+	localTotal := 0
+	for _, b := range backends {
+		if b.Zone == z.LocalZone {
+			localTotal++
+			if b.available() {
+				local = append(local, b)
+			}
+			continue
+		}
+		if !b.available() {
+			continue
+		}
+		if _, ok := byZone[b.Zone]; !ok {
+			remoteZones = append(remoteZones, b.Zone)
+		}
+		byZone[b.Zone] = append(byZone[b.Zone], b)
+		remote = append(remote, b)
+	}
+
+	if len(local) == 0 || len(remote) == 0 {
+		if len(local) > 0 {
+			return local
+		}
+		if len(remote) > 0 {
+			return z.spill(remoteZones, byZone, len(remote))
+		}
+		// Nothing is available, so let the pool wait for a connection
+		return backends
+	}
+
+	share := 1.0
+	if z.MinHealthyPercent > 0 {
+		share = float64(len(local)) / float64(localTotal) * 100 / z.MinHealthyPercent
+	}
+	if share >= 1 {
+		return local
+	}
+
+	z.mux.Lock()
+	stayLocal := z.rand.Float64() < share
+	z.mux.Unlock()
+
+	if stayLocal {
+		return local
+	}
+	return z.spill(remoteZones, byZone, len(remote))
+}
+
+// spill picks a remote zone with a probability proportional to its
+// available backends, and returns them.
+func (z *ZoneAware) spill(zones []string, byZone map[string][]*Backend, total int) []*Backend {
+	z.mux.Lock()
+	n := z.rand.Intn(total)
+	z.mux.Unlock()
+
+	for _, zone := range zones {
+		if n < len(byZone[zone]) {
+			return byZone[zone]
+		}
+		n -= len(byZone[zone])
+	}
+	return byZone[zones[len(zones)-1]]
+}
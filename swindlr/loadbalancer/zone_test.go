@@ -0,0 +1,134 @@
+package loadbalancer
+
+import (
+	"net/http/httptest"
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func zoneBackends() (a1, a2, b1 *Backend) {
+	a1 = &Backend{URL: parseURL("http://a1.test"), Alive: true, Zone: "zone-a"}
+	a2 = &Backend{URL: parseURL("http://a2.test"), Alive: true, Zone: "zone-a"}
+	b1 = &Backend{URL: parseURL("http://b1.test"), Alive: true, Zone: "zone-b"}
+	return a1, a2, b1
+}
+
+func TestZoneAwareStaysLocal(t *testing.T) {
+	viper.Set("use_sticky_sessions", false)
+
+	algorithms := map[string]Algorithm{
+		"round_robin":       &RoundRobin{},
+		"least_connections": &LeastConnections{},
+		"random":            NewRandom(),
+		"latency_aware":     &LatencyAware{},
+	}
+
+	for name, algo := range algorithms {
+		t.Run(name, func(t *testing.T) {
+			a1, a2, b1 := zoneBackends()
+			b1.Latency = 0
+			a1.Latency, a2.Latency = 10, 20
+
+			sp := NewServerPool(algo)
+			sp.AddBackend(a1)
+			sp.AddBackend(a2)
+			sp.AddBackend(b1)
+			sp.SetZoneAware(NewZoneAware("zone-a", 70))
+
+			req := httptest.NewRequest("GET", "http://swindlr.test/", nil)
+			for i := 0; i < 20; i++ {
+				if peer := sp.GetNextPeer(req); peer.Zone != "zone-a" {
+					t.Fatalf("Expected an in-zone backend, got %s", peer.URL)
+				}
+			}
+		})
+	}
+}
+
+func TestZoneAwareSpillover(t *testing.T) {
+	a1, a2, b1 := zoneBackends()
+	a2.Alive = false
+	z := NewZoneAware("zone-a", 70)
+
+	local, remote := 0, 0
+	for i := 0; i < 1000; i++ {
+		selected := z.Filter([]*Backend{a1, a2, b1})
+		if len(selected) == 1 && selected[0] == a1 {
+			local++
+		} else if len(selected) == 1 && selected[0] == b1 {
+			remote++
+		} else {
+			t.Fatalf("Unexpected selection %v", selected)
+		}
+	}
+
+	// Half of the local zone is healthy, which can take 50/70 of the
+	// traffic
+	if local < 620 || local > 800 {
+		t.Errorf("Expected about 71%% of the traffic to stay local, got %d local and %d remote", local, remote)
+	}
+
+	a1.Alive = false
+	if selected := z.Filter([]*Backend{a1, a2, b1}); len(selected) != 1 || selected[0] != b1 {
+		t.Errorf("Expected all traffic to spill over when the local zone is down")
+	}
+}
+
+func TestZoneAwareSaturatedBackends(t *testing.T) {
+	a1, a2, b1 := zoneBackends()
+	a1.MaxConnections, a1.Connections = 1, 1
+	a2.MaxConnections, a2.Connections = 1, 1
+	z := NewZoneAware("zone-a", 70)
+
+	// A local zone at its connection limits spills over like a down one
+	for i := 0; i < 20; i++ {
+		if selected := z.Filter([]*Backend{a1, a2, b1}); len(selected) != 1 || selected[0] != b1 {
+			t.Fatalf("Expected saturated local backends to spill over, got %v", selected)
+		}
+	}
+
+	a2.Connections = 0
+	local := 0
+	for i := 0; i < 1000; i++ {
+		if selected := z.Filter([]*Backend{a1, a2, b1}); len(selected) == 1 && selected[0] == a2 {
+			local++
+		}
+	}
+	if local < 620 || local > 800 {
+		t.Errorf("Expected about 71%% of the traffic to stay local, got %d", local)
+	}
+
+	// With everything saturated, all backends are left to wait on
+	a2.Connections = 1
+	b1.MaxConnections, b1.Connections = 1, 1
+	if selected := z.Filter([]*Backend{a1, a2, b1}); len(selected) != 3 {
+		t.Errorf("Expected all backends when none is available, got %v", selected)
+	}
+}
+
+func TestZoneAwareSpilloverByCapacity(t *testing.T) {
+	a1 := &Backend{URL: parseURL("http://a1.test"), Zone: "zone-a"}
+	b1 := &Backend{URL: parseURL("http://b1.test"), Alive: true, Zone: "zone-b"}
+	b2 := &Backend{URL: parseURL("http://b2.test"), Alive: true, Zone: "zone-b"}
+	b3 := &Backend{URL: parseURL("http://b3.test"), Zone: "zone-b"}
+	c1 := &Backend{URL: parseURL("http://c1.test"), Alive: true, Zone: "zone-c"}
+	z := NewZoneAware("zone-a", 70)
+
+	zoneB := 0
+	for i := 0; i < 900; i++ {
+		selected := z.Filter([]*Backend{a1, b1, b2, b3, c1})
+		switch {
+		case len(selected) == 2 && selected[0] == b1 && selected[1] == b2:
+			zoneB++
+		case len(selected) == 1 && selected[0] == c1:
+		default:
+			t.Fatalf("Unexpected selection %v", selected)
+		}
+	}
+
+	// zone-b has two available backends and zone-c one
+	if zoneB < 520 || zoneB > 680 {
+		t.Errorf("Expected about two thirds of the traffic in zone-b, got %d of 900", zoneB)
+	}
+}
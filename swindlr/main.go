@@ -5,7 +5,6 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"time"
 
 	"github.com/b0gdanp3trovic/swindlr/api"
 	"github.com/b0gdanp3trovic/swindlr/loadbalancer"
@@ -26,37 +25,88 @@ func main() {
 	initConfig(customPath)
 
 	port := viper.GetInt("port")
-	backendURLs := viper.GetStringSlice("backends")
+	backends := loadbalancer.BackendConfigs("backends")
 	useSSL := viper.GetBool("use_ssl")
 	certPath := viper.GetString("ssl_cert_file")
 	keyPath := viper.GetString("ssl_key_file")
 	useDynamic := viper.GetBool("use_dynamic")
 	strategy := viper.GetString("load_balancer.strategy")
 
-	serverPool := loadbalancer.SetupServerPool(backendURLs, strategy)
+	loadbalancer.SetupTrustedProxies()
+	loadbalancer.SetupJWTVerifier()
+	loadbalancer.SetupDistributedRateLimiter()
+	serverPool := loadbalancer.SetupServerPool(backends, strategy)
+	serverPool.SetMaxConnections(viper.GetInt("max_connections"))
+	router := loadbalancer.SetupRouter(serverPool)
+	mirror := loadbalancer.SetupMirror(router)
+	geoRouter := loadbalancer.SetupGeoRouter()
+	clientLimiter := loadbalancer.SetupClientRateLimiter()
+	policies := loadbalancer.SetupRateLimitPolicies()
 
-	cache := loadbalancer.NewCache(5 * time.Minute)
+	cache := loadbalancer.SetupCache()
 
 	server := http.Server{
 		Addr: fmt.Sprintf(":%d", port),
-		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			loadbalancer.LB(w, r, serverPool, cache)
-		}),
+		Handler: loadbalancer.GeoMiddleware(geoRouter, loadbalancer.ClientRateLimitMiddleware(clientLimiter, loadbalancer.MirrorMiddleware(mirror, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			sp, r := router.Route(r)
+			loadbalancer.RateLimitPolicyMiddleware(policies, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				loadbalancer.LB(w, r, sp, cache)
+			})).ServeHTTP(w, r)
+		})))),
 	}
 
-	go loadbalancer.Health(serverPool)
+	for _, sp := range router.Pools() {
+		go loadbalancer.Health(sp)
+	}
 	go loadbalancer.ManageHealthUpdate()
 
 	// Prepare API endpoints
 	if useDynamic {
 		gin.SetMode(gin.ReleaseMode)
 		apiRouter := gin.Default()
+		audit := api.NewAuditLog(viper.GetInt("audit_log.max_entries"))
 		apiRouter.POST("/api/backends", func(c *gin.Context) {
 			api.AddBackend(c, serverPool)
 		})
 		apiRouter.DELETE("/api/backends/:url", func(c *gin.Context) {
 			api.RemoveBackend(c, serverPool)
 		})
+		apiRouter.GET("/api/splits", func(c *gin.Context) {
+			api.GetSplits(c, router)
+		})
+		apiRouter.PUT("/api/splits/:name", func(c *gin.Context) {
+			api.UpdateSplit(c, router)
+		})
+		apiRouter.GET("/api/rules", func(c *gin.Context) {
+			api.GetRules(c, router)
+		})
+		apiRouter.POST("/api/rules", func(c *gin.Context) {
+			api.AddRule(c, router)
+		})
+		apiRouter.PUT("/api/rules", func(c *gin.Context) {
+			api.SetRules(c, router)
+		})
+		apiRouter.DELETE("/api/rules/:name", func(c *gin.Context) {
+			api.RemoveRule(c, router)
+		})
+		apiRouter.GET("/api/concurrency", func(c *gin.Context) {
+			api.ConcurrencyLimits(c, router)
+		})
+		apiRouter.GET("/api/cache/stats", func(c *gin.Context) {
+			api.CacheStats(c, cache)
+		})
+		apiRouter.POST("/api/cache/purge", func(c *gin.Context) {
+			api.PurgeCache(c, cache, audit)
+		})
+		apiRouter.DELETE("/api/cache", func(c *gin.Context) {
+			api.FlushCache(c, cache, audit)
+		})
+		apiRouter.GET("/api/audit", func(c *gin.Context) {
+			api.GetAuditLog(c, audit)
+		})
+		apiRouter.GET("/metrics", func(c *gin.Context) {
+			api.Metrics(c)
+		})
 
 		// run API server
 		go func() {